@@ -0,0 +1,293 @@
+//! Admin API giving operators a look at a running instance, and a few actions on it.
+//! The HTTP server itself is left to the binary: it hands requests to Admin::handle.
+
+use crate::client;
+use crate::flags::Flags;
+use crate::instance::{handler_flag, Instance, Ready};
+use crate::middleware::Recent;
+use crate::stats::Collector;
+use serde_json::{json, Value};
+
+/// Answer to an admin request, the body is JSON.
+#[derive(Debug, PartialEq)]
+pub struct Reply {
+    pub status: u16,
+    pub body: String,
+}
+
+impl Reply {
+    fn json(status: u16, body: Value) -> Self {
+        Self {
+            status,
+            body: body.to_string(),
+        }
+    }
+
+    fn error(status: u16, message: &str) -> Self {
+        Self::json(status, json!({ "error": message }))
+    }
+}
+
+/// Admin serves, to requests authenticated with token:
+///  * `GET /info`: version of the bot
+///  * `GET /health`: whether the instance runs and is connected
+///  * `GET /stats`: see stats::Stats
+///  * `GET /handlers`: names of the post handlers enabled by the current flags
+///  * `GET /events`: recent events, see middleware::Recent
+///  * `POST /flags/reload`: reload flags, see with_flags_reload
+pub struct Admin {
+    token: String,
+    collector: Collector,
+    ready: Ready,
+    handlers: Vec<String>,
+    flags: Flags,
+    flagged: bool,
+    reload: Option<Reload>,
+    recent: Option<Recent>,
+}
+
+type Reload = Box<dyn Fn() -> Result<(), String> + Send + Sync>;
+
+impl Admin {
+    /// Admin of instance, token must not be empty.
+    pub fn new<C>(token: &str, instance: &Instance<C>) -> Self
+    where
+        C: client::Sender + client::Notifier,
+    {
+        Self {
+            token: token.to_string(),
+            collector: instance.collector(),
+            ready: instance.ready(),
+            handlers: instance.handler_names(),
+            flags: instance.flags(),
+            flagged: instance.flagged_handlers(),
+            reload: None,
+            recent: None,
+        }
+    }
+
+    /// Reload flags with reload, usually Instance::reload_flags of a shared instance.
+    pub fn with_flags_reload<F>(mut self, reload: F) -> Self
+    where
+        F: Fn() -> Result<(), String> + Send + Sync + 'static,
+    {
+        self.reload = Some(Box::new(reload));
+        self
+    }
+
+    pub fn with_recent(mut self, recent: Recent) -> Self {
+        self.recent = Some(recent);
+        self
+    }
+
+    fn authorized(&self, authorization: Option<&str>) -> bool {
+        match authorization.and_then(|a| a.strip_prefix("Bearer ")) {
+            Some(token) => !self.token.is_empty() && same_token(&self.token, token),
+            None => false,
+        }
+    }
+
+    /// Handlers enabled now, flags may have been reloaded since new().
+    fn enabled_handlers(&self) -> Vec<&str> {
+        self.handlers
+            .iter()
+            .filter(|name| !self.flagged || self.flags.flag(&handler_flag(name)))
+            .map(|name| name.as_str())
+            .collect()
+    }
+
+    /// authorization is the value of the Authorization header, as `Bearer <token>`.
+    pub fn handle(
+        &self,
+        method: &str,
+        path: &str,
+        authorization: Option<&str>,
+    ) -> Reply {
+        if !self.authorized(authorization) {
+            return Reply::error(401, "invalid token");
+        }
+
+        match (method, path) {
+            ("GET", "/info") => Reply::json(
+                200,
+                json!({
+                    "version": env!("CARGO_PKG_VERSION"),
+                    "git_hash": crate::BUILD_GIT_HASH,
+                }),
+            ),
+            ("GET", "/health") => {
+                let stats = self.collector.snapshot();
+                Reply::json(
+                    200,
+                    json!({
+                        "ready": self.ready.is_ready(),
+                        "connection": format!("{:?}", stats.connection),
+                    }),
+                )
+            }
+            ("GET", "/stats") => {
+                let stats = self.collector.snapshot();
+                Reply::json(
+                    200,
+                    json!({
+                        "events": stats.events,
+                        "reconnects": stats.reconnects,
+                        "last_reconnect": stats.last_reconnect.map(|t| t.to_rfc3339()),
+                        "last_error": stats.last_error,
+                        "slow_handlers": stats.slow_handlers,
+                        "shed_events": stats.shed_events,
+                        "connection": format!("{:?}", stats.connection),
+                    }),
+                )
+            }
+            ("GET", "/handlers") => Reply::json(200, json!(self.enabled_handlers())),
+            ("GET", "/events") => match &self.recent {
+                Some(recent) => {
+                    let events: Vec<Value> = recent
+                        .recent_events()
+                        .iter()
+                        .map(|e| {
+                            json!({
+                                "kind": e.kind,
+                                "channel_id": e.channel_id,
+                                "content": e.content,
+                                "at": e.at.to_rfc3339(),
+                            })
+                        })
+                        .collect();
+                    Reply::json(200, json!(events))
+                }
+                None => Reply::error(404, "recent events are not kept"),
+            },
+            ("POST", "/flags/reload") => match &self.reload {
+                Some(reload) => match reload() {
+                    Ok(()) => Reply::json(200, json!({ "reloaded": true })),
+                    Err(e) => Reply::error(500, &e),
+                },
+                None => Reply::error(404, "no flags file"),
+            },
+            (_, "/info")
+            | (_, "/health")
+            | (_, "/stats")
+            | (_, "/handlers")
+            | (_, "/events")
+            | (_, "/flags/reload") => Reply::error(405, "method not allowed"),
+            _ => Reply::error(404, "not found"),
+        }
+    }
+}
+
+/// Compares tokens in a time that depends on their length only, not on where they
+/// differ, so they cannot be guessed from response times.
+fn same_token(expected: &str, given: &str) -> bool {
+    let (expected, given) = (expected.as_bytes(), given.as_bytes());
+    expected.len() == given.len()
+        && expected
+            .iter()
+            .zip(given)
+            .fold(0, |diff, (a, b)| diff | (a ^ b))
+            == 0
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::handler::Debug;
+    use crate::middleware::Middleware;
+    use crate::models::{Event, Post};
+    use crate::testing::Recorder;
+
+    fn admin() -> Admin {
+        let mut instance = Instance::new(Recorder::new());
+        instance.add_post_handler(Box::new(Debug::new("debug")));
+        Admin::new("secret", &instance)
+    }
+
+    fn get(admin: &Admin, path: &str) -> (u16, Value) {
+        let reply = admin.handle("GET", path, Some("Bearer secret"));
+        (reply.status, serde_json::from_str(&reply.body).unwrap())
+    }
+
+    #[test]
+    fn admin_token() {
+        let admin = admin();
+        assert_eq!(401, admin.handle("GET", "/stats", None).status);
+        assert_eq!(
+            401,
+            admin.handle("GET", "/stats", Some("Bearer nope")).status
+        );
+        assert_eq!(401, admin.handle("GET", "/stats", Some("secret")).status);
+        assert_eq!(
+            200,
+            admin.handle("GET", "/stats", Some("Bearer secret")).status
+        );
+
+        let instance = Instance::new(Recorder::new());
+        let open = Admin::new("", &instance);
+        assert_eq!(401, open.handle("GET", "/stats", Some("Bearer ")).status);
+
+        assert!(same_token("secret", "secret"));
+        assert!(!same_token("secret", "secreT"));
+        assert!(!same_token("secret", "secret2"));
+    }
+
+    #[test]
+    fn admin_handlers_flagged() {
+        let mut instance = Instance::new(Recorder::new());
+        instance.add_post_handler(Box::new(Debug::new("debug")));
+        instance.set_flagged_handlers(true);
+        let admin = Admin::new("secret", &instance);
+        assert_eq!(json!([]), get(&admin, "/handlers").1);
+
+        instance
+            .flags()
+            .reload(crate::flags::Flags::parse("handler.debug").unwrap());
+        assert_eq!(json!(["debug"]), get(&admin, "/handlers").1);
+    }
+
+    #[test]
+    fn admin_endpoints() {
+        let recent = Recent::new(5);
+        recent
+            .process(&mut Event::Post(Post::with_message("hello")))
+            .unwrap();
+        let admin = admin().with_recent(recent);
+
+        let (status, health) = get(&admin, "/health");
+        assert_eq!(200, status);
+        assert_eq!(false, health["ready"]);
+        assert_eq!("Disconnected", health["connection"]);
+
+        let (_, stats) = get(&admin, "/stats");
+        assert_eq!(0, stats["events"]);
+        assert_eq!(json!(["debug"]), get(&admin, "/handlers").1);
+        assert_eq!("hello", get(&admin, "/events").1[0]["content"]);
+        assert!(get(&admin, "/info").1["version"].is_string());
+
+        assert_eq!(404, get(&admin, "/nope").0);
+        assert_eq!(
+            405,
+            admin.handle("POST", "/stats", Some("Bearer secret")).status
+        );
+        let reload = admin.handle("POST", "/flags/reload", Some("Bearer secret"));
+        assert_eq!(404, reload.status);
+    }
+
+    #[test]
+    fn admin_reload_flags() {
+        let path = std::env::temp_dir().join("flobot-admin-flags");
+        std::fs::write(&path, "blagues").unwrap();
+        let mut instance = Instance::new(Recorder::new());
+        instance.set_flags_file(path.to_str().unwrap());
+        let flags = instance.flags();
+        let instance = std::sync::Arc::new(instance);
+        let shared = instance.clone();
+        let admin = Admin::new("secret", &instance)
+            .with_flags_reload(move || shared.reload_flags());
+
+        let reload = admin.handle("POST", "/flags/reload", Some("Bearer secret"));
+        assert_eq!(200, reload.status);
+        assert!(flags.flag("blagues"));
+        std::fs::remove_file(path).unwrap();
+    }
+}
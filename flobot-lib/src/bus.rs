@@ -0,0 +1,158 @@
+//! Messages handlers send each other, apart from the events of the backend.
+
+use crate::log::{Level, Logger};
+use std::collections::HashMap;
+use std::panic::{self, AssertUnwindSafe};
+use std::sync::{Arc, Mutex};
+
+pub type Subscriber = Arc<dyn Fn(&str) + Send + Sync>;
+
+#[derive(Default)]
+struct Topics {
+    subscribers: HashMap<String, Vec<Subscriber>>,
+    /// last payload published on each topic, replayed to new subscribers.
+    last: HashMap<String, String>,
+    closed: bool,
+    logger: Logger,
+}
+
+/// Bus delivers payloads published on a topic to its subscribers, from the thread
+/// publishing them. Clones share topics, so a handler can keep one to publish and
+/// another one to subscribe.
+#[derive(Clone, Default)]
+pub struct Bus {
+    topics: Arc<Mutex<Topics>>,
+}
+
+impl Bus {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Log panicking subscribers with logger, for every clone.
+    pub fn set_logger(&self, logger: Logger) {
+        self.topics.lock().unwrap().logger = logger;
+    }
+
+    /// Call f with every payload published on topic. If a payload was already
+    /// published on it, f is called right away with the last one. Returns false,
+    /// without subscribing, once the bus is closed.
+    pub fn subscribe<F: Fn(&str) + Send + Sync + 'static>(
+        &self,
+        topic: &str,
+        f: F,
+    ) -> bool {
+        let subscriber: Subscriber = Arc::new(f);
+        let (last, logger) = {
+            let mut topics = self.topics.lock().unwrap();
+            if topics.closed {
+                return false;
+            }
+            topics
+                .subscribers
+                .entry(topic.to_string())
+                .or_default()
+                .push(subscriber.clone());
+            (topics.last.get(topic).cloned(), topics.logger.clone())
+        };
+        if let Some(payload) = last {
+            Self::deliver(&logger, topic, &[subscriber], &payload);
+        }
+        true
+    }
+
+    /// Send payload to the subscribers of topic, returns how many received it.
+    /// Nothing is sent once the bus is closed.
+    pub fn publish(&self, topic: &str, payload: &str) -> usize {
+        let (subscribers, logger) = {
+            let mut topics = self.topics.lock().unwrap();
+            if topics.closed {
+                return 0;
+            }
+            topics.last.insert(topic.to_string(), payload.to_string());
+            let subscribers = topics.subscribers.get(topic).cloned();
+            (subscribers.unwrap_or_default(), topics.logger.clone())
+        };
+        Self::deliver(&logger, topic, &subscribers, payload)
+    }
+
+    /// A panicking subscriber does not prevent the next ones to receive payload.
+    fn deliver(
+        logger: &Logger,
+        topic: &str,
+        subscribers: &[Subscriber],
+        payload: &str,
+    ) -> usize {
+        subscribers
+            .iter()
+            .filter(|subscriber| {
+                let res = panic::catch_unwind(AssertUnwindSafe(|| subscriber(payload)));
+                if res.is_err() {
+                    logger.log(
+                        Level::Error,
+                        &format!("subscriber of {} panicked", topic),
+                    );
+                }
+                res.is_ok()
+            })
+            .count()
+    }
+
+    /// Drop every subscriber and payload, and refuse new ones.
+    pub fn close(&self) {
+        let mut topics = self.topics.lock().unwrap();
+        topics.subscribers.clear();
+        topics.last.clear();
+        topics.closed = true;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn record(bus: &Bus, topic: &str) -> Arc<Mutex<Vec<String>>> {
+        let received = Arc::new(Mutex::new(vec![]));
+        let r = received.clone();
+        bus.subscribe(topic, move |payload| {
+            r.lock().unwrap().push(payload.to_string())
+        });
+        received
+    }
+
+    #[test]
+    fn bus_publish() {
+        let bus = Bus::new();
+        let first = record(&bus, "werewolf.started");
+        let second = record(&bus.clone(), "werewolf.started");
+        let other = record(&bus, "sms.sent");
+        bus.subscribe("werewolf.started", |_| panic!("broken subscriber"));
+
+        assert_eq!(2, bus.publish("werewolf.started", "channel1"));
+        assert_eq!(vec!["channel1"], *first.lock().unwrap());
+        assert_eq!(vec!["channel1"], *second.lock().unwrap());
+        assert!(other.lock().unwrap().is_empty());
+        assert_eq!(0, bus.publish("nobody", "listens"));
+    }
+
+    #[test]
+    fn bus_replay() {
+        let bus = Bus::new();
+        bus.publish("werewolf.started", "channel1");
+        bus.publish("werewolf.started", "channel2");
+
+        let late = record(&bus, "werewolf.started");
+        assert_eq!(vec!["channel2"], *late.lock().unwrap());
+    }
+
+    #[test]
+    fn bus_close() {
+        let bus = Bus::new();
+        let received = record(&bus, "topic");
+        bus.close();
+
+        assert_eq!(0, bus.publish("topic", "payload"));
+        assert!(!bus.subscribe("topic", |_| {}));
+        assert!(received.lock().unwrap().is_empty());
+    }
+}
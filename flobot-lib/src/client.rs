@@ -1,5 +1,11 @@
+use crate::dialog::Dialog;
 use crate::models::*;
+use chrono::{DateTime, Utc};
+use std::collections::HashMap;
 use std::convert::From;
+use std::sync::mpsc;
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
 
 impl From<reqwest::Error> for Error {
     fn from(e: reqwest::Error) -> Error {
@@ -43,12 +49,186 @@ pub type Result<T> = std::result::Result<T, Error>;
 pub trait Sender {
     fn post(&self, post: &Post) -> Result<()>;
     fn reaction(&self, post: &Post, reaction: &str) -> Result<()>;
+    /// remove a reaction the bot added to post.
+    fn remove_reaction(&self, post: &Post, reaction: &str) -> Result<()>;
     fn reply(&self, post: &Post, message: &str) -> Result<()>;
+    /// send message on post's channel, visible only to the author of post.
+    fn ephemeral(&self, post: &Post, message: &str) -> Result<()>;
+}
+
+/// Send posts that are referred to afterwards, to reply to or edit them.
+pub trait Creator {
+    /// Send post and return it as created by the backend, with its id.
+    fn create_post(&self, post: &Post) -> Result<Post>;
 }
 
 pub trait Editor {
     /// edit an existing post so it contains message instead.
     fn edit(&self, post: &Post, message: &str) -> Result<()>;
+    /// delete an existing post.
+    fn delete(&self, post: &Post) -> Result<()>;
+}
+
+/// Post messages that don't stay around for long.
+pub trait Expiring {
+    /// Send post and delete it once ttl elapsed. Returns the created post.
+    fn post_with_ttl(&self, post: &Post, ttl: Duration) -> Result<Post>;
+}
+
+/// Post messages that must reach the channel, even when the backend refuses them.
+pub trait Critical {
+    /// Send post, or its message to a fallback destination when the backend refuses
+    /// it. The fallback may be seen by other people than the members of the channel
+    /// of post: only use it for messages that can be shared.
+    fn post_critical(&self, post: &Post) -> Result<()>;
+}
+
+/// Post messages that must be sent once, even when the handler sending them retries.
+pub trait Idempotent {
+    /// Send post, unless a post was already sent with key within the dedup window,
+    /// in which case nothing is sent. Returns the created, or original, post.
+    fn post_once(&self, post: &Post, key: &str) -> Result<Post>;
+}
+
+/// Where SeenPosts remembers the posts sent with an idempotency key. Bot processes
+/// sharing a store do not send a post again once one of them sent it.
+pub trait SentStore: Send + Sync {
+    /// Post sent with key, and when it was sent.
+    fn sent(
+        &self,
+        key: &str,
+    ) -> std::result::Result<Option<(DateTime<Utc>, Post)>, String>;
+    /// Remember post as sent with key at, for window. Posts sent before may be
+    /// forgotten once their window elapsed.
+    fn remember(
+        &self,
+        key: &str,
+        at: DateTime<Utc>,
+        post: &Post,
+        window: Duration,
+    ) -> std::result::Result<(), String>;
+}
+
+/// Sent posts kept in memory, forgotten when the bot restarts.
+#[derive(Default)]
+struct InMemory {
+    posts: Mutex<HashMap<String, (DateTime<Utc>, Post)>>,
+}
+
+impl SentStore for InMemory {
+    fn sent(
+        &self,
+        key: &str,
+    ) -> std::result::Result<Option<(DateTime<Utc>, Post)>, String> {
+        Ok(self.posts.lock().unwrap().get(key).cloned())
+    }
+
+    fn remember(
+        &self,
+        key: &str,
+        at: DateTime<Utc>,
+        post: &Post,
+        window: Duration,
+    ) -> std::result::Result<(), String> {
+        let mut posts = self.posts.lock().unwrap();
+        let expired = at - chrono::Duration::from_std(window).unwrap();
+        posts.retain(|_, (sent, _)| *sent >= expired);
+        posts.insert(key.to_string(), (at, post.clone()));
+        Ok(())
+    }
+}
+
+/// Posts sent with an idempotency key, remembered for window. Clones share them.
+/// Posts are kept in memory unless with_store is given a store.
+#[derive(Clone)]
+pub struct SeenPosts {
+    window: Duration,
+    store: Arc<dyn SentStore>,
+    /// keys being sent, so that concurrent retries of a key cannot both send.
+    sending: Arc<Mutex<HashMap<String, Arc<Mutex<()>>>>>,
+}
+
+impl Default for SeenPosts {
+    fn default() -> Self {
+        Self::new(Duration::from_secs(600))
+    }
+}
+
+impl SeenPosts {
+    pub fn new(window: Duration) -> Self {
+        Self {
+            window,
+            store: Arc::new(InMemory::default()),
+            sending: Arc::default(),
+        }
+    }
+
+    /// Remember sent posts in store instead of memory.
+    pub fn with_store<S: SentStore + 'static>(mut self, store: S) -> Self {
+        self.store = Arc::new(store);
+        self
+    }
+
+    /// Returns the post sent with key within window, or call send and remember the
+    /// post it returns. Posts with the same key are sent one at a time, so that
+    /// concurrent retries cannot both send. Failed sends are not remembered.
+    pub fn send_once<F>(&self, key: &str, send: F) -> Result<Post>
+    where
+        F: FnOnce() -> Result<Post>,
+    {
+        self.send_once_at(key, Utc::now(), send)
+    }
+
+    fn send_once_at<F>(&self, key: &str, now: DateTime<Utc>, send: F) -> Result<Post>
+    where
+        F: FnOnce() -> Result<Post>,
+    {
+        let lock = self
+            .sending
+            .lock()
+            .unwrap()
+            .entry(key.to_string())
+            .or_default()
+            .clone();
+        let res = {
+            let _sending = lock.lock().unwrap();
+            self.send_locked(key, now, send)
+        };
+
+        // nobody else waits on the key: forget its lock.
+        let mut sending = self.sending.lock().unwrap();
+        if Arc::strong_count(&lock) == 2 {
+            sending.remove(key);
+        }
+        res
+    }
+
+    fn send_locked<F>(&self, key: &str, now: DateTime<Utc>, send: F) -> Result<Post>
+    where
+        F: FnOnce() -> Result<Post>,
+    {
+        let expired = now - chrono::Duration::from_std(self.window).unwrap();
+        match self.store.sent(key).map_err(Error::Other)? {
+            Some((sent, post)) if sent >= expired => return Ok(post),
+            _ => (),
+        }
+        let post = send()?;
+        if let Err(e) = self.store.remember(key, now, &post, self.window) {
+            println!(
+                "cannot remember post {} sent with key {}: {}",
+                post.id, key, e
+            );
+        }
+        Ok(post)
+    }
+}
+
+/// Send posts at a later time with the backend.
+pub trait Scheduler {
+    /// Send post at the given time, returns the id of the scheduled post. None means
+    /// the backend has no scheduled posts, see schedule::Jobs::schedule to fall back
+    /// on jobs.
+    fn schedule(&self, post: &Post, at: DateTime<Utc>) -> Result<Option<String>>;
 }
 
 pub trait Channel {
@@ -59,13 +239,89 @@ pub trait Channel {
         name: &str,
         users: &Vec<String>,
     ) -> Result<String>;
+    /// Creates a channel named name on team_id. If the name is already taken, the
+    /// existing channel is returned instead, unless it is archived.
+    fn create(
+        &self,
+        team_id: &str,
+        name: &str,
+        display_name: &str,
+        public: bool,
+    ) -> Result<ChannelInfo>;
     /// Archive given channel.
     fn archive(&self, channel_id: &str) -> Result<()>;
+    /// Set the notification preferences of the bot on channel_id, like
+    /// `desktop` or `mark_unread`. Props that are not given are left untouched.
+    fn notify_props(
+        &self,
+        channel_id: &str,
+        props: &HashMap<String, String>,
+    ) -> Result<()>;
 }
 
 pub trait Getter {
     fn my_user_id(&self) -> &str;
     fn users_by_ids(&self, ids: Vec<&str>) -> Result<Vec<User>>;
+    /// The team the bot works with, see conf::Conf.
+    fn team(&self) -> Result<Team>;
+    /// Unread counts of the bot on channel_id.
+    fn unread(&self, channel_id: &str) -> Result<ChannelUnread>;
+    /// Channels of the team where the bot has unread mentions. Empty when there are none.
+    fn unread_mentions(&self) -> Result<Vec<ChannelUnread>>;
+    /// URL opening post_id in the web client. Posts out of any team, like direct
+    /// messages, are linked through the team the bot works with.
+    fn permalink(&self, post_id: &str) -> Result<String>;
+    fn channel(&self, channel_id: &str) -> Result<ChannelInfo>;
+    /// Tells if name is a custom emoji of the server. Standard emoji, like `dog`, are
+    /// not custom ones and cannot be looked up, see emoji::is_standard for the common
+    /// ones.
+    fn custom_emoji_exists(&self, name: &str) -> Result<bool>;
+    /// Limits of the server, fetched once. Defaults are used when they could not be.
+    fn limits(&self) -> ServerLimits;
+    /// Posts of the thread started by root_id, root included, in chronological order.
+    /// Deleted posts are left out.
+    fn thread(&self, root_id: &str) -> Result<Vec<Post>>;
+    /// Post post_id with its embeds, reactions and files.
+    fn post_with_metadata(&self, post_id: &str) -> Result<PostDetails>;
+
+    /// Mention token notifying user_id, see mention().
+    fn mention(&self, user_id: &str) -> Result<String> {
+        Ok(self.mention_many(vec![user_id])?.remove(0))
+    }
+
+    /// Mention tokens for every user id, in the same order.
+    fn mention_many(&self, user_ids: Vec<&str>) -> Result<Vec<String>> {
+        let users = self.users_by_ids(user_ids.clone())?;
+        user_ids
+            .iter()
+            .map(|id| match users.iter().find(|u| &u.id == id) {
+                Some(user) => Ok(mention(&user.username)),
+                None => Err(Error::Other(format!("unknown user id {}", id))),
+            })
+            .collect()
+    }
+}
+
+/// Build the mention token for username. Usernames can contain `.`, `-` and `_`:
+/// they must not be escaped, or the backend won't recognize the mention.
+pub fn mention(username: &str) -> String {
+    format!(
+        "@{}",
+        username.trim().trim_start_matches('@').to_lowercase()
+    )
+}
+
+/// Source of events for an instance. The backend connection implements it, tests can
+/// use a fake one emitting scripted events.
+pub trait Listener {
+    /// Send received events to sender. Returns when no more events will come.
+    fn listen(&self, sender: mpsc::Sender<Event>) -> Result<()>;
+}
+
+pub trait Interactive {
+    /// Open dialog for the user who triggered trigger_id, like by clicking a button.
+    /// The submission is sent to url, see dialog::Dialogs.
+    fn open_dialog(&self, trigger_id: &str, url: &str, dialog: &Dialog) -> Result<()>;
 }
 
 /// A Notifier implementation should only send messages to the debugging channel.
@@ -76,3 +332,148 @@ pub trait Notifier {
     fn error(&self, message: &str) -> Result<()>;
     fn required_action(&self, message: &str) -> Result<()>;
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::testing::Recorder;
+
+    fn user(id: &str, username: &str) -> User {
+        User {
+            id: id.to_string(),
+            username: username.to_string(),
+            display_name: username.to_string(),
+        }
+    }
+
+    #[test]
+    fn mention_format() {
+        assert_eq!("@john", mention("john"));
+        assert_eq!("@john", mention("@John "));
+        assert_eq!("@j.doe-_x_", mention("j.doe-_x_"));
+    }
+
+    #[test]
+    fn mention_users() {
+        let client = Recorder::new();
+        client
+            .users
+            .lock()
+            .unwrap()
+            .extend(vec![user("1", "john"), user("2", "jane_doe.")]);
+
+        assert_eq!("@jane_doe.", client.mention("2").unwrap());
+        assert_eq!(
+            vec!["@jane_doe.", "@john"],
+            client.mention_many(vec!["2", "1"]).unwrap()
+        );
+        assert!(client.mention("3").is_err());
+    }
+
+    #[test]
+    fn post_once() {
+        let client = Recorder::new();
+        let post = Post::with_message("report ready");
+        client.post_once(&post, "report:2026-10-14").unwrap();
+        client.post_once(&post, "report:2026-10-14").unwrap();
+        assert_eq!(1, client.posts.lock().unwrap().len());
+
+        client.post_once(&post, "report:2026-10-15").unwrap();
+        assert_eq!(2, client.posts.lock().unwrap().len());
+    }
+
+    #[test]
+    fn post_once_window() {
+        let seen = SeenPosts::new(Duration::from_secs(60));
+        let start = Utc::now();
+        let sent = Arc::new(Mutex::new(0));
+        let send = |message: &str| {
+            let sent = sent.clone();
+            let message = message.to_string();
+            move || {
+                *sent.lock().unwrap() += 1;
+                Ok(Post::with_message(&message))
+            }
+        };
+
+        let first = seen.send_once_at("key", start, send("first")).unwrap();
+        let again = seen.send_once_at("key", start, send("again")).unwrap();
+        assert_eq!("first", first.message);
+        assert_eq!("first", again.message);
+        assert_eq!(1, *sent.lock().unwrap());
+
+        seen.send_once_at("other", start, send("other")).unwrap();
+        let later = start + chrono::Duration::seconds(61);
+        let expired = seen.send_once_at("key", later, send("expired")).unwrap();
+        assert_eq!("expired", expired.message);
+        assert_eq!(3, *sent.lock().unwrap());
+
+        let failed = seen.send_once_at("failed", start, || Err(Error::Status(500)));
+        assert!(failed.is_err());
+        let retried = seen.send_once_at("failed", start, send("retried")).unwrap();
+        assert_eq!("retried", retried.message);
+    }
+
+    #[test]
+    fn post_once_per_key() {
+        let seen = SeenPosts::default();
+        let (started, wait_started) = mpsc::channel();
+        let (release, wait_release) = mpsc::channel::<()>();
+        let slow = {
+            let seen = seen.clone();
+            std::thread::spawn(move || {
+                seen.send_once("slow", || {
+                    started.send(()).unwrap();
+                    wait_release.recv().unwrap();
+                    Ok(Post::with_message("slow"))
+                })
+            })
+        };
+        wait_started.recv().unwrap();
+
+        // sent while the slow key is still sending.
+        let fast = seen.send_once("fast", || Ok(Post::with_message("fast")));
+        assert_eq!("fast", fast.unwrap().message);
+        release.send(()).unwrap();
+        assert_eq!("slow", slow.join().unwrap().unwrap().message);
+        assert!(seen.sending.lock().unwrap().is_empty());
+    }
+
+    #[derive(Clone, Default)]
+    struct Shared(Arc<InMemory>);
+
+    impl SentStore for Shared {
+        fn sent(
+            &self,
+            key: &str,
+        ) -> std::result::Result<Option<(DateTime<Utc>, Post)>, String> {
+            self.0.sent(key)
+        }
+
+        fn remember(
+            &self,
+            key: &str,
+            at: DateTime<Utc>,
+            post: &Post,
+            window: Duration,
+        ) -> std::result::Result<(), String> {
+            self.0.remember(key, at, post, window)
+        }
+    }
+
+    #[test]
+    fn post_once_store() {
+        let store = Shared::default();
+        let first = SeenPosts::default().with_store(store.clone());
+        let second = SeenPosts::default().with_store(store.clone());
+
+        first
+            .send_once("key", || Ok(Post::with_message("first")))
+            .unwrap();
+        let again = second
+            .send_once("key", || Ok(Post::with_message("second")))
+            .unwrap();
+        assert_eq!("first", again.message);
+        assert!(store.sent("key").unwrap().is_some());
+    }
+}
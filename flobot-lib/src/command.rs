@@ -0,0 +1,651 @@
+use crate::client;
+use crate::handler::{Handler, Result};
+use crate::log::{Level, Logger};
+use crate::models::Post;
+use serde::de::DeserializeOwned;
+use std::collections::HashMap;
+use std::marker::PhantomData;
+
+/// Extract arguments of `!name args…` from message.
+fn arguments<'a>(name: &str, message: &'a str) -> Option<&'a str> {
+    let rest = message.strip_prefix('!')?.strip_prefix(name)?;
+    if rest.is_empty() || rest.starts_with(char::is_whitespace) {
+        return Some(rest.trim());
+    }
+    None
+}
+
+/// JsonCommand handles `!name <json>` commands: the JSON payload is decoded into T
+/// before being given to the callback, along with the command post.
+///
+/// Malformed payloads are answered with the parse error, and the callback is not called.
+///
+/// ```text
+/// !cfg {"env": "prod"}
+/// ```
+pub struct JsonCommand<T, C, F> {
+    name: String,
+    help: Option<String>,
+    client: C,
+    callback: F,
+    payload: PhantomData<fn() -> T>,
+}
+
+impl<T, C, F> JsonCommand<T, C, F>
+where
+    T: DeserializeOwned,
+    C: client::Sender,
+    F: Fn(&Post, T) -> Result,
+{
+    pub fn new(name: &str, help: Option<String>, client: C, callback: F) -> Self {
+        Self {
+            name: name.to_string(),
+            help,
+            client,
+            callback,
+            payload: PhantomData,
+        }
+    }
+}
+
+impl<T, C, F> Handler for JsonCommand<T, C, F>
+where
+    T: DeserializeOwned,
+    C: client::Sender,
+    F: Fn(&Post, T) -> Result,
+{
+    type Data = Post;
+
+    fn name(&self) -> String {
+        self.name.clone()
+    }
+
+    fn help(&self) -> Option<String> {
+        self.help.clone()
+    }
+
+    fn handle(&self, post: &Post) -> Result {
+        let payload = match arguments(&self.name, &post.message) {
+            Some(payload) => payload,
+            None => return Ok(()),
+        };
+
+        match serde_json::from_str(payload) {
+            Ok(payload) => (self.callback)(post, payload),
+            Err(e) => {
+                let reply = format!("cannot parse `!{}` payload: {}", self.name, e);
+                Ok(self.client.reply(post, &reply)?)
+            }
+        }
+    }
+}
+
+/// Acknowledge reacts with `ack` to `!name` posts before calling its handler, so users
+/// know slow commands were seen. With an outcome, the reaction is then swapped for the
+/// success or failure one depending on the handler result. Reactions that fail are
+/// logged, the result is always the one of the handler.
+pub struct Acknowledge<H, C> {
+    name: String,
+    handler: H,
+    client: C,
+    ack: String,
+    outcome: Option<(String, String)>,
+    logger: Logger,
+}
+
+impl<H, C> Acknowledge<H, C>
+where
+    H: Handler<Data = Post>,
+    C: client::Sender,
+{
+    pub fn new(name: &str, handler: H, client: C, ack: &str) -> Self {
+        Self {
+            name: name.to_string(),
+            handler,
+            client,
+            ack: ack.to_string(),
+            outcome: None,
+            logger: Logger::default(),
+        }
+    }
+
+    pub fn with_logger(mut self, logger: Logger) -> Self {
+        self.logger = logger;
+        self
+    }
+
+    pub fn with_outcome(mut self, success: &str, failure: &str) -> Self {
+        self.outcome = Some((success.to_string(), failure.to_string()));
+        self
+    }
+}
+
+impl<H, C> Handler for Acknowledge<H, C>
+where
+    H: Handler<Data = Post>,
+    C: client::Sender,
+{
+    type Data = Post;
+
+    fn name(&self) -> String {
+        self.handler.name()
+    }
+
+    fn help(&self) -> Option<String> {
+        self.handler.help()
+    }
+
+    fn handle(&self, post: &Post) -> Result {
+        if arguments(&self.name, &post.message).is_none() {
+            return self.handler.handle(post);
+        }
+
+        let log = |reacted: client::Result<()>| {
+            if let Err(e) = reacted {
+                let message = format!("cannot acknowledge post {}: {:?}", post.id, e);
+                self.logger.log(Level::Warn, &message);
+            }
+        };
+        log(self.client.reaction(post, &self.ack));
+        let res = self.handler.handle(post);
+
+        if let Some((success, failure)) = &self.outcome {
+            log(self.client.remove_reaction(post, &self.ack));
+            let outcome = if res.is_ok() { success } else { failure };
+            log(self.client.reaction(post, outcome));
+        }
+        res
+    }
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum ArgKind {
+    /// a single word.
+    Word,
+    Integer,
+    /// every remaining word, must be the last argument.
+    Text,
+}
+
+#[derive(Clone, Debug)]
+pub struct Arg {
+    name: String,
+    kind: ArgKind,
+    optional: bool,
+    /// inclusive bounds of an ArgKind::Integer argument.
+    range: Option<(i64, i64)>,
+}
+
+impl Arg {
+    fn new(name: &str, kind: ArgKind) -> Self {
+        Self {
+            name: name.to_string(),
+            kind,
+            optional: false,
+            range: None,
+        }
+    }
+
+    pub fn word(name: &str) -> Self {
+        Self::new(name, ArgKind::Word)
+    }
+
+    pub fn integer(name: &str) -> Self {
+        Self::new(name, ArgKind::Integer)
+    }
+
+    pub fn text(name: &str) -> Self {
+        Self::new(name, ArgKind::Text)
+    }
+
+    pub fn optional(mut self) -> Self {
+        self.optional = true;
+        self
+    }
+
+    /// Refuse integers outside of min..=max.
+    pub fn range(mut self, min: i64, max: i64) -> Self {
+        self.range = Some((min, max));
+        self
+    }
+
+    fn usage(&self) -> String {
+        match (self.kind, self.optional) {
+            (ArgKind::Text, false) => format!("<{}…>", self.name),
+            (ArgKind::Text, true) => format!("[{}…]", self.name),
+            (_, false) => format!("<{}>", self.name),
+            (_, true) => format!("[{}]", self.name),
+        }
+    }
+}
+
+/// Arguments of a command, by name, as validated against its Arg.
+#[derive(Debug, Default)]
+pub struct Args {
+    values: HashMap<String, String>,
+}
+
+impl Args {
+    pub fn get(&self, name: &str) -> Option<&str> {
+        self.values.get(name).map(String::as_str)
+    }
+
+    /// Value of an ArgKind::Integer argument.
+    pub fn integer(&self, name: &str) -> Option<i64> {
+        self.get(name).and_then(|v| v.parse().ok())
+    }
+}
+
+type Run = Box<dyn Fn(&Post, &Args) -> Result + Send + Sync>;
+
+/// Command run by a Router for `!name args…` posts.
+pub struct Command {
+    name: String,
+    description: String,
+    args: Vec<Arg>,
+    channels: Vec<String>,
+    users: Vec<String>,
+    run: Run,
+}
+
+impl Command {
+    pub fn new<F>(name: &str, description: &str, run: F) -> Self
+    where
+        F: Fn(&Post, &Args) -> Result + Send + Sync + 'static,
+    {
+        Self {
+            name: name.to_string(),
+            description: description.to_string(),
+            args: vec![],
+            channels: vec![],
+            users: vec![],
+            run: Box::new(run),
+        }
+    }
+
+    pub fn arg(mut self, arg: Arg) -> Self {
+        self.args.push(arg);
+        self
+    }
+
+    /// Only run the command in channels. Empty allows every channel.
+    pub fn allow_channels(mut self, channels: Vec<String>) -> Self {
+        self.channels = channels;
+        self
+    }
+
+    /// Only let users, by id, run the command, like conf::Conf::admin_users. Empty
+    /// allows everyone.
+    pub fn allow_users(mut self, users: Vec<String>) -> Self {
+        self.users = users;
+        self
+    }
+
+    pub fn usage(&self) -> String {
+        let mut usage = format!("!{}", self.name);
+        for arg in &self.args {
+            usage.push(' ');
+            usage.push_str(&arg.usage());
+        }
+        usage
+    }
+
+    fn help(&self) -> String {
+        format!("`{}`: {}", self.usage(), self.description)
+    }
+
+    fn allowed(&self, post: &Post) -> bool {
+        let allowed =
+            |list: &Vec<String>, id: &String| list.is_empty() || list.contains(id);
+        allowed(&self.channels, &post.channel_id) && allowed(&self.users, &post.user_id)
+    }
+
+    fn parse(&self, arguments: &str) -> std::result::Result<Args, String> {
+        let mut words = arguments.split_whitespace();
+        let mut args = Args::default();
+        for arg in &self.args {
+            let value = match arg.kind {
+                ArgKind::Text => Some(words.by_ref().collect::<Vec<_>>().join(" "))
+                    .filter(|text| !text.is_empty()),
+                _ => words.next().map(String::from),
+            };
+            match value {
+                Some(value) => {
+                    if arg.kind == ArgKind::Integer {
+                        let integer = value
+                            .parse::<i64>()
+                            .map_err(|_| format!("{} must be an integer", arg.name))?;
+                        match arg.range {
+                            Some((min, max)) if integer < min || integer > max => {
+                                return Err(format!(
+                                    "{} must be between {} and {}",
+                                    arg.name, min, max
+                                ))
+                            }
+                            _ => {}
+                        }
+                    }
+                    args.values.insert(arg.name.clone(), value);
+                }
+                None if arg.optional => {}
+                None => return Err(format!("missing {}", arg.name)),
+            }
+        }
+        if words.next().is_some() {
+            return Err("too many arguments".to_string());
+        }
+        Ok(args)
+    }
+}
+
+/// Router runs the command a post calls, once its author is allowed to and its
+/// arguments are valid. Users are answered with the usage of the command otherwise.
+/// Register it with Instance::add_router so `!help <command>` shows each command.
+pub struct Router<C> {
+    name: String,
+    client: C,
+    commands: Vec<Command>,
+}
+
+impl<C: client::Sender> Router<C> {
+    pub fn new(name: &str, client: C) -> Self {
+        Self {
+            name: name.to_string(),
+            client,
+            commands: vec![],
+        }
+    }
+
+    pub fn add(&mut self, command: Command) -> &mut Self {
+        self.commands.push(command);
+        self
+    }
+
+    /// Help of each command, by command name.
+    pub fn helps(&self) -> Vec<(String, String)> {
+        self.commands
+            .iter()
+            .map(|c| (c.name.clone(), c.help()))
+            .collect()
+    }
+}
+
+impl<C: client::Sender> Handler for Router<C> {
+    type Data = Post;
+
+    fn name(&self) -> String {
+        self.name.clone()
+    }
+
+    /// Every command of the router.
+    fn help(&self) -> Option<String> {
+        if self.commands.is_empty() {
+            return None;
+        }
+        let helps: Vec<String> = self.commands.iter().map(Command::help).collect();
+        Some(helps.join("\n"))
+    }
+
+    fn handle(&self, post: &Post) -> Result {
+        let (command, arguments) = match self
+            .commands
+            .iter()
+            .find_map(|c| arguments(&c.name, &post.message).map(|args| (c, args)))
+        {
+            Some(found) => found,
+            None => return Ok(()),
+        };
+
+        if !command.allowed(post) {
+            let reply = format!("you cannot run `!{}` here", command.name);
+            return Ok(self.client.ephemeral(post, &reply)?);
+        }
+        match command.parse(arguments) {
+            Ok(args) => (command.run)(post, &args),
+            Err(e) => {
+                let reply = format!("{}, usage: `{}`", e, command.usage());
+                Ok(self.client.reply(post, &reply)?)
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::testing::{Down, Recorder};
+    use std::collections::HashMap;
+    use std::sync::{Arc, Mutex};
+
+    type Cfg = HashMap<String, String>;
+
+    fn cfg_command(
+        client: Recorder,
+        got: Arc<Mutex<Vec<Cfg>>>,
+    ) -> impl Handler<Data = Post> {
+        JsonCommand::new("cfg", None, client, move |_post: &Post, cfg: Cfg| {
+            got.lock().unwrap().push(cfg);
+            Ok(())
+        })
+    }
+
+    #[test]
+    fn arguments_match() {
+        assert_eq!(Some("{}"), arguments("cfg", "!cfg {}"));
+        assert_eq!(Some(""), arguments("cfg", "!cfg"));
+        assert_eq!(None, arguments("cfg", "!cfgs {}"));
+        assert_eq!(None, arguments("cfg", "cfg {}"));
+    }
+
+    #[test]
+    fn json_command_valid() {
+        let client = Recorder::new();
+        let got = Arc::new(Mutex::new(vec![]));
+        let command = cfg_command(client.clone(), got.clone());
+
+        command
+            .handle(&Post::with_message(r#"!cfg {"env": "prod"}"#))
+            .unwrap();
+        command.handle(&Post::with_message("!other")).unwrap();
+
+        let got = got.lock().unwrap();
+        assert_eq!(1, got.len());
+        assert_eq!("prod", got[0]["env"]);
+        assert!(client.replied().is_empty());
+    }
+
+    #[test]
+    fn json_command_invalid() {
+        let client = Recorder::new();
+        let got = Arc::new(Mutex::new(vec![]));
+        let command = cfg_command(client.clone(), got.clone());
+
+        command
+            .handle(&Post::with_message(r#"!cfg {"env": prod}"#))
+            .unwrap();
+
+        assert!(got.lock().unwrap().is_empty());
+        let replied = client.replied();
+        assert_eq!(1, replied.len());
+        assert!(replied[0].starts_with("cannot parse `!cfg` payload"));
+    }
+
+    struct Outcome {
+        fail: bool,
+    }
+
+    impl Handler for Outcome {
+        type Data = Post;
+
+        fn name(&self) -> String {
+            "outcome".into()
+        }
+
+        fn help(&self) -> Option<String> {
+            None
+        }
+
+        fn handle(&self, _post: &Post) -> Result {
+            if self.fail {
+                return Err(crate::handler::Error::Other("failed".to_string()));
+            }
+            Ok(())
+        }
+    }
+
+    fn command_post(id: &str, message: &str) -> Post {
+        let mut post = Post::with_message(message);
+        post.id = id.to_string();
+        post
+    }
+
+    #[test]
+    fn acknowledge() {
+        let client = Recorder::new();
+        let ack =
+            Acknowledge::new("build", Outcome { fail: false }, client.clone(), "eyes");
+
+        ack.handle(&command_post("p1", "!build now")).unwrap();
+        ack.handle(&command_post("p2", "build now")).unwrap();
+        assert_eq!(
+            vec![("p1".to_string(), "eyes".to_string())],
+            *client.reactions.lock().unwrap()
+        );
+    }
+
+    #[test]
+    fn acknowledge_outcome() {
+        let client = Recorder::new();
+        let ok =
+            Acknowledge::new("build", Outcome { fail: false }, client.clone(), "eyes")
+                .with_outcome("white_check_mark", "x");
+        let ko =
+            Acknowledge::new("build", Outcome { fail: true }, client.clone(), "eyes")
+                .with_outcome("white_check_mark", "x");
+
+        ok.handle(&command_post("p1", "!build")).unwrap();
+        assert!(ko.handle(&command_post("p2", "!build")).is_err());
+        assert_eq!(
+            vec![
+                ("p1".to_string(), "white_check_mark".to_string()),
+                ("p2".to_string(), "x".to_string())
+            ],
+            *client.reactions.lock().unwrap()
+        );
+    }
+
+    #[test]
+    fn acknowledge_reaction_failed() {
+        let ok = Acknowledge::new("build", Outcome { fail: false }, Down, "eyes")
+            .with_outcome("white_check_mark", "x");
+        let ko = Acknowledge::new("build", Outcome { fail: true }, Down, "eyes")
+            .with_outcome("white_check_mark", "x");
+
+        assert!(ok.handle(&command_post("p1", "!build")).is_ok());
+        match ko.handle(&command_post("p2", "!build")) {
+            Err(crate::handler::Error::Other(e)) => assert_eq!("failed", e),
+            res => panic!("expected the handler error, got {:?}", res),
+        }
+    }
+
+    fn router(client: Recorder, got: Arc<Mutex<Vec<String>>>) -> Router<Recorder> {
+        let mut router = Router::new("commands", client);
+        let weather = got.clone();
+        router.add(
+            Command::new("weather", "forecast of a city", move |_, args: &Args| {
+                weather.lock().unwrap().push(format!(
+                    "{} {}",
+                    args.get("city").unwrap(),
+                    args.integer("days").unwrap_or(1)
+                ));
+                Ok(())
+            })
+            .arg(Arg::word("city"))
+            .arg(Arg::integer("days").range(1, 16).optional()),
+        );
+        router.add(
+            Command::new("say", "say something", move |_, args: &Args| {
+                got.lock()
+                    .unwrap()
+                    .push(args.get("message").unwrap().to_string());
+                Ok(())
+            })
+            .arg(Arg::text("message"))
+            .allow_channels(vec!["town-square".to_string()])
+            .allow_users(vec!["admin".to_string()]),
+        );
+        router
+    }
+
+    fn post_in(channel_id: &str, user_id: &str, message: &str) -> Post {
+        let mut post = Post::with_message(message);
+        post.channel_id = channel_id.to_string();
+        post.user_id = user_id.to_string();
+        post
+    }
+
+    #[test]
+    fn router_arguments() {
+        let client = Recorder::new();
+        let got = Arc::new(Mutex::new(vec![]));
+        let router = router(client.clone(), got.clone());
+
+        router
+            .handle(&Post::with_message("!weather Paris 3"))
+            .unwrap();
+        router.handle(&Post::with_message("!weather Lyon")).unwrap();
+        router.handle(&Post::with_message("!weatherman")).unwrap();
+        router.handle(&Post::with_message("not a command")).unwrap();
+        assert_eq!(vec!["Paris 3", "Lyon 1"], *got.lock().unwrap());
+
+        router.handle(&Post::with_message("!weather")).unwrap();
+        router
+            .handle(&Post::with_message("!weather Paris soon"))
+            .unwrap();
+        router
+            .handle(&Post::with_message("!weather Paris 3 4"))
+            .unwrap();
+        router
+            .handle(&Post::with_message("!weather Paris 99999999999999"))
+            .unwrap();
+        assert_eq!(
+            vec![
+                "missing city, usage: `!weather <city> [days]`",
+                "days must be an integer, usage: `!weather <city> [days]`",
+                "too many arguments, usage: `!weather <city> [days]`",
+                "days must be between 1 and 16, usage: `!weather <city> [days]`",
+            ],
+            client.replied()
+        );
+        assert_eq!(2, got.lock().unwrap().len());
+    }
+
+    #[test]
+    fn router_permissions() {
+        let client = Recorder::new();
+        let got = Arc::new(Mutex::new(vec![]));
+        let router = router(client.clone(), got.clone());
+
+        router
+            .handle(&post_in("town-square", "admin", "!say hello all"))
+            .unwrap();
+        router
+            .handle(&post_in("off-topic", "admin", "!say hello"))
+            .unwrap();
+        router
+            .handle(&post_in("town-square", "user", "!say hello"))
+            .unwrap();
+
+        assert_eq!(vec!["hello all"], *got.lock().unwrap());
+        assert_eq!(2, client.ephemerals.lock().unwrap().len());
+    }
+
+    #[test]
+    fn router_help() {
+        let router = router(Recorder::new(), Arc::default());
+        let help = router.help().unwrap();
+        assert!(help.contains("`!weather <city> [days]`: forecast of a city"));
+        assert!(help.contains("`!say <message…>`: say something"));
+        assert_eq!("weather", router.helps()[0].0);
+    }
+}
@@ -1,3 +1,4 @@
+use crate::log::Level;
 use std::env::var;
 
 #[derive(Debug, Clone)]
@@ -10,10 +11,29 @@ pub struct Conf {
     pub api_url: String,
     /// for any websocket connection to handle.
     pub ws_url: String,
+    /// reconnect the websocket when it fails, or return the error so the caller,
+    /// or a supervisor, can restart the bot cleanly.
+    pub ws_reconnect: bool,
     /// token can contain a serialized data for a backend, such as mattermost, to authenticate the bot.
     pub token: String,
     /// should you want to use a database to maintain states for the bot, use this variable.
     pub db_url: String,
+    /// name of the team the bot works with. can be left empty when the bot
+    /// is member of a single team.
+    pub team_name: Option<String>,
+    /// most verbose level logged, see log::Level.
+    pub log_level: Level,
+    /// at debug level, log one event every log_sample events.
+    pub log_sample: u64,
+    /// maximum number of calls to the backend api running at the same time.
+    pub api_concurrency: usize,
+    /// seconds during which posts sent with the same idempotency key are sent once.
+    pub post_dedup_secs: u64,
+    /// incoming webhook url critical posts are sent to when the api refuses them,
+    /// see client::Critical.
+    pub fallback_webhook: Option<String>,
+    /// ids of the users allowed to run admin commands, see command::Command.
+    pub admin_users: Vec<String>,
 }
 
 impl Conf {
@@ -22,8 +42,35 @@ impl Conf {
             debug_channel: var("BOT_DEBUG_CHAN").expect("BOT_DEBUG_CHAN"),
             api_url: var("BOT_API_URL").expect("BOT_API_URL"),
             ws_url: var("BOT_WS_URL").expect("BOT_WS_URL"),
+            ws_reconnect: var("BOT_WS_RECONNECT")
+                .unwrap_or("true".to_string())
+                .parse()
+                .expect("BOT_WS_RECONNECT"),
             token: var("BOT_TOKEN").expect("BOT_TOKEN"),
             db_url: var("BOT_DB_URL").expect("BOT_DB_URL"),
+            team_name: var("BOT_TEAM_NAME").ok(),
+            log_level: var("BOT_LOG_LEVEL")
+                .unwrap_or("info".to_string())
+                .parse()
+                .expect("BOT_LOG_LEVEL"),
+            log_sample: var("BOT_LOG_SAMPLE")
+                .unwrap_or("1".to_string())
+                .parse()
+                .expect("BOT_LOG_SAMPLE"),
+            api_concurrency: var("BOT_API_CONCURRENCY")
+                .unwrap_or("8".to_string())
+                .parse()
+                .expect("BOT_API_CONCURRENCY"),
+            post_dedup_secs: var("BOT_POST_DEDUP_SECONDS")
+                .unwrap_or("600".to_string())
+                .parse()
+                .expect("BOT_POST_DEDUP_SECONDS"),
+            fallback_webhook: var("BOT_FALLBACK_WEBHOOK_URL").ok(),
+            admin_users: var("BOT_ADMIN_USERS")
+                .unwrap_or_default()
+                .split_whitespace()
+                .map(String::from)
+                .collect(),
         })
     }
 }
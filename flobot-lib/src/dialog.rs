@@ -0,0 +1,276 @@
+//! Interactive dialogs: opened with client::Interactive, their submissions are sent by
+//! the server to a callback url and routed by callback id with Dialogs.
+
+use std::collections::HashMap;
+
+#[derive(Clone, Debug, PartialEq)]
+pub enum ElementKind {
+    Text,
+    Textarea,
+    /// options as (displayed text, value).
+    Select(Vec<(String, String)>),
+}
+
+/// Field of a dialog.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Element {
+    pub kind: ElementKind,
+    pub name: String,
+    pub display_name: String,
+    pub optional: bool,
+}
+
+impl Element {
+    fn new(kind: ElementKind, name: &str, display_name: &str) -> Self {
+        Self {
+            kind,
+            name: name.to_string(),
+            display_name: display_name.to_string(),
+            optional: false,
+        }
+    }
+
+    pub fn text(name: &str, display_name: &str) -> Self {
+        Self::new(ElementKind::Text, name, display_name)
+    }
+
+    pub fn textarea(name: &str, display_name: &str) -> Self {
+        Self::new(ElementKind::Textarea, name, display_name)
+    }
+
+    pub fn select(
+        name: &str,
+        display_name: &str,
+        options: Vec<(String, String)>,
+    ) -> Self {
+        Self::new(ElementKind::Select(options), name, display_name)
+    }
+
+    pub fn optional(mut self) -> Self {
+        self.optional = true;
+        self
+    }
+}
+
+#[derive(Clone, Debug, PartialEq)]
+pub struct Dialog {
+    pub callback_id: String,
+    pub title: String,
+    pub submit_label: Option<String>,
+    /// sent back as is with the submission.
+    pub state: String,
+    pub elements: Vec<Element>,
+}
+
+impl Dialog {
+    pub fn new(callback_id: &str, title: &str) -> Self {
+        Self {
+            callback_id: callback_id.to_string(),
+            title: title.to_string(),
+            submit_label: None,
+            state: "".to_string(),
+            elements: vec![],
+        }
+    }
+
+    pub fn submit_label(mut self, label: &str) -> Self {
+        self.submit_label = Some(label.to_string());
+        self
+    }
+
+    pub fn state(mut self, state: &str) -> Self {
+        self.state = state.to_string();
+        self
+    }
+
+    pub fn element(mut self, element: Element) -> Self {
+        self.elements.push(element);
+        self
+    }
+}
+
+/// Values a user submitted a dialog with, by element name. Elements left empty are
+/// missing from values.
+#[derive(Clone, Debug, Default)]
+pub struct Submission {
+    pub callback_id: String,
+    pub state: String,
+    pub user_id: String,
+    pub channel_id: String,
+    pub team_id: String,
+    pub values: HashMap<String, String>,
+    pub cancelled: bool,
+}
+
+/// Answer to a submission. The dialog closes when there is no error, else it stays
+/// open and shows them.
+#[derive(Clone, Debug, Default, PartialEq)]
+pub struct Response {
+    /// error about the whole submission.
+    pub error: Option<String>,
+    /// errors by element name.
+    pub errors: HashMap<String, String>,
+}
+
+impl Response {
+    pub fn ok() -> Self {
+        Self::default()
+    }
+
+    pub fn error(message: &str) -> Self {
+        Self {
+            error: Some(message.to_string()),
+            errors: HashMap::new(),
+        }
+    }
+
+    pub fn field_error(mut self, name: &str, message: &str) -> Self {
+        self.errors.insert(name.to_string(), message.to_string());
+        self
+    }
+
+    pub fn is_ok(&self) -> bool {
+        self.error.is_none() && self.errors.is_empty()
+    }
+}
+
+pub trait DialogHandler {
+    /// Handle a submission whose required elements are all set.
+    fn submit(&self, submission: &Submission) -> Response;
+}
+
+struct Route {
+    required: Vec<String>,
+    handler: Box<dyn DialogHandler + Send + Sync>,
+}
+
+/// Dialogs routes submissions to the handler of their dialog.
+#[derive(Default)]
+pub struct Dialogs {
+    routes: HashMap<String, Route>,
+}
+
+impl Dialogs {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Route submissions of dialog to handler, replacing the previous handler of
+    /// dialogs with the same callback id.
+    pub fn add<H>(&mut self, dialog: &Dialog, handler: H) -> &mut Self
+    where
+        H: DialogHandler + Send + Sync + 'static,
+    {
+        let required = dialog
+            .elements
+            .iter()
+            .filter(|e| !e.optional)
+            .map(|e| e.name.clone())
+            .collect();
+        self.routes.insert(
+            dialog.callback_id.clone(),
+            Route {
+                required,
+                handler: Box::new(handler),
+            },
+        );
+        self
+    }
+
+    /// Whether no dialog is routed, in which case there is no submission to serve.
+    pub fn is_empty(&self) -> bool {
+        self.routes.is_empty()
+    }
+
+    /// Cancelled submissions are not handled.
+    pub fn submit(&self, submission: &Submission) -> Response {
+        if submission.cancelled {
+            return Response::ok();
+        }
+        let route = match self.routes.get(&submission.callback_id) {
+            Some(route) => route,
+            None => return Response::error("unknown dialog"),
+        };
+
+        let missing = route.required.iter().filter(|name| {
+            submission
+                .values
+                .get(*name)
+                .map_or(true, |v| v.trim().is_empty())
+        });
+        let response = missing.fold(Response::ok(), |response, name| {
+            response.field_error(name, "required")
+        });
+        if !response.is_ok() {
+            return response;
+        }
+        route.handler.submit(submission)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    struct Poll;
+
+    impl DialogHandler for Poll {
+        fn submit(&self, submission: &Submission) -> Response {
+            match submission.values.get("answer").map(String::as_str) {
+                Some("yes") | Some("no") => Response::ok(),
+                _ => Response::ok().field_error("answer", "yes or no"),
+            }
+        }
+    }
+
+    fn submission(callback_id: &str, values: &[(&str, &str)]) -> Submission {
+        Submission {
+            callback_id: callback_id.to_string(),
+            values: values
+                .iter()
+                .map(|(k, v)| (k.to_string(), v.to_string()))
+                .collect(),
+            ..Submission::default()
+        }
+    }
+
+    fn dialogs() -> Dialogs {
+        let poll = Dialog::new("poll", "Poll")
+            .element(Element::text("answer", "Answer"))
+            .element(Element::textarea("comment", "Comment").optional());
+        let mut dialogs = Dialogs::new();
+        dialogs.add(&poll, Poll);
+        dialogs
+    }
+
+    #[test]
+    fn dialog_routing() {
+        let dialogs = dialogs();
+        assert!(!dialogs.is_empty());
+        assert!(Dialogs::new().is_empty());
+        assert!(dialogs
+            .submit(&submission("poll", &[("answer", "yes")]))
+            .is_ok());
+        assert_eq!(
+            Response::error("unknown dialog"),
+            dialogs.submit(&submission("other", &[]))
+        );
+
+        let mut cancelled = submission("other", &[]);
+        cancelled.cancelled = true;
+        assert!(dialogs.submit(&cancelled).is_ok());
+    }
+
+    #[test]
+    fn dialog_field_errors() {
+        let dialogs = dialogs();
+        assert_eq!(
+            Response::ok().field_error("answer", "required"),
+            dialogs.submit(&submission("poll", &[("answer", " "), ("comment", "hm")]))
+        );
+        assert_eq!(
+            Response::ok().field_error("answer", "yes or no"),
+            dialogs.submit(&submission("poll", &[("answer", "maybe")]))
+        );
+    }
+}
@@ -0,0 +1,144 @@
+//! Names of standard emoji, as used in reactions.
+
+/// Commonly used standard emoji, by their Mattermost names. The list is not
+/// exhaustive: a name missing here can still be a valid standard emoji.
+const STANDARD: &[&str] = &[
+    "+1",
+    "-1",
+    "100",
+    "alarm_clock",
+    "angry",
+    "beer",
+    "beers",
+    "bell",
+    "birthday",
+    "blush",
+    "boom",
+    "bow",
+    "bulb",
+    "calendar",
+    "champagne",
+    "clap",
+    "clock1",
+    "coffee",
+    "confused",
+    "construction",
+    "cry",
+    "crying_cat_face",
+    "dancer",
+    "disappointed",
+    "dizzy",
+    "eyes",
+    "facepalm",
+    "fire",
+    "flushed",
+    "frowning",
+    "ghost",
+    "gift",
+    "grimacing",
+    "grin",
+    "grinning",
+    "hand",
+    "heart",
+    "heart_eyes",
+    "heavy_check_mark",
+    "heavy_multiplication_x",
+    "hourglass",
+    "hourglass_flowing_sand",
+    "hugs",
+    "hushed",
+    "innocent",
+    "joy",
+    "kissing_heart",
+    "laughing",
+    "link",
+    "lock",
+    "mag",
+    "man_shrugging",
+    "memo",
+    "moneybag",
+    "muscle",
+    "neutral_face",
+    "no_entry",
+    "ok",
+    "ok_hand",
+    "open_mouth",
+    "pensive",
+    "pizza",
+    "point_down",
+    "point_left",
+    "point_right",
+    "point_up",
+    "pray",
+    "question",
+    "rage",
+    "raised_hands",
+    "relaxed",
+    "relieved",
+    "robot",
+    "rocket",
+    "rofl",
+    "rotating_light",
+    "scream",
+    "see_no_evil",
+    "shrug",
+    "skull",
+    "sleeping",
+    "slightly_smiling_face",
+    "smile",
+    "smiley",
+    "smirk",
+    "sob",
+    "star",
+    "star2",
+    "stuck_out_tongue",
+    "sun_with_face",
+    "sunglasses",
+    "sunny",
+    "sweat",
+    "sweat_smile",
+    "tada",
+    "thinking",
+    "thumbsdown",
+    "thumbsup",
+    "tired_face",
+    "trophy",
+    "unamused",
+    "upside_down_face",
+    "v",
+    "warning",
+    "wave",
+    "weary",
+    "white_check_mark",
+    "wink",
+    "worried",
+    "x",
+    "yum",
+    "zap",
+    "zzz",
+];
+
+/// Tells if name, with or without colons, is in the list of common standard emoji.
+pub fn is_standard(name: &str) -> bool {
+    let name = name.trim_matches(':');
+    STANDARD.binary_search(&name).is_ok()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn standard_sorted() {
+        let mut sorted = STANDARD.to_vec();
+        sorted.sort_unstable();
+        assert_eq!(sorted, STANDARD);
+    }
+
+    #[test]
+    fn standard_names() {
+        assert!(is_standard("ok_hand"));
+        assert!(is_standard(":eyes:"));
+        assert!(!is_standard("not_an_emoji"));
+    }
+}
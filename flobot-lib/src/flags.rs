@@ -0,0 +1,111 @@
+//! Feature flags toggling handler behaviours without a new build.
+
+use crate::log::{Level, Logger};
+use std::collections::HashMap;
+use std::sync::{Arc, RwLock};
+
+/// Flags are shared by clones: handlers keep a clone and check it when handling,
+/// so a reload is seen right away.
+#[derive(Clone, Default)]
+pub struct Flags {
+    flags: Arc<RwLock<HashMap<String, bool>>>,
+    logger: Logger,
+}
+
+impl Flags {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Log with logger when loading, clones made before keep their logger.
+    pub fn with_logger(mut self, logger: Logger) -> Self {
+        self.logger = logger;
+        self
+    }
+
+    /// Parse one flag per line, as `name`, `name=true` or `name=false`.
+    /// Empty lines and lines starting with `#` are ignored.
+    pub fn parse(content: &str) -> Result<HashMap<String, bool>, String> {
+        let mut flags = HashMap::new();
+        for line in content.lines().map(str::trim) {
+            if line.is_empty() || line.starts_with('#') {
+                continue;
+            }
+            let (name, value) = match line.split_once('=') {
+                Some((name, value)) => (
+                    name.trim(),
+                    value
+                        .trim()
+                        .parse()
+                        .map_err(|_| format!("invalid flag value: {}", line))?,
+                ),
+                None => (line, true),
+            };
+            flags.insert(name.to_string(), value);
+        }
+        Ok(flags)
+    }
+
+    /// Tells if the flag is on. Unknown flags are off.
+    pub fn flag(&self, name: &str) -> bool {
+        *self.flags.read().unwrap().get(name).unwrap_or(&false)
+    }
+
+    /// Replace every flag with flags.
+    pub fn reload(&self, flags: HashMap<String, bool>) {
+        *self.flags.write().unwrap() = flags;
+    }
+
+    /// Reload flags from the file at path, see parse(). A missing file turns every
+    /// flag off. Flags are kept as they are if the file cannot be read or parsed.
+    pub fn load(&self, path: &str) -> Result<(), String> {
+        let content = match std::fs::read_to_string(path) {
+            Ok(content) => content,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => {
+                let message = format!("no flags file {}, every flag is off", path);
+                self.logger.log(Level::Info, &message);
+                String::new()
+            }
+            Err(e) => return Err(format!("cannot read flags from {}: {}", path, e)),
+        };
+        self.reload(Self::parse(&content)?);
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn flags_parse() {
+        let flags =
+            Flags::parse("# jokes\nblagues\nmeteo = false\n\nsms=true").unwrap();
+        assert_eq!(3, flags.len());
+        assert_eq!(Some(&true), flags.get("blagues"));
+        assert_eq!(Some(&false), flags.get("meteo"));
+        assert!(Flags::parse("meteo=maybe").is_err());
+    }
+
+    #[test]
+    fn flags_reload() {
+        let flags = Flags::new();
+        let handler_flags = flags.clone();
+        assert!(!handler_flags.flag("blagues"));
+
+        flags.reload(Flags::parse("blagues").unwrap());
+        assert!(handler_flags.flag("blagues"));
+
+        flags.reload(Flags::parse("blagues=false").unwrap());
+        assert!(!handler_flags.flag("blagues"));
+    }
+
+    #[test]
+    fn flags_missing_file() {
+        let flags = Flags::new();
+        flags.reload(Flags::parse("blagues").unwrap());
+        let path = std::env::temp_dir().join("flobot-no-such-flags");
+        assert!(flags.load(path.to_str().unwrap()).is_ok());
+        assert!(!flags.flag("blagues"));
+    }
+}
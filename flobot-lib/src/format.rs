@@ -0,0 +1,119 @@
+//! Markdown formatting helpers.
+
+fn width(s: &str) -> usize {
+    s.chars().count()
+}
+
+/// Longest run of backticks in s.
+fn backticks(s: &str) -> usize {
+    s.split(|c| c != '`')
+        .map(|run| run.len())
+        .max()
+        .unwrap_or(0)
+}
+
+/// Wrap content in a code block. The fence is made longer than any backtick
+/// sequence of content, so content cannot close the block early.
+pub fn code_block(lang: &str, content: &str) -> String {
+    let fence = "`".repeat(backticks(content).max(2) + 1);
+    format!(
+        "{}{}\n{}\n{}",
+        fence,
+        lang,
+        content.trim_end_matches('\n'),
+        fence
+    )
+}
+
+fn escape_cell(cell: &str) -> String {
+    cell.replace('\\', "\\\\")
+        .replace('|', "\\|")
+        .replace('`', "\\`")
+        .replace("\r\n", " ")
+        .replace('\n', " ")
+}
+
+fn table_row(cells: &[String], widths: &[usize]) -> String {
+    let mut row = String::from("|");
+    for (cell, w) in cells.iter().zip(widths.iter()) {
+        row.push_str(&format!(" {}{} |", cell, " ".repeat(w - width(cell))));
+    }
+    row
+}
+
+/// Build a table with aligned columns. Pipes and backticks in cells are escaped,
+/// new lines replaced by spaces. Missing cells are left empty and extra cells dropped.
+pub fn table(headers: &[&str], rows: &[Vec<&str>]) -> String {
+    let headers: Vec<String> = headers.iter().map(|h| escape_cell(h)).collect();
+    let rows: Vec<Vec<String>> = rows
+        .iter()
+        .map(|row| {
+            (0..headers.len())
+                .map(|i| escape_cell(row.get(i).unwrap_or(&"")))
+                .collect()
+        })
+        .collect();
+
+    let widths: Vec<usize> = (0..headers.len())
+        .map(|i| {
+            rows.iter()
+                .map(|row| width(&row[i]))
+                .chain(std::iter::once(width(&headers[i])))
+                .max()
+                .unwrap()
+                .max(3) // the separator needs 3 dashes.
+        })
+        .collect();
+
+    let separator: Vec<String> = widths.iter().map(|w| "-".repeat(*w)).collect();
+    let mut lines = vec![table_row(&headers, &widths), table_row(&separator, &widths)];
+    for row in rows.iter() {
+        lines.push(table_row(row, &widths));
+    }
+    lines.join("\n")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn code_block_simple() {
+        assert_eq!(
+            "```rust\nlet a = 1;\n```",
+            code_block("rust", "let a = 1;\n")
+        );
+        assert_eq!("```\n\n```", code_block("", ""));
+    }
+
+    #[test]
+    fn code_block_backticks() {
+        let block = code_block("md", "```\nnested\n```");
+        assert_eq!("````md\n```\nnested\n```\n````", block);
+    }
+
+    #[test]
+    fn table_aligned() {
+        let table = table(
+            &["name", "count"],
+            &[vec!["jokes", "12"], vec!["triggers", "3"]],
+        );
+        let expect = "\
+| name     | count |
+| -------- | ----- |
+| jokes    | 12    |
+| triggers | 3     |";
+        assert_eq!(expect, table);
+    }
+
+    #[test]
+    fn table_escaped() {
+        let table = table(&["a|b", "c"], &[vec!["`x`", "y\nz"], vec!["é"]]);
+        let expect = "\
+| a\\|b  | c   |
+| ----- | --- |
+| \\`x\\` | y z |
+| é     |     |";
+        assert_eq!(expect, table);
+    }
+}
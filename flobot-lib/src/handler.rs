@@ -1,5 +1,7 @@
 use crate::client;
-use crate::models::Post;
+use crate::middleware::CHANNEL_KIND;
+use crate::models::{ChannelKind, Post};
+use regex::Regex;
 use std::convert::From;
 
 #[derive(Debug)]
@@ -8,6 +10,9 @@ pub enum Error {
     Timeout(String),
     Status(String),
     Other(String),
+    /// message for the author of the post, replied to them instead of being
+    /// reported as an internal error.
+    User(String),
 }
 
 impl From<client::Error> for Error {
@@ -24,8 +29,7 @@ impl From<client::Error> for Error {
 pub type Result = std::result::Result<(), Error>;
 
 /// Handle events after they have been through middleware.
-/// Although Data suggest it is possible to support different types of
-/// event, only Post are supported currently.
+/// Data is either a Post or a PostEdited, see Instance::add_edit_handler.
 pub trait Handler {
     type Data;
     fn name(&self) -> String;
@@ -33,6 +37,72 @@ pub trait Handler {
     fn handle(&self, data: &Self::Data) -> Result;
 }
 
+/// Message a ReplyHandler answers a post with.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Response {
+    pub message: String,
+    /// sent only to the author of the post instead of replied in its thread.
+    pub ephemeral: bool,
+}
+
+impl Response {
+    pub fn new(message: &str) -> Self {
+        Self {
+            message: message.to_string(),
+            ephemeral: false,
+        }
+    }
+
+    pub fn ephemeral(message: &str) -> Self {
+        Self {
+            message: message.to_string(),
+            ephemeral: true,
+        }
+    }
+}
+
+/// ReplyHandler only computes the answer to a post, if any: wrapped in a Replier,
+/// the answer is sent as a threaded reply to the post.
+pub trait ReplyHandler {
+    fn name(&self) -> String;
+    fn help(&self) -> Option<String>;
+    fn reply(&self, post: &Post) -> std::result::Result<Option<Response>, Error>;
+}
+
+/// Replier turns a ReplyHandler into a Handler, sending its responses with client.
+pub struct Replier<R, C> {
+    handler: R,
+    client: C,
+}
+
+impl<R: ReplyHandler, C: client::Sender> Replier<R, C> {
+    pub fn new(handler: R, client: C) -> Self {
+        Self { handler, client }
+    }
+}
+
+impl<R: ReplyHandler, C: client::Sender> Handler for Replier<R, C> {
+    type Data = Post;
+
+    fn name(&self) -> String {
+        self.handler.name()
+    }
+
+    fn help(&self) -> Option<String> {
+        self.handler.help()
+    }
+
+    fn handle(&self, post: &Post) -> Result {
+        match self.handler.reply(post)? {
+            Some(response) if response.ephemeral => {
+                Ok(self.client.ephemeral(post, &response.message)?)
+            }
+            Some(response) => Ok(self.client.reply(post, &response.message)?),
+            None => Ok(()),
+        }
+    }
+}
+
 /// DO NOT USE IN PRODUCTION: Debug handler will PRINT ALL MESSAGES.
 pub struct Debug {
     name: String,
@@ -93,3 +163,206 @@ impl<PH: Handler> Handler for MutexedHandler<PH> {
         self.handler.lock().unwrap().handle(data)
     }
 }
+
+/// MatchRegex calls its handler only for posts matching the regex. Capture groups are
+/// given to the handler in post.metadata: `match.0` holds the whole match, `match.1`
+/// the first group and so on, named groups are also available as `match.<name>`.
+pub struct MatchRegex<H> {
+    regex: Regex,
+    handler: H,
+}
+
+impl<H> MatchRegex<H> {
+    pub fn new(pattern: &str, handler: H) -> std::result::Result<Self, regex::Error> {
+        Ok(Self {
+            regex: Regex::new(pattern)?,
+            handler,
+        })
+    }
+}
+
+impl<H: Handler<Data = Post>> Handler for MatchRegex<H> {
+    type Data = Post;
+
+    fn name(&self) -> String {
+        self.handler.name()
+    }
+
+    fn help(&self) -> Option<String> {
+        self.handler.help()
+    }
+
+    fn handle(&self, post: &Post) -> Result {
+        let captures = match self.regex.captures(&post.message) {
+            Some(captures) => captures,
+            None => return Ok(()),
+        };
+
+        let mut post = post.clone();
+        for (i, name) in self.regex.capture_names().enumerate() {
+            if let Some(capture) = captures.get(i) {
+                let capture = capture.as_str().to_string();
+                if let Some(name) = name {
+                    post.metadata
+                        .insert(format!("match.{}", name), capture.clone());
+                }
+                post.metadata.insert(format!("match.{}", i), capture);
+            }
+        }
+
+        self.handler.handle(&post)
+    }
+}
+
+/// OnChannelKind calls its handler only for posts sent on kind channels, as set by
+/// middleware::ChannelType. Posts of unresolved channels are ignored.
+pub struct OnChannelKind<H> {
+    kind: ChannelKind,
+    handler: H,
+}
+
+impl<H> OnChannelKind<H> {
+    pub fn new(kind: ChannelKind, handler: H) -> Self {
+        Self { kind, handler }
+    }
+
+    /// Handle direct messages only.
+    pub fn direct(handler: H) -> Self {
+        Self::new(ChannelKind::Direct, handler)
+    }
+}
+
+impl<H: Handler<Data = Post>> Handler for OnChannelKind<H> {
+    type Data = Post;
+
+    fn name(&self) -> String {
+        self.handler.name()
+    }
+
+    fn help(&self) -> Option<String> {
+        self.handler.help()
+    }
+
+    fn handle(&self, post: &Post) -> Result {
+        match post.metadata.get(CHANNEL_KIND) {
+            Some(kind) if kind == self.kind.as_str() => self.handler.handle(post),
+            _ => Ok(()),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::testing::Recorder;
+    use std::collections::HashMap;
+    use std::sync::{Arc, Mutex};
+
+    struct Metadata {
+        got: Arc<Mutex<Vec<HashMap<String, String>>>>,
+    }
+
+    impl Handler for Metadata {
+        type Data = Post;
+
+        fn name(&self) -> String {
+            "metadata".into()
+        }
+
+        fn help(&self) -> Option<String> {
+            None
+        }
+
+        fn handle(&self, post: &Post) -> Result {
+            self.got.lock().unwrap().push(post.metadata.clone());
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn match_regex() {
+        let got = Arc::new(Mutex::new(vec![]));
+        let handler = MatchRegex::new(
+            r"^!deploy (?P<env>[a-z]+) ([0-9.]+)$",
+            Metadata { got: got.clone() },
+        )
+        .unwrap();
+
+        handler.handle(&Post::with_message("!deploy")).unwrap();
+        handler
+            .handle(&Post::with_message("deploy prod 1.2"))
+            .unwrap();
+        assert!(got.lock().unwrap().is_empty());
+
+        handler
+            .handle(&Post::with_message("!deploy prod 1.2"))
+            .unwrap();
+        let got = got.lock().unwrap();
+        assert_eq!(1, got.len());
+        assert_eq!("!deploy prod 1.2", got[0]["match.0"]);
+        assert_eq!("prod", got[0]["match.1"]);
+        assert_eq!("prod", got[0]["match.env"]);
+        assert_eq!("1.2", got[0]["match.2"]);
+    }
+
+    #[test]
+    fn on_direct_message() {
+        let got = Arc::new(Mutex::new(vec![]));
+        let handler = OnChannelKind::direct(Metadata { got: got.clone() });
+
+        let mut post = Post::with_message("hi");
+        handler.handle(&post).unwrap();
+        post.metadata
+            .insert(CHANNEL_KIND.to_string(), "public".to_string());
+        handler.handle(&post).unwrap();
+        assert!(got.lock().unwrap().is_empty());
+
+        post.metadata
+            .insert(CHANNEL_KIND.to_string(), "direct".to_string());
+        handler.handle(&post).unwrap();
+        assert_eq!(1, got.lock().unwrap().len());
+    }
+
+    struct Echo {}
+
+    impl ReplyHandler for Echo {
+        fn name(&self) -> String {
+            "echo".into()
+        }
+
+        fn help(&self) -> Option<String> {
+            None
+        }
+
+        fn reply(&self, post: &Post) -> std::result::Result<Option<Response>, Error> {
+            Ok(match post.message.strip_prefix("!echo ") {
+                Some("secret") => Some(Response::ephemeral("secret")),
+                Some(message) => Some(Response::new(message)),
+                None => None,
+            })
+        }
+    }
+
+    #[test]
+    fn replier() {
+        let client = Recorder::new();
+        let handler = Replier::new(Echo {}, client.clone());
+
+        let mut post = Post::with_message("!echo hello");
+        post.id = "p1".to_string();
+        post.user_id = "u1".to_string();
+        handler.handle(&post).unwrap();
+        handler.handle(&Post::with_message("hello")).unwrap();
+        post.message = "!echo secret".to_string();
+        handler.handle(&post).unwrap();
+
+        assert_eq!(
+            vec![("p1".to_string(), "hello".to_string())],
+            *client.replies.lock().unwrap()
+        );
+        assert_eq!(
+            vec![("u1".to_string(), "secret".to_string())],
+            *client.ephemerals.lock().unwrap()
+        );
+    }
+}
@@ -1,12 +1,22 @@
+use crate::bus::Bus;
 use crate::client;
-use crate::handler::Handler;
+use crate::command::Router;
+use crate::flags::Flags;
+use crate::handler::{self, Handler};
+use crate::lifecycle::Lifecycle;
+use crate::limit::PostBudget;
+use crate::log::{Level, Logger};
 use crate::middleware::Continue;
 use crate::middleware::Error as MiddlewareError;
 use crate::middleware::Middleware as MMiddleware;
-use crate::models::{Event, Post, StatusCode, StatusError};
+use crate::models::{Event, Post, PostEdited, StatusCode, StatusError};
+use crate::shed::Shedder;
+use crate::stats::{Collector, Stats};
 use regex::Regex;
 use std::convert::From;
-use std::sync::mpsc::Receiver;
+use std::sync::mpsc::{Receiver, RecvTimeoutError, Sender, TryRecvError};
+use std::sync::{Arc, Condvar, Mutex};
+use std::time::{Duration, Instant};
 
 #[derive(Debug)]
 pub enum Error {
@@ -43,26 +53,297 @@ impl From<MiddlewareError> for Error {
     }
 }
 
+#[derive(Default)]
+struct Stopping {
+    deadline: Option<Instant>,
+    /// events dropped because the deadline passed. set once the instance returned.
+    dropped: Option<u64>,
+    /// sender of the events the instance receives, see Instance::set_event_sender.
+    sender: Option<Sender<Event>>,
+    /// whether stop sent an Event::Shutdown after the events queued.
+    marked: bool,
+}
+
+/// Stopper asks an instance to stop: events already received keep being processed
+/// until the deadline, then the remaining ones are dropped.
+#[derive(Clone, Default)]
+pub struct Stopper {
+    stopping: Arc<(Mutex<Stopping>, Condvar)>,
+}
+
+impl Stopper {
+    /// Stop the instance, giving it timeout to process events already received.
+    /// Returns how many events were dropped, or None when the instance didn't return
+    /// in time, like when a handler is stuck.
+    pub fn stop(&self, timeout: Duration) -> Option<u64> {
+        let (lock, cvar) = &*self.stopping;
+        let mut stopping = lock.lock().unwrap();
+        stopping.deadline = Some(Instant::now() + timeout);
+        // sent before the deadline is seen, so that it follows all the events queued.
+        if let Some(sender) = &stopping.sender {
+            stopping.marked = sender.send(Event::Shutdown).is_ok();
+        }
+        let wait = timeout + Duration::from_secs(1);
+        let (stopping, _) = cvar
+            .wait_timeout_while(stopping, wait, |s| s.dropped.is_none())
+            .unwrap();
+        stopping.dropped
+    }
+
+    fn deadline(&self) -> Option<Instant> {
+        self.stopping.0.lock().unwrap().deadline
+    }
+
+    fn marked(&self) -> bool {
+        self.stopping.0.lock().unwrap().marked
+    }
+
+    fn stopped(&self, dropped: u64) {
+        let (lock, cvar) = &*self.stopping;
+        lock.lock().unwrap().dropped = Some(dropped);
+        cvar.notify_all();
+    }
+}
+
+#[derive(Default)]
+struct Readiness {
+    /// the instance started and processes events.
+    running: bool,
+    /// the backend connection is open, see Lifecycle::connected.
+    connected: bool,
+}
+
+impl Readiness {
+    fn ready(&self) -> bool {
+        self.running && self.connected
+    }
+}
+
+/// Ready tells when an instance processes events received from an open backend
+/// connection. It is not ready anymore while the connection is down.
+#[derive(Clone, Default)]
+pub struct Ready {
+    ready: Arc<(Mutex<Readiness>, Condvar)>,
+}
+
+impl Ready {
+    pub fn is_ready(&self) -> bool {
+        self.ready.0.lock().unwrap().ready()
+    }
+
+    /// Wait for the instance to be ready, up to timeout. Returns false if it is not.
+    pub fn wait(&self, timeout: Duration) -> bool {
+        let (lock, cvar) = &*self.ready;
+        let (readiness, _) = cvar
+            .wait_timeout_while(lock.lock().unwrap(), timeout, |r| !r.ready())
+            .unwrap();
+        readiness.ready()
+    }
+
+    fn update<F: FnOnce(&mut Readiness)>(&self, f: F) {
+        let (lock, cvar) = &*self.ready;
+        f(&mut lock.lock().unwrap());
+        cvar.notify_all();
+    }
+}
+
 pub type PostHandler = Box<dyn Handler<Data = Post> + Send + Sync>;
+pub type EditHandler = Box<dyn Handler<Data = PostEdited> + Send + Sync>;
 pub type Middleware = Box<dyn MMiddleware + Send + Sync>;
 
+/// Calls handler for posts sent on channel_id only.
+struct ChannelHandler {
+    channel_id: String,
+    handler: PostHandler,
+}
+
+impl Handler for ChannelHandler {
+    type Data = Post;
+
+    fn name(&self) -> String {
+        self.handler.name()
+    }
+
+    fn help(&self) -> Option<String> {
+        self.handler.help()
+    }
+
+    fn handle(&self, post: &Post) -> handler::Result {
+        if post.channel_id != self.channel_id {
+            return Ok(());
+        }
+        self.handler.handle(post)
+    }
+}
+
+/// Name of the flag enabling the handler called name, see
+/// Instance::set_flagged_handlers.
+pub fn handler_flag(name: &str) -> String {
+    format!("handler.{}", name)
+}
+
 pub struct Instance<C> {
     middlewares: Vec<Middleware>,
     post_handlers: Vec<PostHandler>,
-    helps: std::collections::HashMap<String, String>,
+    edit_handlers: Vec<EditHandler>,
+    /// helps shown by `!help`, with the name of the handler they belong to.
+    helps: std::collections::HashMap<String, (String, String)>,
     client: C,
+    collector: Collector,
+    stopper: Stopper,
+    logger: Logger,
+    flags: Flags,
+    flags_file: Option<String>,
+    slow_threshold: Option<Duration>,
+    ready: Ready,
+    lifecycle: Lifecycle,
+    bus: Bus,
+    post_budget: Option<PostBudget>,
+    flagged_handlers: bool,
+    shedder: Option<Shedder>,
 }
 
 impl<C: client::Sender + client::Notifier> Instance<C> {
     pub fn new(client: C) -> Self {
+        let ready = Ready::default();
+        let lifecycle = Lifecycle::new();
+        let (connected, disconnected) = (ready.clone(), ready.clone());
+        lifecycle
+            .on_connect(move || connected.update(|r| r.connected = true))
+            .on_disconnect(move || disconnected.update(|r| r.connected = false));
         Instance {
             middlewares: vec![],
             post_handlers: vec![],
+            edit_handlers: vec![],
             helps: std::collections::HashMap::new(),
             client,
+            collector: Collector::new(),
+            stopper: Stopper::default(),
+            logger: Logger::default(),
+            flags: Flags::new(),
+            flags_file: None,
+            slow_threshold: None,
+            ready,
+            lifecycle,
+            bus: Bus::new(),
+            post_budget: None,
+            flagged_handlers: false,
+            shedder: None,
+        }
+    }
+
+    /// Handle telling when this instance is running.
+    pub fn ready(&self) -> Ready {
+        self.ready.clone()
+    }
+
+    /// Warn about handlers taking longer than threshold to handle an event.
+    pub fn set_slow_threshold(&mut self, threshold: Duration) {
+        self.slow_threshold = Some(threshold);
+    }
+
+    /// Reset budget for each post, and stop calling handlers once they spent it
+    /// through their limit::Budgeted clients.
+    pub fn set_post_budget(&mut self, budget: PostBudget) {
+        self.post_budget = Some(budget);
+    }
+
+    /// Feature flags of this instance, shared with the returned clone.
+    pub fn flags(&self) -> Flags {
+        self.flags.clone()
+    }
+
+    pub fn flag(&self, name: &str) -> bool {
+        self.flags.flag(name)
+    }
+
+    /// File flags are read from by reload_flags().
+    pub fn set_flags_file(&mut self, path: &str) {
+        self.flags_file = Some(path.to_string());
+    }
+
+    /// Load flags again from the flags file, see Flags::load.
+    pub fn reload_flags(&self) -> Result<(), String> {
+        match &self.flags_file {
+            Some(path) => self.flags.load(path),
+            None => Err("no flags file".to_string()),
+        }
+    }
+
+    /// Only call handlers whose handler_flag() is on, so the handlers running can be
+    /// picked per environment, and changed by reloading flags.
+    pub fn set_flagged_handlers(&mut self, flagged: bool) {
+        self.flagged_handlers = flagged;
+    }
+
+    /// Whether handlers are picked by their handler_flag(), see set_flagged_handlers.
+    pub fn flagged_handlers(&self) -> bool {
+        self.flagged_handlers
+    }
+
+    /// Whether the handler called name is called, and its helps shown.
+    fn handler_enabled(&self, name: &str) -> bool {
+        !self.flagged_handlers || self.flags.flag(&handler_flag(name))
+    }
+
+    /// Sender of the events given to run(). Stopping then sends an Event::Shutdown
+    /// after the events already queued, so that only they are drained.
+    pub fn set_event_sender(&mut self, sender: Sender<Event>) {
+        self.stopper.stopping.0.lock().unwrap().sender = Some(sender);
+    }
+
+    /// Tell shedder each time an event is taken from the receiver given to run(),
+    /// when the events are forwarded to it by shedder.
+    pub fn set_shedder(&mut self, shedder: Shedder) {
+        self.shedder = Some(shedder);
+    }
+
+    fn taken(&self) {
+        if let Some(shedder) = &self.shedder {
+            shedder.taken();
         }
     }
 
+    /// Log with logger, its flags, lifecycle and bus included.
+    pub fn set_logger(&mut self, logger: Logger) {
+        self.flags = self.flags.clone().with_logger(logger.clone());
+        self.lifecycle.set_logger(logger.clone());
+        self.bus.set_logger(logger.clone());
+        self.logger = logger;
+    }
+
+    /// Logger of this instance, for the parts of the bot logging like it.
+    pub fn logger(&self) -> Logger {
+        self.logger.clone()
+    }
+
+    /// Handle to stop this instance while it runs.
+    pub fn stopper(&self) -> Stopper {
+        self.stopper.clone()
+    }
+
+    /// Bus handlers of this instance communicate through, closed once run() returns.
+    pub fn bus(&self) -> Bus {
+        self.bus.clone()
+    }
+
+    /// Callbacks of this instance, shared with the returned clone. Shutdown
+    /// callbacks run once run() returns, share it with the backend connection for
+    /// the others.
+    pub fn lifecycle(&self) -> Lifecycle {
+        self.lifecycle.clone()
+    }
+
+    /// Share the stats collector of this instance, typically with the backend
+    /// connection so it can report reconnections.
+    pub fn collector(&self) -> Collector {
+        self.collector.clone()
+    }
+
+    pub fn stats(&self) -> Stats {
+        self.collector.snapshot()
+    }
+
     pub fn add_middleware(&mut self, middleware: Middleware) -> &mut Self {
         self.middlewares.push(middleware);
         self
@@ -71,12 +352,51 @@ impl<C: client::Sender + client::Notifier> Instance<C> {
     pub fn add_post_handler(&mut self, handler: PostHandler) -> &mut Self {
         handler.help().and_then(|help| {
             self.helps
-                .insert(handler.name().to_string(), help.to_string())
+                .insert(handler.name(), (handler.name(), help.to_string()))
         });
         self.post_handlers.push(handler);
         self
     }
 
+    /// Call handler with edited posts. Bursts of edits reach it once with
+    /// middleware::Debounce.
+    pub fn add_edit_handler(&mut self, handler: EditHandler) -> &mut Self {
+        self.edit_handlers.push(handler);
+        self
+    }
+
+    /// Add router as a post handler, each of its commands shown by `!help <command>`.
+    pub fn add_router<R>(&mut self, router: Router<R>) -> &mut Self
+    where
+        R: client::Sender + Send + Sync + 'static,
+    {
+        let name = router.name();
+        self.helps.extend(
+            router
+                .helps()
+                .into_iter()
+                .map(|(command, help)| (command, (name.clone(), help))),
+        );
+        self.add_post_handler(Box::new(router))
+    }
+
+    /// Names of the post handlers, in the order they are called.
+    pub fn handler_names(&self) -> Vec<String> {
+        self.post_handlers.iter().map(|h| h.name()).collect()
+    }
+
+    /// Same as add_post_handler, for posts sent on channel_id only.
+    pub fn add_post_handler_for_channel(
+        &mut self,
+        channel_id: &str,
+        handler: PostHandler,
+    ) -> &mut Self {
+        self.add_post_handler(Box::new(ChannelHandler {
+            channel_id: channel_id.to_string(),
+            handler,
+        }))
+    }
+
     fn process_middlewares(&self, event: &mut Event) -> Result<Continue, Error> {
         for middleware in self.middlewares.iter() {
             match middleware.process(event)? {
@@ -91,7 +411,12 @@ impl<C: client::Sender + client::Notifier> Instance<C> {
     fn process_help(&self, post: &Post) -> Result<(), Error> {
         if &post.message == "!help" {
             let mut reply = String::new();
-            let mut keys: Vec<String> = self.helps.keys().map(|v| v.clone()).collect();
+            let mut keys: Vec<String> = self
+                .helps
+                .iter()
+                .filter(|(_, (handler, _))| self.handler_enabled(handler))
+                .map(|(key, _)| key.clone())
+                .collect();
             keys.sort();
             for key in keys.iter() {
                 reply.push_str(&format!("`{}`\n", key));
@@ -107,8 +432,10 @@ impl<C: client::Sender + client::Notifier> Instance<C> {
             Some(captures) => {
                 let name = captures.get(1).unwrap().as_str();
                 match self.helps.get(name) {
-                    Some(m) => self.client.reply(post, m),
-                    None => self.client.reply(post, "tutétrompé"),
+                    Some((handler, m)) if self.handler_enabled(handler) => {
+                        self.client.reply(post, m)
+                    }
+                    _ => self.client.reply(post, "tutétrompé"),
                 }
                 .map_err(client_err)
             }
@@ -116,34 +443,99 @@ impl<C: client::Sender + client::Notifier> Instance<C> {
         }
     }
 
+    fn check_slow(&self, name: &str, event: &str, elapsed: Duration) {
+        match self.slow_threshold {
+            Some(threshold) if elapsed > threshold => {
+                self.collector.slow_handler();
+                self.logger.log(
+                    Level::Warn,
+                    &format!(
+                        "handler {} took {}ms on a {} event",
+                        name,
+                        elapsed.as_millis(),
+                        event
+                    ),
+                );
+            }
+            _ => {}
+        }
+    }
+
     fn process_event_post(&self, post: &Post) -> Result<(), Error> {
         let _ = self.process_help(post)?;
+        if let Some(budget) = &self.post_budget {
+            budget.reset();
+        }
         for handler in self.post_handlers.iter() {
+            if !self.handler_enabled(&handler.name()) {
+                continue;
+            }
+            if self.post_budget.as_ref().map_or(false, PostBudget::spent) {
+                self.logger.log(
+                    Level::Warn,
+                    &format!("post budget spent, {} not called", handler.name()),
+                );
+                continue;
+            }
+            let start = Instant::now();
             let res = handler.handle(post);
+            self.check_slow(&handler.name(), "post", start.elapsed());
             let _ = match res {
                 Ok(_) => {}
-                Err(e) => match self.client.debug(&format!("error: {:?}", e)) {
-                    Ok(_) => {}
-                    Err(e) => println!("debug error: {:?}", e),
-                },
+                Err(handler::Error::User(message)) => {
+                    if let Err(e) = self.client.reply(post, &message) {
+                        println!("user error reply: {:?}", e);
+                    }
+                }
+                Err(e) => {
+                    self.collector.error(&format!(
+                        "handler {}: {:?}",
+                        handler.name(),
+                        e
+                    ));
+                    match self.client.debug(&format!("error: {:?}", e)) {
+                        Ok(_) => {}
+                        Err(e) => println!("debug error: {:?}", e),
+                    }
+                }
             };
         }
         Ok(())
     }
 
+    fn process_event_edited(&self, edited: &PostEdited) -> Result<(), Error> {
+        for handler in self.edit_handlers.iter() {
+            if !self.handler_enabled(&handler.name()) {
+                continue;
+            }
+            let start = Instant::now();
+            let res = handler.handle(edited);
+            self.check_slow(&handler.name(), "edit", start.elapsed());
+            if let Err(e) = res {
+                self.collector
+                    .error(&format!("handler {}: {:?}", handler.name(), e));
+                if let Err(e) = self.client.debug(&format!("error: {:?}", e)) {
+                    self.logger
+                        .log(Level::Warn, &format!("debug error: {:?}", e));
+                }
+            }
+        }
+        Ok(())
+    }
+
     fn process_event(&self, event: &Event) -> Result<(), Error> {
         match event {
             Event::Post(post) => self.process_event_post(post),
-            Event::PostEdited(_edited) => {
-                println!("edits are unsupported for now");
-                Ok(())
-            }
+            Event::PostEdited(edited) => self.process_event_edited(edited),
             Event::Unsupported(_unsupported) => {
                 //println!("unsupported event: {:?}", unsupported);
                 Ok(())
             }
             Event::Hello(hello) => {
-                println!("hello server {:?}", hello.server_string);
+                self.logger.log(
+                    Level::Info,
+                    &format!("hello server {:?}", hello.server_string),
+                );
                 Ok(())
             }
             Event::Status(status) => match status.code {
@@ -157,7 +549,8 @@ impl<C: client::Sender + client::Notifier> Instance<C> {
                         .clone(),
                 )),
                 StatusCode::Unsupported => {
-                    println!("unsupported: {:?}", status);
+                    self.logger
+                        .log(Level::Debug, &format!("unsupported: {:?}", status));
                     Ok(())
                 }
                 StatusCode::Unknown => Err(Error::Other(
@@ -174,14 +567,55 @@ impl<C: client::Sender + client::Notifier> Instance<C> {
     }
 
     fn process(&self, event: &mut Event) -> Result<(), Error> {
-        let res = self.process_middlewares(event)?;
-        match res {
-            Continue::Yes => self.process_event(event),
-            Continue::No => Ok(()),
+        self.collector.event();
+        self.logger.event(event);
+        let res = match self.process_middlewares(event) {
+            Ok(Continue::Yes) => self.process_event(event),
+            Ok(Continue::No) => Ok(()),
+            Err(e) => Err(e),
+        };
+        if let Err(e) = &res {
+            self.collector.error(&e.to_string());
         }
+        res
     }
 
-    pub fn run(&self, receiver: Receiver<Event>) -> Result<(), Error> {
+    /// Process the events queued when the instance was stopped until the deadline,
+    /// dropping the others. With an event sender, events queued are the ones before
+    /// the Event::Shutdown sent at stop, and events sent after are left in receiver.
+    /// Without, events are processed until receiver is empty, and those left at the
+    /// deadline are not counted as dropped.
+    fn drain(
+        &self,
+        receiver: &Receiver<Event>,
+        deadline: Instant,
+    ) -> Result<u64, Error> {
+        let marked = self.stopper.marked();
+        while Instant::now() < deadline {
+            match receiver.try_recv() {
+                Ok(Event::Shutdown) | Err(TryRecvError::Empty) => return Ok(0),
+                Ok(mut event) => {
+                    self.taken();
+                    self.process(&mut event)?
+                }
+                Err(TryRecvError::Disconnected) => return Ok(0),
+            }
+        }
+
+        let mut dropped = 0;
+        while marked {
+            match receiver.try_recv() {
+                Ok(Event::Shutdown) | Err(_) => break,
+                Ok(_) => dropped += 1,
+            }
+        }
+        if dropped > 0 {
+            println!("instance stopped, {} events dropped", dropped);
+        }
+        Ok(dropped)
+    }
+
+    fn run_loop(&self, receiver: Receiver<Event>) -> Result<u64, Error> {
         let mut loaded = String::from("## Loaded middlewares\n");
         for m in self.middlewares.iter() {
             loaded.push_str(&format!(" * `{}`\n", m.name()));
@@ -192,13 +626,21 @@ impl<C: client::Sender + client::Notifier> Instance<C> {
         }
 
         let _ = self.client.startup(&loaded)?;
+        self.ready.update(|r| r.running = true);
 
         loop {
-            match receiver.recv() {
-                Ok(mut event) => match event {
-                    Event::Shutdown => return Ok(()),
-                    _ => self.process(&mut event)?,
-                },
+            if let Some(deadline) = self.stopper.deadline() {
+                return self.drain(&receiver, deadline);
+            }
+
+            // wake up regularly to notice stop requests.
+            match receiver.recv_timeout(Duration::from_millis(100)) {
+                Ok(Event::Shutdown) => return Ok(0),
+                Ok(mut event) => {
+                    self.taken();
+                    self.process(&mut event)?
+                }
+                Err(RecvTimeoutError::Timeout) => {}
                 Err(rte) => {
                     return Err(Error::Consumer(format!(
                         "receiving channel error: {}",
@@ -208,4 +650,502 @@ impl<C: client::Sender + client::Notifier> Instance<C> {
             };
         }
     }
+
+    /// Process events from receiver until an Event::Shutdown is received, or the
+    /// instance is stopped through its stopper().
+    pub fn run(&self, receiver: Receiver<Event>) -> Result<(), Error> {
+        let res = self.run_loop(receiver);
+        self.ready.update(|r| r.running = false);
+        self.stopper.stopped(*res.as_ref().unwrap_or(&0));
+        self.lifecycle.shutdown();
+        self.bus.close();
+        res.map(|_| ())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::client::Listener;
+    use crate::client::Sender;
+    use crate::command::Command;
+    use crate::limit::Budgeted;
+    use crate::testing::{Recorder, Scripted};
+    use std::sync::mpsc::channel;
+
+    struct Failing {
+        user: bool,
+    }
+
+    impl Handler for Failing {
+        type Data = Post;
+
+        fn name(&self) -> String {
+            "failing".into()
+        }
+
+        fn help(&self) -> Option<String> {
+            None
+        }
+
+        fn handle(&self, _post: &Post) -> handler::Result {
+            if self.user {
+                return Err(handler::Error::User("wrong arguments".to_string()));
+            }
+            Err(handler::Error::Other("failed".to_string()))
+        }
+    }
+
+    struct Slow {
+        delay: Duration,
+        handled: Arc<Mutex<u64>>,
+    }
+
+    impl Handler for Slow {
+        type Data = Post;
+
+        fn name(&self) -> String {
+            "slow".into()
+        }
+
+        fn help(&self) -> Option<String> {
+            None
+        }
+
+        fn handle(&self, _post: &Post) -> handler::Result {
+            std::thread::sleep(self.delay);
+            *self.handled.lock().unwrap() += 1;
+            Ok(())
+        }
+    }
+
+    struct Edits {
+        seen: Arc<Mutex<Vec<String>>>,
+    }
+
+    impl Handler for Edits {
+        type Data = PostEdited;
+
+        fn name(&self) -> String {
+            "edits".into()
+        }
+
+        fn help(&self) -> Option<String> {
+            None
+        }
+
+        fn handle(&self, edited: &PostEdited) -> handler::Result {
+            self.seen.lock().unwrap().push(edited.message.clone());
+            Ok(())
+        }
+    }
+
+    struct Chatty {
+        client: Budgeted<Recorder>,
+        called: Arc<Mutex<u64>>,
+    }
+
+    impl Handler for Chatty {
+        type Data = Post;
+
+        fn name(&self) -> String {
+            "chatty".into()
+        }
+
+        fn help(&self) -> Option<String> {
+            None
+        }
+
+        fn handle(&self, post: &Post) -> handler::Result {
+            *self.called.lock().unwrap() += 1;
+            Ok(self.client.reply(post, "me too")?)
+        }
+    }
+
+    fn slow_instance(delay: Duration, handled: Arc<Mutex<u64>>) -> Instance<Recorder> {
+        let mut instance = Instance::new(Recorder::new());
+        instance.add_post_handler(Box::new(Slow { delay, handled }));
+        instance
+    }
+
+    #[test]
+    fn stop_drains() {
+        let handled = Arc::new(Mutex::new(0));
+        let instance = slow_instance(Duration::from_millis(10), handled.clone());
+        let stopper = instance.stopper();
+
+        let (sender, receiver) = channel();
+        for _ in 0..5 {
+            sender.send(Event::Post(Post::with_message("hey"))).unwrap();
+        }
+        let t = std::thread::spawn(move || instance.run(receiver));
+
+        assert_eq!(Some(0), stopper.stop(Duration::from_secs(5)));
+        assert!(t.join().unwrap().is_ok());
+        assert_eq!(5, *handled.lock().unwrap());
+    }
+
+    #[test]
+    fn stop_deadline() {
+        let handled = Arc::new(Mutex::new(0));
+        let mut instance = slow_instance(Duration::from_millis(100), handled.clone());
+        let stopper = instance.stopper();
+
+        let (sender, receiver) = channel();
+        instance.set_event_sender(sender.clone());
+        for _ in 0..10 {
+            sender.send(Event::Post(Post::with_message("hey"))).unwrap();
+        }
+        let t = std::thread::spawn(move || instance.run(receiver));
+
+        let dropped = stopper.stop(Duration::from_millis(150)).unwrap();
+        assert!(t.join().unwrap().is_ok());
+        assert!(dropped > 0);
+        assert_eq!(10, dropped + *handled.lock().unwrap());
+    }
+
+    #[test]
+    fn stop_sending_after() {
+        let handled = Arc::new(Mutex::new(0));
+        let mut instance = slow_instance(Duration::from_millis(20), handled.clone());
+        let stopper = instance.stopper();
+
+        let (sender, receiver) = channel();
+        instance.set_event_sender(sender.clone());
+        for _ in 0..5 {
+            sender
+                .send(Event::Post(Post::with_message("before")))
+                .unwrap();
+        }
+        let t = std::thread::spawn(move || instance.run(receiver));
+        let stop = std::thread::spawn(move || stopper.stop(Duration::from_secs(5)));
+
+        // sent while the instance drains, after the events queued at stop.
+        std::thread::sleep(Duration::from_millis(30));
+        for _ in 0..50 {
+            sender
+                .send(Event::Post(Post::with_message("after")))
+                .unwrap();
+        }
+        assert_eq!(Some(0), stop.join().unwrap());
+        assert!(t.join().unwrap().is_ok());
+        assert_eq!(5, *handled.lock().unwrap());
+    }
+
+    #[test]
+    fn stop_while_listening() {
+        let handled = Arc::new(Mutex::new(0));
+        let mut instance = slow_instance(Duration::from_millis(0), handled.clone());
+        let stopper = instance.stopper();
+
+        // the listener keeps sending until the instance drops the receiver.
+        let (sender, receiver) = channel();
+        instance.set_event_sender(sender.clone());
+        let listener = std::thread::spawn(move || {
+            while sender.send(Event::Post(Post::with_message("hey"))).is_ok() {}
+        });
+        let t = std::thread::spawn(move || instance.run(receiver));
+
+        assert!(stopper.stop(Duration::from_millis(100)).is_some());
+        assert!(t.join().unwrap().is_ok());
+        listener.join().unwrap();
+    }
+
+    #[test]
+    fn scripted_listener() {
+        let handled = Arc::new(Mutex::new(0));
+        let instance = slow_instance(Duration::from_millis(0), handled.clone());
+
+        let listener = Scripted::new(vec![
+            Event::Post(Post::with_message("one")),
+            Event::Unsupported("typing".to_string()),
+            Event::Post(Post::with_message("two")),
+            Event::Shutdown,
+        ]);
+        let (sender, receiver) = channel();
+        let t = std::thread::spawn(move || listener.listen(sender));
+
+        assert!(instance.run(receiver).is_ok());
+        assert!(t.join().unwrap().is_ok());
+        assert_eq!(2, *handled.lock().unwrap());
+        assert_eq!(3, instance.stats().events);
+    }
+
+    #[test]
+    fn shutdown_callbacks() {
+        let instance = Instance::new(Recorder::new());
+        let shutdown = Arc::new(Mutex::new(0));
+        let s = shutdown.clone();
+        instance
+            .lifecycle()
+            .on_shutdown(move || *s.lock().unwrap() += 1);
+
+        let (sender, receiver) = channel();
+        sender.send(Event::Post(Post::with_message("one"))).unwrap();
+        assert_eq!(0, *shutdown.lock().unwrap());
+        sender.send(Event::Shutdown).unwrap();
+        instance.run(receiver).unwrap();
+        assert_eq!(1, *shutdown.lock().unwrap());
+    }
+
+    #[test]
+    fn bus_closed_on_stop() {
+        let instance = Instance::new(Recorder::new());
+        let bus = instance.bus();
+        let received = Arc::new(Mutex::new(0));
+        let r = received.clone();
+        assert!(bus.subscribe("topic", move |_| *r.lock().unwrap() += 1));
+
+        let (sender, receiver) = channel();
+        sender.send(Event::Shutdown).unwrap();
+        assert_eq!(1, bus.publish("topic", "before"));
+        instance.run(receiver).unwrap();
+
+        assert_eq!(0, bus.publish("topic", "after"));
+        assert_eq!(1, *received.lock().unwrap());
+    }
+
+    #[test]
+    fn post_budget_stops_handlers() {
+        let client = Recorder::new();
+        let budget = PostBudget::new(2);
+        let called = Arc::new(Mutex::new(0));
+        let mut instance = Instance::new(client.clone());
+        instance.set_post_budget(budget.clone());
+        for _ in 0..3 {
+            instance.add_post_handler(Box::new(Chatty {
+                client: Budgeted::new(client.clone(), budget.clone()),
+                called: called.clone(),
+            }));
+        }
+
+        let (sender, receiver) = channel();
+        sender.send(Event::Post(Post::with_message("one"))).unwrap();
+        sender.send(Event::Post(Post::with_message("two"))).unwrap();
+        sender.send(Event::Shutdown).unwrap();
+        instance.run(receiver).unwrap();
+
+        assert_eq!(4, *called.lock().unwrap());
+        assert_eq!(4, client.replied().len());
+    }
+
+    #[test]
+    fn reload_flags() {
+        let mut instance = Instance::new(Recorder::new());
+        assert!(instance.reload_flags().is_err());
+
+        let path = std::env::temp_dir().join("flobot-instance-flags");
+        std::fs::write(&path, "blagues").unwrap();
+        instance.set_flags_file(path.to_str().unwrap());
+        instance.reload_flags().unwrap();
+        assert!(instance.flag("blagues"));
+        std::fs::remove_file(path).unwrap();
+    }
+
+    #[test]
+    fn flagged_handlers() {
+        let handled = Arc::new(Mutex::new(0));
+        let mut instance = slow_instance(Duration::from_millis(0), handled.clone());
+        instance.set_flagged_handlers(true);
+        let flags = instance.flags();
+        assert_eq!("handler.slow", handler_flag("slow"));
+
+        let (sender, receiver) = channel();
+        sender.send(Event::Post(Post::with_message("one"))).unwrap();
+        let t = std::thread::spawn(move || instance.run(receiver));
+        std::thread::sleep(Duration::from_millis(100));
+        assert_eq!(0, *handled.lock().unwrap());
+
+        flags.reload(Flags::parse("handler.slow").unwrap());
+        sender.send(Event::Post(Post::with_message("two"))).unwrap();
+        sender.send(Event::Shutdown).unwrap();
+        assert!(t.join().unwrap().is_ok());
+        assert_eq!(1, *handled.lock().unwrap());
+    }
+
+    #[test]
+    fn edits_handled() {
+        let seen = Arc::new(Mutex::new(vec![]));
+        let mut instance = Instance::new(Recorder::new());
+        instance
+            .add_edit_handler(Box::new(Edits { seen: seen.clone() }))
+            .set_flagged_handlers(true);
+        let edited = |message: &str| {
+            Event::PostEdited(PostEdited {
+                channel_id: "chan".into(),
+                message: message.into(),
+                user_id: "user".into(),
+                root_id: "".into(),
+                parent_id: "".into(),
+                id: "post".into(),
+            })
+        };
+
+        instance.process(&mut edited("off")).unwrap();
+        instance
+            .flags()
+            .reload(Flags::parse("handler.edits").unwrap());
+        instance.process(&mut edited("on")).unwrap();
+        instance
+            .process(&mut Event::Post(Post::with_message("new")))
+            .unwrap();
+        assert_eq!(vec!["on".to_string()], *seen.lock().unwrap());
+    }
+
+    #[test]
+    fn user_error_replied() {
+        let client = Recorder::new();
+        let mut instance = Instance::new(client.clone());
+        instance.add_post_handler(Box::new(Failing { user: true }));
+        instance.add_post_handler(Box::new(Failing { user: false }));
+
+        let (sender, receiver) = channel();
+        sender
+            .send(Event::Post(Post::with_message("!cmd")))
+            .unwrap();
+        sender.send(Event::Shutdown).unwrap();
+        instance.run(receiver).unwrap();
+
+        assert_eq!(vec!["wrong arguments"], client.replied());
+        let debugs = client.debugs.lock().unwrap();
+        let errors: Vec<&String> =
+            debugs.iter().filter(|d| d.starts_with("error")).collect();
+        assert_eq!(1, errors.len());
+        assert!(errors[0].contains("failed"));
+    }
+
+    #[test]
+    fn slow_handlers() {
+        let handled = Arc::new(Mutex::new(0));
+        let mut instance = slow_instance(Duration::from_millis(30), handled.clone());
+        instance.set_slow_threshold(Duration::from_millis(10));
+        let mut fast = slow_instance(Duration::from_millis(0), handled.clone());
+        fast.set_slow_threshold(Duration::from_millis(10));
+
+        for instance in [&instance, &fast].iter() {
+            let (sender, receiver) = channel();
+            sender.send(Event::Post(Post::with_message("hey"))).unwrap();
+            sender.send(Event::Shutdown).unwrap();
+            instance.run(receiver).unwrap();
+        }
+
+        assert_eq!(2, *handled.lock().unwrap());
+        assert_eq!(1, instance.stats().slow_handlers);
+        assert_eq!(0, fast.stats().slow_handlers);
+    }
+
+    #[test]
+    fn ready_once_connected() {
+        let client = Recorder::new();
+        let instance = Instance::new(client.clone());
+        let ready = instance.ready();
+        let lifecycle = instance.lifecycle();
+        assert!(!ready.is_ready());
+        assert!(!ready.wait(Duration::from_millis(10)));
+
+        // running, but the connection is not open yet.
+        let (sender, receiver) = channel();
+        let t = std::thread::spawn(move || instance.run(receiver));
+        assert!(!ready.wait(Duration::from_millis(50)));
+        assert!(client.debugs.lock().unwrap()[0].contains("Loaded middlewares"));
+
+        lifecycle.connected();
+        assert!(ready.wait(Duration::from_secs(5)));
+        lifecycle.disconnected();
+        assert!(!ready.is_ready());
+        lifecycle.connected();
+        assert!(ready.is_ready());
+
+        sender.send(Event::Shutdown).unwrap();
+        assert!(t.join().unwrap().is_ok());
+        assert!(!ready.is_ready());
+    }
+
+    #[test]
+    fn channel_handler() {
+        let handled = Arc::new(Mutex::new(0));
+        let mut instance = Instance::new(Recorder::new());
+        instance.add_post_handler_for_channel(
+            "support",
+            Box::new(Slow {
+                delay: Duration::from_millis(0),
+                handled: handled.clone(),
+            }),
+        );
+
+        let (sender, receiver) = channel();
+        for channel_id in ["support", "town-square", "support", "off-topic"].iter() {
+            let mut post = Post::with_message("help");
+            post.channel_id = channel_id.to_string();
+            sender.send(Event::Post(post)).unwrap();
+        }
+        sender.send(Event::Shutdown).unwrap();
+        instance.run(receiver).unwrap();
+
+        assert_eq!(2, *handled.lock().unwrap());
+    }
+
+    #[test]
+    fn stats_events() {
+        let client = Recorder::new();
+        let mut instance = Instance::new(client.clone());
+        instance.add_post_handler(Box::new(Failing { user: false }));
+
+        let (sender, receiver) = channel();
+        sender.send(Event::Post(Post::with_message("one"))).unwrap();
+        sender.send(Event::Post(Post::with_message("two"))).unwrap();
+        sender.send(Event::Shutdown).unwrap();
+        instance.run(receiver).unwrap();
+
+        let stats = instance.stats();
+        assert_eq!(2, stats.events);
+        assert!(stats.last_error.unwrap().starts_with("handler failing"));
+        assert_eq!(0, instance.collector().snapshot().reconnects);
+    }
+
+    #[test]
+    fn router_help() {
+        let client = Recorder::new();
+        let mut router = Router::new("commands", client.clone());
+        router.add(
+            Command::new("ping", "answers pong", |_, _| Ok(()))
+                .arg(crate::command::Arg::word("who").optional()),
+        );
+        let mut instance = Instance::new(client.clone());
+        instance.add_router(router);
+
+        instance.process_help(&Post::with_message("!help")).unwrap();
+        instance
+            .process_help(&Post::with_message("!help ping"))
+            .unwrap();
+        assert_eq!(
+            vec!["`commands`\n`ping`\n", "`!ping [who]`: answers pong",],
+            client.replied()
+        );
+    }
+
+    #[test]
+    fn flagged_handlers_help() {
+        let client = Recorder::new();
+        let mut router = Router::new("commands", client.clone());
+        router.add(Command::new("ping", "answers pong", |_, _| Ok(())));
+        let mut instance = Instance::new(client.clone());
+        instance.add_router(router);
+        instance.set_flagged_handlers(true);
+
+        instance.process_help(&Post::with_message("!help")).unwrap();
+        instance
+            .process_help(&Post::with_message("!help ping"))
+            .unwrap();
+        instance
+            .flags()
+            .reload(Flags::parse("handler.commands").unwrap());
+        instance
+            .process_help(&Post::with_message("!help ping"))
+            .unwrap();
+        assert_eq!(
+            vec!["", "tutétrompé", "`!ping`: answers pong"],
+            client.replied()
+        );
+    }
 }
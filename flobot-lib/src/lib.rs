@@ -1,11 +1,27 @@
+pub mod admin;
+pub mod bus;
 pub mod client;
+pub mod command;
 pub mod conf;
+pub mod dialog;
+pub mod emoji;
+pub mod flags;
+pub mod format;
 pub mod handler;
 pub mod instance;
+pub mod lifecycle;
+pub mod limit;
+pub mod log;
 pub mod middleware;
 pub mod models;
+pub mod schedule;
+pub mod shed;
+pub mod split;
+pub mod stats;
 pub mod task;
 pub mod tempo;
+#[cfg(test)]
+mod testing;
 
 // https://doc.rust-lang.org/nightly/std/macro.env.html - compile time env
 pub const BUILD_GIT_HASH: &'static str = env!("BUILD_GIT_HASH");
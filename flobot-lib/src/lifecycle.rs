@@ -0,0 +1,213 @@
+//! Callbacks run when the bot connects, disconnects and shuts down.
+
+use crate::client::Notifier;
+use crate::log::{Level, Logger};
+use std::panic::{self, AssertUnwindSafe};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex, RwLock};
+use std::time::{Duration, Instant};
+
+pub type Callback = Box<dyn Fn() + Send + Sync>;
+
+#[derive(Default)]
+struct Callbacks {
+    connect: Vec<Callback>,
+    disconnect: Vec<Callback>,
+    reconnect: Vec<Callback>,
+    shutdown: Vec<Callback>,
+    logger: Logger,
+}
+
+/// Lifecycle runs the callbacks registered for each stage of the bot. Clones share
+/// callbacks: the instance reports its shutdown, the backend connection reports
+/// connections and disconnections.
+#[derive(Clone, Default)]
+pub struct Lifecycle {
+    callbacks: Arc<RwLock<Callbacks>>,
+    connected_once: Arc<AtomicBool>,
+}
+
+impl Lifecycle {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Call f on every connection, reconnections included.
+    pub fn on_connect<F: Fn() + Send + Sync + 'static>(&self, f: F) -> &Self {
+        self.callbacks.write().unwrap().connect.push(Box::new(f));
+        self
+    }
+
+    pub fn on_disconnect<F: Fn() + Send + Sync + 'static>(&self, f: F) -> &Self {
+        self.callbacks.write().unwrap().disconnect.push(Box::new(f));
+        self
+    }
+
+    /// Call f on every connection but the first one, after connect callbacks.
+    pub fn on_reconnect<F: Fn() + Send + Sync + 'static>(&self, f: F) -> &Self {
+        self.callbacks.write().unwrap().reconnect.push(Box::new(f));
+        self
+    }
+
+    pub fn on_shutdown<F: Fn() + Send + Sync + 'static>(&self, f: F) -> &Self {
+        self.callbacks.write().unwrap().shutdown.push(Box::new(f));
+        self
+    }
+
+    /// Log panicking callbacks with logger, for every clone.
+    pub fn set_logger(&self, logger: Logger) {
+        self.callbacks.write().unwrap().logger = logger;
+    }
+
+    /// Run callbacks, a panicking callback does not prevent the next ones to run.
+    fn run(logger: &Logger, stage: &str, callbacks: &[Callback]) {
+        for callback in callbacks {
+            if panic::catch_unwind(AssertUnwindSafe(callback)).is_err() {
+                logger.log(Level::Error, &format!("{} callback panicked", stage));
+            }
+        }
+    }
+
+    pub fn connected(&self) {
+        let callbacks = self.callbacks.read().unwrap();
+        Self::run(&callbacks.logger, "connect", &callbacks.connect);
+        if self.connected_once.swap(true, Ordering::SeqCst) {
+            Self::run(&callbacks.logger, "reconnect", &callbacks.reconnect);
+        }
+    }
+
+    pub fn disconnected(&self) {
+        let callbacks = self.callbacks.read().unwrap();
+        Self::run(&callbacks.logger, "disconnect", &callbacks.disconnect);
+    }
+
+    pub fn shutdown(&self) {
+        let callbacks = self.callbacks.read().unwrap();
+        Self::run(&callbacks.logger, "shutdown", &callbacks.shutdown);
+    }
+}
+
+/// Announcer tells the debug channel the bot reconnected, at most once per cooldown
+/// so a flapping connection does not flood it. Register it with
+/// Lifecycle::on_reconnect.
+pub struct Announcer<N> {
+    notifier: N,
+    message: String,
+    cooldown: Duration,
+    last: Mutex<Option<Instant>>,
+    logger: Logger,
+}
+
+impl<N: Notifier> Announcer<N> {
+    pub fn new(notifier: N, message: &str, cooldown: Duration) -> Self {
+        Self {
+            notifier,
+            message: message.to_string(),
+            cooldown,
+            last: Mutex::new(None),
+            logger: Logger::default(),
+        }
+    }
+
+    pub fn with_logger(mut self, logger: Logger) -> Self {
+        self.logger = logger;
+        self
+    }
+
+    /// Send the message, unless it was within cooldown. Returns true if sent.
+    pub fn announce(&self) -> bool {
+        self.announce_at(Instant::now())
+    }
+
+    fn announce_at(&self, now: Instant) -> bool {
+        let mut last = self.last.lock().unwrap();
+        if let Some(last) = *last {
+            if now.saturating_duration_since(last) < self.cooldown {
+                return false;
+            }
+        }
+        if let Err(e) = self.notifier.debug(&self.message) {
+            self.logger.log(
+                Level::Warn,
+                &format!("cannot announce reconnection: {:?}", e),
+            );
+            return false;
+        }
+        *last = Some(now);
+        true
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::testing::Recorder;
+
+    fn record(lifecycle: &Lifecycle) -> Arc<Mutex<Vec<&'static str>>> {
+        let calls = Arc::new(Mutex::new(vec![]));
+        let (c1, c2, c3, c4) =
+            (calls.clone(), calls.clone(), calls.clone(), calls.clone());
+        lifecycle
+            .on_connect(move || c1.lock().unwrap().push("connect"))
+            .on_disconnect(move || c2.lock().unwrap().push("disconnect"))
+            .on_reconnect(move || c3.lock().unwrap().push("reconnect"))
+            .on_shutdown(move || c4.lock().unwrap().push("shutdown"));
+        calls
+    }
+
+    #[test]
+    fn lifecycle_stages() {
+        let lifecycle = Lifecycle::new();
+        let calls = record(&lifecycle);
+
+        let backend = lifecycle.clone();
+        backend.connected();
+        backend.disconnected();
+        backend.connected();
+        lifecycle.shutdown();
+
+        assert_eq!(
+            vec!["connect", "disconnect", "connect", "reconnect", "shutdown"],
+            *calls.lock().unwrap()
+        );
+    }
+
+    #[test]
+    fn lifecycle_panic() {
+        let lifecycle = Lifecycle::new();
+        lifecycle.on_shutdown(|| panic!("cleanup failed"));
+        let calls = record(&lifecycle);
+
+        lifecycle.shutdown();
+        assert_eq!(vec!["shutdown"], *calls.lock().unwrap());
+    }
+
+    #[test]
+    fn announce_cooldown() {
+        let client = Recorder::new();
+        let announcer = Announcer::new(client.clone(), "back", Duration::from_secs(60));
+        let start = Instant::now();
+
+        assert!(announcer.announce_at(start));
+        assert!(!announcer.announce_at(start + Duration::from_secs(10)));
+        assert!(!announcer.announce_at(start + Duration::from_secs(59)));
+        assert!(announcer.announce_at(start + Duration::from_secs(61)));
+        assert_eq!(vec!["back", "back"], *client.debugs.lock().unwrap());
+    }
+
+    #[test]
+    fn announce_rapid_reconnects() {
+        let client = Recorder::new();
+        let announcer = Announcer::new(client.clone(), "back", Duration::from_secs(60));
+        let lifecycle = Lifecycle::new();
+        lifecycle.on_reconnect(move || {
+            announcer.announce();
+        });
+
+        for _ in 0..5 {
+            lifecycle.connected();
+            lifecycle.disconnected();
+        }
+        assert_eq!(vec!["back"], *client.debugs.lock().unwrap());
+    }
+}
@@ -0,0 +1,286 @@
+//! Limits of the calls to the backend, shared by clones of a client.
+
+use crate::client::{Channel, Editor, Error, Getter, Result, Sender};
+use crate::models::{
+    ChannelInfo, ChannelUnread, Post, PostDetails, ServerLimits, Team, User,
+};
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::{Arc, Condvar, Mutex};
+
+/// Limiter lets at most max holders of a Permit run at the same time, others wait
+/// for a permit to be released. Clones share the same permits.
+#[derive(Clone)]
+pub struct Limiter {
+    max: usize,
+    used: Arc<(Mutex<usize>, Condvar)>,
+}
+
+/// Permit is released when dropped.
+pub struct Permit<'a> {
+    limiter: &'a Limiter,
+}
+
+impl Limiter {
+    /// A max of 0 is handled as 1.
+    pub fn new(max: usize) -> Self {
+        Self {
+            max: max.max(1),
+            used: Arc::new((Mutex::new(0), Condvar::new())),
+        }
+    }
+
+    /// Wait for a permit.
+    pub fn acquire(&self) -> Permit<'_> {
+        let (used, released) = &*self.used;
+        let mut used = used.lock().unwrap();
+        while *used >= self.max {
+            used = released.wait(used).unwrap();
+        }
+        *used += 1;
+        Permit { limiter: self }
+    }
+}
+
+impl Drop for Permit<'_> {
+    fn drop(&mut self) {
+        let (used, released) = &*self.limiter.used;
+        *used.lock().unwrap() -= 1;
+        released.notify_one();
+    }
+}
+
+/// PostBudget is the number of messages handlers may send for a single event, so a
+/// misconfiguration cannot make the bot flood a channel. Clones share the count: the
+/// instance, see Instance::set_post_budget, resets it for each event and stops
+/// calling handlers once it is spent, handlers send through a Budgeted client.
+#[derive(Clone)]
+pub struct PostBudget {
+    max: usize,
+    sent: Arc<AtomicUsize>,
+}
+
+impl PostBudget {
+    pub fn new(max: usize) -> Self {
+        Self {
+            max,
+            sent: Arc::default(),
+        }
+    }
+
+    pub fn reset(&self) {
+        self.sent.store(0, Ordering::SeqCst);
+    }
+
+    pub fn spent(&self) -> bool {
+        self.sent.load(Ordering::SeqCst) >= self.max
+    }
+
+    /// Count one message, false if the budget was already spent.
+    fn take(&self) -> bool {
+        self.sent
+            .fetch_update(Ordering::SeqCst, Ordering::SeqCst, |sent| {
+                if sent < self.max {
+                    Some(sent + 1)
+                } else {
+                    None
+                }
+            })
+            .is_ok()
+    }
+}
+
+/// Budgeted sends through client as long as budget is not spent, and refuses with
+/// an error after. Reactions, edits and other calls are not counted.
+#[derive(Clone)]
+pub struct Budgeted<C> {
+    client: C,
+    budget: PostBudget,
+}
+
+impl<C: Sender> Budgeted<C> {
+    pub fn new(client: C, budget: PostBudget) -> Self {
+        Self { client, budget }
+    }
+
+    fn take(&self) -> Result<()> {
+        if self.budget.take() {
+            return Ok(());
+        }
+        Err(Error::Other(format!(
+            "budget of {} posts for this event spent",
+            self.budget.max
+        )))
+    }
+}
+
+impl<C: Sender> Sender for Budgeted<C> {
+    fn post(&self, post: &Post) -> Result<()> {
+        self.take()?;
+        self.client.post(post)
+    }
+
+    fn reaction(&self, post: &Post, reaction: &str) -> Result<()> {
+        self.client.reaction(post, reaction)
+    }
+
+    fn remove_reaction(&self, post: &Post, reaction: &str) -> Result<()> {
+        self.client.remove_reaction(post, reaction)
+    }
+
+    fn reply(&self, post: &Post, message: &str) -> Result<()> {
+        self.take()?;
+        self.client.reply(post, message)
+    }
+
+    fn ephemeral(&self, post: &Post, message: &str) -> Result<()> {
+        self.take()?;
+        self.client.ephemeral(post, message)
+    }
+}
+
+impl<C: Editor> Editor for Budgeted<C> {
+    fn edit(&self, post: &Post, message: &str) -> Result<()> {
+        self.client.edit(post, message)
+    }
+
+    fn delete(&self, post: &Post) -> Result<()> {
+        self.client.delete(post)
+    }
+}
+
+impl<C: Channel> Channel for Budgeted<C> {
+    fn create_private(
+        &self,
+        team_id: &str,
+        name: &str,
+        users: &Vec<String>,
+    ) -> Result<String> {
+        self.client.create_private(team_id, name, users)
+    }
+
+    fn create(
+        &self,
+        team_id: &str,
+        name: &str,
+        display_name: &str,
+        public: bool,
+    ) -> Result<ChannelInfo> {
+        self.client.create(team_id, name, display_name, public)
+    }
+
+    fn archive(&self, channel_id: &str) -> Result<()> {
+        self.client.archive(channel_id)
+    }
+
+    fn notify_props(
+        &self,
+        channel_id: &str,
+        props: &HashMap<String, String>,
+    ) -> Result<()> {
+        self.client.notify_props(channel_id, props)
+    }
+}
+
+impl<C: Getter> Getter for Budgeted<C> {
+    fn my_user_id(&self) -> &str {
+        self.client.my_user_id()
+    }
+
+    fn users_by_ids(&self, ids: Vec<&str>) -> Result<Vec<User>> {
+        self.client.users_by_ids(ids)
+    }
+
+    fn team(&self) -> Result<Team> {
+        self.client.team()
+    }
+
+    fn unread(&self, channel_id: &str) -> Result<ChannelUnread> {
+        self.client.unread(channel_id)
+    }
+
+    fn unread_mentions(&self) -> Result<Vec<ChannelUnread>> {
+        self.client.unread_mentions()
+    }
+
+    fn permalink(&self, post_id: &str) -> Result<String> {
+        self.client.permalink(post_id)
+    }
+
+    fn channel(&self, channel_id: &str) -> Result<ChannelInfo> {
+        self.client.channel(channel_id)
+    }
+
+    fn custom_emoji_exists(&self, name: &str) -> Result<bool> {
+        self.client.custom_emoji_exists(name)
+    }
+
+    fn limits(&self) -> ServerLimits {
+        self.client.limits()
+    }
+
+    fn thread(&self, root_id: &str) -> Result<Vec<Post>> {
+        self.client.thread(root_id)
+    }
+
+    fn post_with_metadata(&self, post_id: &str) -> Result<PostDetails> {
+        self.client.post_with_metadata(post_id)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::testing::Recorder;
+    use std::thread;
+    use std::time::Duration;
+
+    #[test]
+    fn limit_concurrency() {
+        let limiter = Limiter::new(2);
+        let running = Arc::new(Mutex::new((0, 0)));
+
+        let threads: Vec<_> = (0..6)
+            .map(|_| {
+                let limiter = limiter.clone();
+                let running = running.clone();
+                thread::spawn(move || {
+                    let _permit = limiter.acquire();
+                    {
+                        let mut running = running.lock().unwrap();
+                        running.0 += 1;
+                        running.1 = running.1.max(running.0);
+                    }
+                    thread::sleep(Duration::from_millis(30));
+                    running.lock().unwrap().0 -= 1;
+                })
+            })
+            .collect();
+        for t in threads {
+            t.join().unwrap();
+        }
+
+        assert_eq!((0, 2), *running.lock().unwrap());
+    }
+
+    #[test]
+    fn budget_spent() {
+        let client = Recorder::new();
+        let budget = PostBudget::new(2);
+        let budgeted = Budgeted::new(client.clone(), budget.clone());
+        let post = Post::with_message("hello");
+
+        assert!(budgeted.post(&post).is_ok());
+        assert!(budgeted.reaction(&post, "wave").is_ok());
+        assert!(!budget.spent());
+        assert!(budgeted.reply(&post, "hi").is_ok());
+        assert!(budget.spent());
+        assert!(budgeted.ephemeral(&post, "hi").is_err());
+        assert_eq!(1, client.posts.lock().unwrap().len());
+        assert_eq!(1, client.replies.lock().unwrap().len());
+        assert!(client.ephemerals.lock().unwrap().is_empty());
+
+        budget.reset();
+        assert!(budgeted.post(&post).is_ok());
+    }
+}
@@ -0,0 +1,109 @@
+//! Log level and sampling of the events going through an instance.
+
+use std::str::FromStr;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
+
+#[derive(Clone, Copy, Debug, PartialEq, PartialOrd)]
+pub enum Level {
+    Error,
+    Warn,
+    Info,
+    Debug,
+}
+
+impl FromStr for Level {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_lowercase().as_str() {
+            "error" => Ok(Level::Error),
+            "warn" => Ok(Level::Warn),
+            "info" => Ok(Level::Info),
+            "debug" => Ok(Level::Debug),
+            _ => Err(format!("unknown log level {}", s)),
+        }
+    }
+}
+
+/// Logger prints messages up to its level. At debug level, events are logged one
+/// every `sample` events, so busy teams don't flood logs. Clones share the count of
+/// events, so that the parts of the bot given a clone keep the same sample.
+#[derive(Clone)]
+pub struct Logger {
+    level: Level,
+    sample: u64,
+    seen: Arc<AtomicU64>,
+}
+
+impl Default for Logger {
+    fn default() -> Self {
+        Self::new(Level::Info, 1)
+    }
+}
+
+impl Logger {
+    /// A sample of 0 is handled as 1: every event is logged.
+    pub fn new(level: Level, sample: u64) -> Self {
+        Self {
+            level,
+            sample: sample.max(1),
+            seen: Arc::default(),
+        }
+    }
+
+    pub fn enabled(&self, level: Level) -> bool {
+        level <= self.level
+    }
+
+    pub fn log(&self, level: Level, message: &str) {
+        if self.enabled(level) {
+            println!("{:?}: {}", level, message);
+        }
+    }
+
+    /// Tells if the current event is part of the sample and must be logged.
+    fn sampled(&self) -> bool {
+        self.seen.fetch_add(1, Ordering::Relaxed) % self.sample == 0
+    }
+
+    /// Log event at debug level, if sampled.
+    pub fn event<T: std::fmt::Debug>(&self, event: &T) -> bool {
+        if !self.enabled(Level::Debug) || !self.sampled() {
+            return false;
+        }
+        self.log(Level::Debug, &format!("event {:?}", event));
+        true
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn level_parse() {
+        assert_eq!(Ok(Level::Debug), "DEBUG".parse());
+        assert!("verbose".parse::<Level>().is_err());
+        assert!(Logger::new(Level::Info, 1).enabled(Level::Error));
+        assert!(!Logger::new(Level::Info, 1).enabled(Level::Debug));
+    }
+
+    #[test]
+    fn event_sampling() {
+        let logger = Logger::new(Level::Debug, 10);
+        let logged = (0..1000).filter(|i| logger.event(i)).count();
+        assert_eq!(100, logged);
+
+        let logger = Logger::new(Level::Info, 1);
+        assert_eq!(0, (0..100).filter(|i| logger.event(i)).count());
+
+        let logger = Logger::new(Level::Debug, 0);
+        assert_eq!(100, (0..100).filter(|i| logger.event(i)).count());
+
+        let logger = Logger::new(Level::Debug, 2);
+        let clone = logger.clone();
+        assert!(logger.event(&0));
+        assert!(!clone.event(&1));
+    }
+}
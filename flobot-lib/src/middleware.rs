@@ -1,10 +1,20 @@
 use crate::client;
-use crate::models::Event;
+use crate::handler::{self, ReplyHandler, Response};
+use crate::log::{Level, Logger};
+use crate::models::{ChannelKind, Event, Post};
+use chrono::{DateTime, Datelike, NaiveTime, Utc, Weekday};
+use chrono_tz::Tz;
+use std::collections::{HashMap, VecDeque};
 use std::convert::From;
+use std::sync::mpsc::Sender;
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::Duration;
 
 #[derive(Debug)]
 pub enum Error {
     Client(String),
+    Lock(String),
 }
 
 pub enum Continue {
@@ -81,3 +91,1035 @@ impl Middleware for IgnoreSelf {
         "IgnoreSelf"
     }
 }
+
+/// Metadata key of a post holding its channel kind, see models::ChannelKind::as_str.
+pub const CHANNEL_KIND: &str = "channel.kind";
+
+/// ChannelType sets the kind of channel posts were sent on in post.metadata, as
+/// CHANNEL_KIND. Channels are resolved once with the client, then cached. The
+/// metadata is left unset when a channel cannot be resolved.
+pub struct ChannelType<C> {
+    client: C,
+    kinds: Mutex<HashMap<String, ChannelKind>>,
+}
+
+impl<C: client::Getter> ChannelType<C> {
+    pub fn new(client: C) -> Self {
+        Self {
+            client,
+            kinds: Mutex::new(HashMap::new()),
+        }
+    }
+
+    fn kind(&self, channel_id: &str) -> client::Result<ChannelKind> {
+        if let Some(kind) = self.kinds.lock().unwrap().get(channel_id) {
+            return Ok(*kind);
+        }
+        let kind = self.client.channel(channel_id)?.kind;
+        self.kinds
+            .lock()
+            .unwrap()
+            .insert(channel_id.to_string(), kind);
+        Ok(kind)
+    }
+}
+
+impl<C: client::Getter> Middleware for ChannelType<C> {
+    fn process(&self, event: &mut Event) -> Result {
+        if let Event::Post(post) = event {
+            match self.kind(&post.channel_id) {
+                Ok(kind) => {
+                    post.metadata
+                        .insert(CHANNEL_KIND.to_string(), kind.as_str().to_string());
+                }
+                Err(e) => {
+                    println!("cannot resolve channel {}: {:?}", post.channel_id, e)
+                }
+            }
+        }
+        Ok(Continue::Yes)
+    }
+
+    fn name(&self) -> &str {
+        "ChannelType"
+    }
+}
+
+/// TeamOnly restricts the bot to the team team_id: posts from the other teams the bot
+/// is member of are dropped. Direct and group messages belong to no team and always
+/// go through. Edits don't tell their team, they are dropped when on a channel posts
+/// of another team were seen on.
+pub struct TeamOnly {
+    team_id: String,
+    /// team of the channels posts were seen on.
+    channels: Mutex<HashMap<String, String>>,
+}
+
+impl TeamOnly {
+    pub fn new(team_id: &str) -> Self {
+        Self {
+            team_id: team_id.to_string(),
+            channels: Mutex::new(HashMap::new()),
+        }
+    }
+
+    fn other_team(&self, team_id: &str) -> bool {
+        team_id != "" && team_id != self.team_id
+    }
+}
+
+impl Middleware for TeamOnly {
+    fn process(&self, event: &mut Event) -> Result {
+        let other_team = match event {
+            Event::Post(post) => {
+                if post.team_id != "" {
+                    self.channels
+                        .lock()
+                        .unwrap()
+                        .insert(post.channel_id.clone(), post.team_id.clone());
+                }
+                self.other_team(&post.team_id)
+            }
+            Event::PostEdited(edited) => {
+                let channels = self.channels.lock().unwrap();
+                channels
+                    .get(&edited.channel_id)
+                    .map_or(false, |team_id| self.other_team(team_id))
+            }
+            _ => false,
+        };
+        if other_team {
+            return Ok(Continue::No);
+        }
+        Ok(Continue::Yes)
+    }
+
+    fn name(&self) -> &str {
+        "TeamOnly"
+    }
+}
+
+/// MaxLength stops posts, and their edits, whose message is longer than max bytes so
+/// handlers are not triggered by giant inputs like pasted logs. When a client is
+/// given, the author is warned with an ephemeral message.
+pub struct MaxLength<C> {
+    max: usize,
+    client: Option<C>,
+}
+
+impl<C: client::Sender> MaxLength<C> {
+    pub fn new(max: usize, client: Option<C>) -> Self {
+        Self { max, client }
+    }
+}
+
+impl<C: client::Sender> Middleware for MaxLength<C> {
+    fn process(&self, event: &mut Event) -> Result {
+        let length = match event {
+            Event::Post(post) => post.message.len(),
+            Event::PostEdited(edited) => edited.message.len(),
+            _ => return Ok(Continue::Yes),
+        };
+
+        if length <= self.max {
+            return Ok(Continue::Yes);
+        }
+
+        if let (Some(client), Event::Post(post)) = (&self.client, event) {
+            client.ephemeral(
+                post,
+                &format!(
+                    "message ignored: {} bytes long, max is {} bytes",
+                    length, self.max
+                ),
+            )?;
+        }
+
+        Ok(Continue::No)
+    }
+
+    fn name(&self) -> &str {
+        "MaxLength"
+    }
+}
+
+#[derive(Default)]
+struct Edits {
+    /// last edit generation seen for a post id.
+    pending: HashMap<String, u64>,
+    /// edits sent back to the instance, by post id, waiting to go through.
+    released: HashMap<String, String>,
+}
+
+/// Debounce collapses bursts of edits on the same post into a single event.
+///
+/// Each PostEdited event is held back until the post stayed untouched for
+/// `window`, then only the latest version is sent back to the instance
+/// through `sender`, i.e. the same channel the instance receives events from.
+/// That version then goes through the whole middleware chain again.
+pub struct Debounce {
+    window: Duration,
+    sender: Mutex<Sender<Event>>,
+    edits: Arc<Mutex<Edits>>,
+    logger: Logger,
+}
+
+impl Debounce {
+    pub fn new(window: Duration, sender: Sender<Event>) -> Self {
+        Self {
+            window,
+            sender: Mutex::new(sender),
+            edits: Arc::default(),
+            logger: Logger::default(),
+        }
+    }
+
+    pub fn with_logger(mut self, logger: Logger) -> Self {
+        self.logger = logger;
+        self
+    }
+}
+
+impl Middleware for Debounce {
+    fn process(&self, event: &mut Event) -> Result {
+        let edited = match event {
+            Event::PostEdited(edited) => edited,
+            _ => return Ok(Continue::Yes),
+        };
+
+        let generation = {
+            let mut edits = self.edits.lock().unwrap();
+            if edits.released.get(&edited.id) == Some(&edited.message) {
+                edits.released.remove(&edited.id);
+                return Ok(Continue::Yes);
+            }
+            let generation = edits.pending.entry(edited.id.clone()).or_insert(0);
+            *generation += 1;
+            *generation
+        };
+
+        let window = self.window;
+        let edits = self.edits.clone();
+        let sender = self.sender.lock().unwrap().clone();
+        let edited = edited.clone();
+        let logger = self.logger.clone();
+        thread::spawn(move || {
+            thread::sleep(window);
+            let mut edits = edits.lock().unwrap();
+            if edits.pending.get(&edited.id) != Some(&generation) {
+                return; // superseded by a more recent edit.
+            }
+            edits.pending.remove(&edited.id);
+            edits
+                .released
+                .insert(edited.id.clone(), edited.message.clone());
+            if let Err(e) = sender.send(Event::PostEdited(edited)) {
+                let message = format!("debounce: cannot send back edit: {:?}", e);
+                logger.log(Level::Warn, &message);
+            }
+        });
+
+        Ok(Continue::No)
+    }
+
+    fn name(&self) -> &str {
+        "Debounce"
+    }
+}
+
+/// Weekly opening windows, in the local time of a timezone, daylight saving time
+/// included.
+#[derive(Clone, Debug)]
+pub struct Schedule {
+    tz: Tz,
+    windows: HashMap<Weekday, Vec<(NaiveTime, NaiveTime)>>,
+}
+
+fn parse_days(days: &str) -> std::result::Result<Vec<Weekday>, String> {
+    let day = |d: &str| {
+        d.parse::<Weekday>()
+            .map_err(|_| format!("unknown weekday {}", d))
+    };
+    match days.split_once('-') {
+        None => Ok(vec![day(days)?]),
+        Some((first, last)) => {
+            let (mut d, last) = (day(first)?, day(last)?);
+            let mut days = vec![d];
+            while d != last {
+                d = d.succ();
+                days.push(d);
+            }
+            Ok(days)
+        }
+    }
+}
+
+impl Schedule {
+    /// Schedule without any window: always closed.
+    pub fn new(tz: Tz) -> Self {
+        Self {
+            tz,
+            windows: HashMap::new(),
+        }
+    }
+
+    /// Open on day from `from` until `to`, excluded.
+    pub fn open(mut self, day: Weekday, from: NaiveTime, to: NaiveTime) -> Self {
+        self.windows.entry(day).or_default().push((from, to));
+        self
+    }
+
+    /// Parse windows like `mon-fri 09:00-12:00 14:00-18:00; sat 10:00-12:00`.
+    pub fn parse(tz: Tz, windows: &str) -> std::result::Result<Self, String> {
+        let mut schedule = Self::new(tz);
+        for spec in windows.split(';').filter(|s| !s.trim().is_empty()) {
+            let mut parts = spec.split_whitespace();
+            let days = parse_days(parts.next().unwrap())?;
+            for range in parts {
+                let time = |t: &str| {
+                    NaiveTime::parse_from_str(t, "%H:%M")
+                        .map_err(|e| format!("{}: {}", range, e))
+                };
+                let (from, to) = match range.split_once('-') {
+                    Some((from, to)) => (time(from)?, time(to)?),
+                    None => return Err(format!("{}: expected HH:MM-HH:MM", range)),
+                };
+                if from >= to {
+                    return Err(format!("{}: window ends before it starts", range));
+                }
+                for day in days.iter() {
+                    schedule = schedule.open(*day, from, to);
+                }
+            }
+        }
+        Ok(schedule)
+    }
+
+    pub fn is_open(&self, at: DateTime<Utc>) -> bool {
+        let local = at.with_timezone(&self.tz);
+        let time = local.time();
+        match self.windows.get(&local.weekday()) {
+            Some(windows) => {
+                windows.iter().any(|(from, to)| *from <= time && time < *to)
+            }
+            None => false,
+        }
+    }
+}
+
+/// BusinessHours stops posts, and their edits, received out of the schedule windows.
+/// When a reply is given, the client answers off hours posts with it.
+pub struct BusinessHours<C> {
+    schedule: Schedule,
+    reply: Option<(C, String)>,
+}
+
+impl<C: client::Sender> BusinessHours<C> {
+    pub fn new(schedule: Schedule, reply: Option<(C, String)>) -> Self {
+        Self { schedule, reply }
+    }
+
+    fn process_at(&self, event: &Event, at: DateTime<Utc>) -> Result {
+        match event {
+            Event::Post(_) | Event::PostEdited(_) => {}
+            _ => return Ok(Continue::Yes),
+        }
+
+        if self.schedule.is_open(at) {
+            return Ok(Continue::Yes);
+        }
+
+        if let (Some((client, message)), Event::Post(post)) = (&self.reply, event) {
+            client.reply(post, message)?;
+        }
+
+        Ok(Continue::No)
+    }
+}
+
+impl<C: client::Sender> Middleware for BusinessHours<C> {
+    fn process(&self, event: &mut Event) -> Result {
+        self.process_at(event, Utc::now())
+    }
+
+    fn name(&self) -> &str {
+        "BusinessHours"
+    }
+}
+
+/// Lock shared by the bot processes working with the same team.
+pub trait Lock {
+    /// Take the lock on key for ttl. Returns false if it is already held.
+    fn acquire(&self, key: &str, ttl: Duration) -> std::result::Result<bool, Error>;
+}
+
+/// Dedupe lets a single bot process handle a post when several of them share a team.
+/// The process taking the lock on the post id first handles it, others drop it.
+pub struct Dedupe<L> {
+    lock: L,
+    ttl: Duration,
+}
+
+impl<L: Lock> Dedupe<L> {
+    /// ttl must be longer than the delay between processes receiving the same post.
+    pub fn new(lock: L, ttl: Duration) -> Self {
+        Self { lock, ttl }
+    }
+}
+
+impl<L: Lock> Middleware for Dedupe<L> {
+    fn process(&self, event: &mut Event) -> Result {
+        let post = match event {
+            Event::Post(post) => post,
+            _ => return Ok(Continue::Yes),
+        };
+
+        if self.lock.acquire(&format!("post:{}", post.id), self.ttl)? {
+            return Ok(Continue::Yes);
+        }
+        Ok(Continue::No)
+    }
+
+    fn name(&self) -> &str {
+        "Dedupe"
+    }
+}
+
+/// Metadata key set to "true" on posts addressing the bot by one of its names.
+pub const ADDRESSED: &str = "message.addressed";
+
+/// Addressed recognizes posts starting with one of the names of the bot, like
+/// `flobot, !joke` or `@Flo: hello`. The name, with an optional punctuation following
+/// it, is stripped from the message and the post is marked as ADDRESSED.
+pub struct Addressed {
+    names: Vec<String>,
+}
+
+impl Addressed {
+    /// names are matched case insensitively, with or without a leading `@`.
+    pub fn new(names: Vec<String>) -> Self {
+        Self {
+            names: names
+                .iter()
+                .map(|name| name.trim_start_matches('@').to_lowercase())
+                .filter(|name| !name.is_empty())
+                .collect(),
+        }
+    }
+
+    /// Message without the name it starts with, if any.
+    fn strip<'a>(&self, message: &'a str) -> Option<&'a str> {
+        let message = message.trim_start();
+        let message = message.strip_prefix('@').unwrap_or(message);
+        self.names.iter().find_map(|name| {
+            let end = message
+                .char_indices()
+                .nth(name.chars().count())
+                .map_or(message.len(), |(i, _)| i);
+            if message[..end].to_lowercase() != *name {
+                return None;
+            }
+            let rest = &message[end..];
+            let rest = rest
+                .strip_prefix(|c: char| ",:;.!?".contains(c))
+                .unwrap_or(rest);
+            if !rest.is_empty() && !rest.starts_with(char::is_whitespace) {
+                return None;
+            }
+            Some(rest.trim_start())
+        })
+    }
+}
+
+impl Middleware for Addressed {
+    fn process(&self, event: &mut Event) -> Result {
+        let post = match event {
+            Event::Post(post) => post,
+            _ => return Ok(Continue::Yes),
+        };
+
+        if let Some(message) = self.strip(&post.message) {
+            post.message = message.to_string();
+            post.metadata
+                .insert(ADDRESSED.to_string(), "true".to_string());
+        }
+        Ok(Continue::Yes)
+    }
+
+    fn name(&self) -> &str {
+        "Addressed"
+    }
+}
+
+/// Metadata key of a post holding its message without the quoted lines.
+pub const UNQUOTED: &str = "message.unquoted";
+/// Metadata key of a post holding its quoted lines, prefixes removed.
+pub const QUOTED: &str = "message.quoted";
+
+/// StripQuotes separates quoted lines, the ones starting with one of the prefixes,
+/// from the rest of posts, in post.metadata as UNQUOTED and QUOTED. With
+/// drop_commands, posts whose `!commands` are only found in quotes are dropped, so
+/// pasting an old command does not run it again.
+pub struct StripQuotes {
+    prefixes: Vec<String>,
+    drop_commands: bool,
+}
+
+impl StripQuotes {
+    pub fn new(prefixes: Vec<String>, drop_commands: bool) -> Self {
+        Self {
+            prefixes,
+            drop_commands,
+        }
+    }
+
+    fn quoted<'a>(&self, line: &'a str) -> Option<&'a str> {
+        let trimmed = line.trim_start();
+        self.prefixes
+            .iter()
+            .find_map(|prefix| trimmed.strip_prefix(prefix.as_str()))
+            .map(|rest| rest.trim_start())
+    }
+}
+
+impl Default for StripQuotes {
+    /// Markdown block quotes, quoted commands dropped.
+    fn default() -> Self {
+        Self::new(vec![">".to_string()], true)
+    }
+}
+
+impl Middleware for StripQuotes {
+    fn process(&self, event: &mut Event) -> Result {
+        let post = match event {
+            Event::Post(post) => post,
+            _ => return Ok(Continue::Yes),
+        };
+
+        let mut unquoted = vec![];
+        let mut quoted = vec![];
+        for line in post.message.lines() {
+            match self.quoted(line) {
+                Some(line) => quoted.push(line),
+                None => unquoted.push(line),
+            }
+        }
+
+        let command =
+            |lines: &Vec<&str>| lines.iter().any(|l| l.trim().starts_with('!'));
+        if self.drop_commands && command(&quoted) && !command(&unquoted) {
+            return Ok(Continue::No);
+        }
+
+        let (unquoted, quoted) = (unquoted.join("\n"), quoted.join("\n"));
+        post.metadata.insert(UNQUOTED.to_string(), unquoted);
+        post.metadata.insert(QUOTED.to_string(), quoted);
+        Ok(Continue::Yes)
+    }
+
+    fn name(&self) -> &str {
+        "StripQuotes"
+    }
+}
+
+/// Length, in characters, of the content kept by EventSummary.
+const SUMMARY_LEN: usize = 80;
+
+/// Short description of an event kept by Recent.
+#[derive(Clone, Debug, PartialEq)]
+pub struct EventSummary {
+    pub kind: String,
+    pub channel_id: String,
+    /// truncated message of posts and edits, or description of other events.
+    pub content: String,
+    pub at: DateTime<Utc>,
+}
+
+impl EventSummary {
+    fn new(event: &Event, at: DateTime<Utc>) -> Self {
+        let (kind, channel_id, content) = match event {
+            Event::Hello(hello) => ("hello", "", hello.server_string.as_str()),
+            Event::Post(post) => {
+                ("post", post.channel_id.as_str(), post.message.as_str())
+            }
+            Event::PostEdited(edited) => (
+                "edited",
+                edited.channel_id.as_str(),
+                edited.message.as_str(),
+            ),
+            Event::Status(_) => ("status", "", ""),
+            Event::Unsupported(content) => ("unsupported", "", content.as_str()),
+            Event::Shutdown => ("shutdown", "", ""),
+        };
+        Self {
+            kind: kind.to_string(),
+            channel_id: channel_id.to_string(),
+            content: content.chars().take(SUMMARY_LEN).collect(),
+            at,
+        }
+    }
+}
+
+/// Recent keeps a summary of the last size events it saw, for live debugging.
+/// Clones share the same events: keep one as middleware and register another as
+/// handler, wrapped in a Replier, to answer `!debug events` with them.
+///
+/// Events include messages of direct and private channels, so `!debug events` is
+/// only answered to the users set with with_admins, none by default.
+#[derive(Clone)]
+pub struct Recent {
+    size: usize,
+    events: Arc<Mutex<VecDeque<EventSummary>>>,
+    admins: Vec<String>,
+}
+
+impl Recent {
+    pub fn new(size: usize) -> Self {
+        Self {
+            size,
+            events: Arc::new(Mutex::new(VecDeque::with_capacity(size))),
+            admins: vec![],
+        }
+    }
+
+    /// Users, by id, allowed to see events with `!debug events`.
+    pub fn with_admins(mut self, admins: Vec<String>) -> Self {
+        self.admins = admins;
+        self
+    }
+
+    fn push(&self, summary: EventSummary) {
+        if self.size == 0 {
+            return;
+        }
+        let mut events = self.events.lock().unwrap();
+        if events.len() >= self.size {
+            events.pop_front();
+        }
+        events.push_back(summary);
+    }
+
+    /// Summaries of the last events, oldest first.
+    pub fn recent_events(&self) -> Vec<EventSummary> {
+        self.events.lock().unwrap().iter().cloned().collect()
+    }
+}
+
+impl Middleware for Recent {
+    fn process(&self, event: &mut Event) -> Result {
+        self.push(EventSummary::new(event, Utc::now()));
+        Ok(Continue::Yes)
+    }
+
+    fn name(&self) -> &str {
+        "Recent"
+    }
+}
+
+impl ReplyHandler for Recent {
+    fn name(&self) -> String {
+        "recent events".to_string()
+    }
+
+    fn help(&self) -> Option<String> {
+        Some("`!debug events`: last events received by the bot".to_string())
+    }
+
+    fn reply(
+        &self,
+        post: &Post,
+    ) -> std::result::Result<Option<Response>, handler::Error> {
+        if post.message.trim() != "!debug events" {
+            return Ok(None);
+        }
+        if !self.admins.contains(&post.user_id) {
+            return Ok(Some(Response::ephemeral(
+                "only admins can see recent events",
+            )));
+        }
+        let events = self.recent_events();
+        if events.is_empty() {
+            return Ok(Some(Response::ephemeral("no recent events")));
+        }
+        let lines: Vec<String> = events
+            .iter()
+            .map(|e| {
+                format!(
+                    "`{}` {} `{}` {}",
+                    e.at.format("%H:%M:%S"),
+                    e.kind,
+                    e.channel_id,
+                    e.content
+                )
+            })
+            .collect();
+        Ok(Some(Response::ephemeral(&lines.join("\n"))))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::models::{ChannelInfo, Post, PostEdited};
+    use crate::testing::Recorder;
+    use std::sync::mpsc::channel;
+
+    fn edit(id: &str, message: &str) -> Event {
+        Event::PostEdited(PostEdited {
+            channel_id: "channel".to_string(),
+            message: message.to_string(),
+            user_id: "user".to_string(),
+            root_id: "".to_string(),
+            parent_id: "".to_string(),
+            id: id.to_string(),
+        })
+    }
+
+    #[test]
+    fn team_only() {
+        let team_only = TeamOnly::new("team");
+        let mut post = Post::with_message("hello");
+
+        post.team_id = "other".to_string();
+        let res = team_only.process(&mut Event::Post(post.clone())).unwrap();
+        assert!(matches!(res, Continue::No));
+
+        post.team_id = "team".to_string();
+        let res = team_only.process(&mut Event::Post(post.clone())).unwrap();
+        assert!(matches!(res, Continue::Yes));
+
+        post.team_id = "".to_string();
+        let res = team_only.process(&mut Event::Post(post.clone())).unwrap();
+        assert!(matches!(res, Continue::Yes));
+
+        // edits on channels of unknown team go through.
+        let res = team_only.process(&mut edit("post", "edited")).unwrap();
+        assert!(matches!(res, Continue::Yes));
+        post.team_id = "other".to_string();
+        post.channel_id = "channel".to_string();
+        team_only.process(&mut Event::Post(post)).unwrap();
+        let res = team_only.process(&mut edit("post", "edited")).unwrap();
+        assert!(matches!(res, Continue::No));
+    }
+
+    #[test]
+    fn max_length() {
+        let client = Recorder::new();
+        let max_length = MaxLength::new(10, Some(client.clone()));
+
+        let mut post = Post::with_message("0123456789");
+        let res = max_length.process(&mut Event::Post(post.clone())).unwrap();
+        assert!(matches!(res, Continue::Yes));
+        assert!(client.ephemerals.lock().unwrap().is_empty());
+
+        post.message.push('!');
+        post.user_id = "author".to_string();
+        let res = max_length.process(&mut Event::Post(post)).unwrap();
+        assert!(matches!(res, Continue::No));
+        let ephemerals = client.ephemerals.lock().unwrap();
+        assert_eq!(1, ephemerals.len());
+        assert_eq!("author", ephemerals[0].0);
+
+        let res = max_length
+            .process(&mut edit("post", "01234567890"))
+            .unwrap();
+        assert!(matches!(res, Continue::No));
+    }
+
+    #[test]
+    fn debounce_burst() {
+        let (sender, receiver) = channel();
+        let debounce = Debounce::new(Duration::from_millis(50), sender);
+
+        for message in ["first", "second", "final"].iter() {
+            let res = debounce.process(&mut edit("post", message)).unwrap();
+            assert!(matches!(res, Continue::No));
+        }
+
+        let mut event = receiver.recv_timeout(Duration::from_secs(1)).unwrap();
+        match &event {
+            Event::PostEdited(edited) => assert_eq!("final", edited.message),
+            _ => panic!("wrong event"),
+        }
+        let res = debounce.process(&mut event).unwrap();
+        assert!(matches!(res, Continue::Yes));
+
+        assert!(receiver.recv_timeout(Duration::from_millis(200)).is_err());
+    }
+
+    #[test]
+    fn debounce_per_post() {
+        let (sender, receiver) = channel();
+        let debounce = Debounce::new(Duration::from_millis(50), sender);
+
+        debounce.process(&mut edit("post1", "one")).unwrap();
+        debounce.process(&mut edit("post2", "two")).unwrap();
+
+        let mut got = vec![];
+        for _ in 0..2 {
+            match receiver.recv_timeout(Duration::from_secs(1)).unwrap() {
+                Event::PostEdited(edited) => got.push(edited.id),
+                _ => panic!("wrong event"),
+            }
+        }
+        got.sort();
+        assert_eq!(vec!["post1", "post2"], got);
+    }
+
+    fn at(rfc3339: &str) -> DateTime<Utc> {
+        DateTime::parse_from_rfc3339(rfc3339)
+            .unwrap()
+            .with_timezone(&Utc)
+    }
+
+    #[test]
+    fn schedule_parse() {
+        let paris = Tz::Europe__Paris;
+        let schedule =
+            Schedule::parse(paris, "mon-fri 09:00-12:00 14:00-18:00").unwrap();
+
+        // wednesday 2021-06-09, 10:30 local
+        assert!(schedule.is_open(at("2021-06-09T08:30:00Z")));
+        // lunch break
+        assert!(!schedule.is_open(at("2021-06-09T10:30:00Z")));
+        // saturday
+        assert!(!schedule.is_open(at("2021-06-12T08:30:00Z")));
+
+        assert!(Schedule::parse(paris, "mon 18:00-09:00").is_err());
+        assert!(Schedule::parse(paris, "noday 09:00-18:00").is_err());
+        assert!(Schedule::parse(paris, "mon 9h-18h").is_err());
+    }
+
+    #[test]
+    fn schedule_dst() {
+        let schedule =
+            Schedule::parse(Tz::Europe__Paris, "mon-fri 09:00-18:00").unwrap();
+
+        // friday 2021-03-26, UTC+1: 08:30 and 17:30 local.
+        assert!(!schedule.is_open(at("2021-03-26T07:30:00Z")));
+        assert!(schedule.is_open(at("2021-03-26T16:30:00Z")));
+        // monday 2021-03-29, after the change to UTC+2: 09:30 and 18:30 local.
+        assert!(schedule.is_open(at("2021-03-29T07:30:00Z")));
+        assert!(!schedule.is_open(at("2021-03-29T16:30:00Z")));
+    }
+
+    #[test]
+    fn business_hours() {
+        let client = Recorder::new();
+        let schedule = Schedule::parse(Tz::UTC, "mon-fri 09:00-18:00").unwrap();
+        let hours = BusinessHours::new(
+            schedule,
+            Some((client.clone(), "back tomorrow".to_string())),
+        );
+
+        let post = Event::Post(Post::with_message("help"));
+        let res = hours.process_at(&post, at("2021-06-09T10:00:00Z")).unwrap();
+        assert!(matches!(res, Continue::Yes));
+        assert!(client.replied().is_empty());
+
+        let res = hours.process_at(&post, at("2021-06-09T20:00:00Z")).unwrap();
+        assert!(matches!(res, Continue::No));
+        assert_eq!(vec!["back tomorrow"], client.replied());
+
+        let res = hours
+            .process_at(&edit("p", "help!"), at("2021-06-12T10:00:00Z"))
+            .unwrap();
+        assert!(matches!(res, Continue::No));
+        assert_eq!(1, client.replied().len());
+    }
+
+    /// In memory lock standing for the shared backend. Locks never expire.
+    #[derive(Clone, Default)]
+    struct SharedLock {
+        held: Arc<Mutex<Vec<String>>>,
+    }
+
+    impl Lock for SharedLock {
+        fn acquire(
+            &self,
+            key: &str,
+            _ttl: Duration,
+        ) -> std::result::Result<bool, Error> {
+            let mut held = self.held.lock().unwrap();
+            if held.iter().any(|k| k == key) {
+                return Ok(false);
+            }
+            held.push(key.to_string());
+            Ok(true)
+        }
+    }
+
+    #[test]
+    fn dedupe_across_instances() {
+        let lock = SharedLock::default();
+        let first = Dedupe::new(lock.clone(), Duration::from_secs(30));
+        let second = Dedupe::new(lock, Duration::from_secs(30));
+
+        let mut post = Post::with_message("!deploy");
+        post.id = "p1".to_string();
+
+        let res = first.process(&mut Event::Post(post.clone())).unwrap();
+        assert!(matches!(res, Continue::Yes));
+        let res = second.process(&mut Event::Post(post.clone())).unwrap();
+        assert!(matches!(res, Continue::No));
+
+        post.id = "p2".to_string();
+        let res = second.process(&mut Event::Post(post)).unwrap();
+        assert!(matches!(res, Continue::Yes));
+
+        let res = first.process(&mut edit("p1", "!deploy now")).unwrap();
+        assert!(matches!(res, Continue::Yes));
+    }
+
+    fn channel_info(id: &str, kind: ChannelKind) -> ChannelInfo {
+        ChannelInfo {
+            id: id.to_string(),
+            team_id: "".to_string(),
+            name: id.to_string(),
+            display_name: id.to_string(),
+            kind,
+        }
+    }
+
+    #[test]
+    fn channel_type() {
+        let client = Recorder::new();
+        client.channels.lock().unwrap().extend(vec![
+            channel_info("dm", ChannelKind::Direct),
+            channel_info("town", ChannelKind::Public),
+        ]);
+        let channel_type = ChannelType::new(client.clone());
+
+        let kind = |channel_id: &str| {
+            let mut post = Post::with_message("hi");
+            post.channel_id = channel_id.to_string();
+            let mut event = Event::Post(post);
+            let res = channel_type.process(&mut event).unwrap();
+            assert!(matches!(res, Continue::Yes));
+            match event {
+                Event::Post(post) => post.metadata.get(CHANNEL_KIND).cloned(),
+                _ => unreachable!(),
+            }
+        };
+
+        assert_eq!(Some("direct".to_string()), kind("dm"));
+        assert_eq!(Some("public".to_string()), kind("town"));
+        assert_eq!(None, kind("unknown"));
+
+        // resolved from cache.
+        client.channels.lock().unwrap().clear();
+        assert_eq!(Some("direct".to_string()), kind("dm"));
+    }
+
+    #[test]
+    fn strip_quotes() {
+        let strip = StripQuotes::default();
+
+        let mut quoted = Event::Post(Post::with_message("remember?\n> !deploy prod"));
+        let res = strip.process(&mut quoted).unwrap();
+        assert!(matches!(res, Continue::No));
+
+        let mut live =
+            Event::Post(Post::with_message("> !deploy prod\n!deploy staging"));
+        let res = strip.process(&mut live).unwrap();
+        assert!(matches!(res, Continue::Yes));
+        match live {
+            Event::Post(post) => {
+                assert_eq!("!deploy staging", post.metadata[UNQUOTED]);
+                assert_eq!("!deploy prod", post.metadata[QUOTED]);
+            }
+            _ => unreachable!(),
+        }
+    }
+
+    #[test]
+    fn strip_quotes_rules() {
+        let strip = StripQuotes::new(vec!["| ".to_string()], false);
+
+        let mut event = Event::Post(Post::with_message("| !joke\n> kept"));
+        let res = strip.process(&mut event).unwrap();
+        assert!(matches!(res, Continue::Yes));
+        match event {
+            Event::Post(post) => {
+                assert_eq!("> kept", post.metadata[UNQUOTED]);
+                assert_eq!("!joke", post.metadata[QUOTED]);
+            }
+            _ => unreachable!(),
+        }
+    }
+
+    #[test]
+    fn recent_eviction() {
+        let recent = Recent::new(3);
+        for i in 0..5 {
+            let mut event = Event::Post(Post::with_message(&format!("message {}", i)));
+            let res = recent.process(&mut event).unwrap();
+            assert!(matches!(res, Continue::Yes));
+        }
+        recent.process(&mut edit("post", &"x".repeat(200))).unwrap();
+
+        let events = recent.recent_events();
+        let messages: Vec<_> = events.iter().map(|e| e.content.as_str()).collect();
+        assert_eq!(
+            vec!["message 3", "message 4", &"x".repeat(SUMMARY_LEN)],
+            messages
+        );
+        assert_eq!("edited", events[2].kind);
+        assert_eq!("channel", events[2].channel_id);
+
+        assert!(Recent::new(0).recent_events().is_empty());
+    }
+
+    #[test]
+    fn recent_reply() {
+        let recent = Recent::new(2).with_admins(vec!["admin".to_string()]);
+        let debug = recent.clone();
+        assert!(debug.reply(&Post::with_message("hello")).unwrap().is_none());
+
+        recent.process(&mut Event::Shutdown).unwrap();
+        let mut post = Post::with_message("!debug events");
+        let refused = debug.reply(&post).unwrap().unwrap();
+        assert!(refused.ephemeral);
+        assert!(!refused.message.contains("shutdown"));
+
+        post.user_id = "admin".to_string();
+        let response = debug.reply(&post).unwrap().unwrap();
+        assert!(response.ephemeral);
+        assert!(response.message.contains("shutdown"));
+    }
+
+    #[test]
+    fn addressed_names() {
+        let addressed = Addressed::new(vec!["flobot".to_string(), "@Flo".to_string()]);
+        let cases = [
+            ("flobot !joke", Some("!joke")),
+            ("@flobot: !joke", Some("!joke")),
+            ("FloBot, hello there", Some("hello there")),
+            ("  flo! ça va ?", Some("ça va ?")),
+            ("@FLO", Some("")),
+            ("flobot!joke", None),
+            ("floboter hello", None),
+            ("hello flobot", None),
+            ("fl", None),
+        ];
+        for (message, expected) in cases.iter() {
+            let mut event = Event::Post(Post::with_message(message));
+            let res = addressed.process(&mut event).unwrap();
+            assert!(matches!(res, Continue::Yes));
+            let post = match event {
+                Event::Post(post) => post,
+                _ => panic!("wrong event"),
+            };
+            match expected {
+                Some(stripped) => {
+                    assert_eq!(*stripped, post.message, "{}", message);
+                    assert_eq!(Some(&"true".to_string()), post.metadata.get(ADDRESSED));
+                }
+                None => {
+                    assert_eq!(*message, post.message);
+                    assert!(post.metadata.get(ADDRESSED).is_none(), "{}", message);
+                }
+            }
+        }
+    }
+}
@@ -1,3 +1,5 @@
+use std::collections::HashMap;
+
 #[derive(Clone, Debug)]
 pub enum Event {
     Hello(Hello),
@@ -22,6 +24,9 @@ pub struct Post {
     pub parent_id: String,
     pub id: String,
     pub team_id: String,
+    /// data attached to the post by middlewares and handler wrappers,
+    /// for the handlers processing it next.
+    pub metadata: HashMap<String, String>,
 }
 
 #[derive(Clone, Debug)]
@@ -44,6 +49,7 @@ impl Post {
             parent_id: "".to_string(),
             id: "".to_string(),
             team_id: "".to_string(),
+            metadata: HashMap::new(),
         }
     }
 
@@ -88,12 +94,109 @@ pub struct StatusError {
     pub status_code: i32,
 }
 
+#[derive(Clone, Debug)]
 pub struct User {
     pub id: String,
     pub username: String,
     pub display_name: String,
 }
 
+#[derive(Clone, Debug)]
+pub struct Team {
+    pub id: String,
+    pub name: String,
+    pub display_name: String,
+}
+
+/// Preview of a link found in a post.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Embed {
+    /// kind of preview, like "opengraph" or "image".
+    pub kind: String,
+    pub url: String,
+}
+
+#[derive(Clone, Debug, PartialEq)]
+pub struct Reaction {
+    pub user_id: String,
+    pub emoji_name: String,
+}
+
+/// File attached to a post.
+#[derive(Clone, Debug, PartialEq)]
+pub struct FileInfo {
+    pub id: String,
+    pub name: String,
+    /// size in bytes.
+    pub size: u64,
+    pub mime_type: String,
+}
+
+/// Post along with what is attached to it.
+#[derive(Clone, Debug)]
+pub struct PostDetails {
+    pub post: Post,
+    pub embeds: Vec<Embed>,
+    pub reactions: Vec<Reaction>,
+    pub files: Vec<FileInfo>,
+}
+
+/// Limits configured on the server.
+#[derive(Clone, Debug, PartialEq)]
+pub struct ServerLimits {
+    /// maximum length of a post, in characters.
+    pub max_post_len: usize,
+    /// maximum size of an uploaded file, in bytes.
+    pub max_file_size: u64,
+}
+
+impl Default for ServerLimits {
+    /// Conservative limits, accepted by any server.
+    fn default() -> Self {
+        Self {
+            max_post_len: 4000,
+            max_file_size: 50 * 1024 * 1024,
+        }
+    }
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum ChannelKind {
+    Public,
+    Private,
+    Direct,
+    Group,
+}
+
+impl ChannelKind {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            ChannelKind::Public => "public",
+            ChannelKind::Private => "private",
+            ChannelKind::Direct => "direct",
+            ChannelKind::Group => "group",
+        }
+    }
+}
+
+#[derive(Clone, Debug)]
+pub struct ChannelInfo {
+    pub id: String,
+    pub team_id: String,
+    pub name: String,
+    pub display_name: String,
+    pub kind: ChannelKind,
+}
+
+/// Unread messages and mentions of the bot on a channel.
+#[derive(Clone, Debug)]
+pub struct ChannelUnread {
+    pub team_id: String,
+    pub channel_id: String,
+    pub msg_count: u64,
+    pub mention_count: u64,
+}
+
 pub struct GenericMe {
     pub id: String,
 }
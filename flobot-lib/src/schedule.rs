@@ -0,0 +1,761 @@
+//! Jobs sending posts, or calling back handlers, at a given time or on a cron
+//! schedule. Jobs are saved to a Store so they survive restarts, and run from the
+//! task runner.
+
+use crate::client::{self, Creator, Editor, Expiring, Scheduler, Sender};
+use crate::log::{Level, Logger};
+use crate::models::Post;
+use crate::task::{self, ExecIn, Now};
+use chrono::{DateTime, Datelike, Duration as CDuration, Timelike, Utc};
+use serde_json::{json, Value};
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex, RwLock};
+use std::time::Duration;
+
+#[derive(Debug, PartialEq)]
+pub enum Error {
+    Spec(String),
+    Store(String),
+}
+
+impl std::error::Error for Error {}
+
+impl std::fmt::Display for Error {
+    fn fmt(&self, f: &mut std::fmt::Formatter) -> std::fmt::Result {
+        match self {
+            Error::Spec(e) => write!(f, "invalid schedule: {}", e),
+            Error::Store(e) => write!(f, "cannot store job: {}", e),
+        }
+    }
+}
+
+pub type Result<T> = std::result::Result<T, Error>;
+
+/// Cron schedule as `minute hour day-of-month month day-of-week`, in UTC. Fields
+/// are `*`, values, ranges and steps: `30 9 * * 1-5`, `*/15 * * * *`, `0 8,12 1 * *`.
+/// Sunday is 0 or 7.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Cron {
+    spec: String,
+    minutes: Vec<bool>,
+    hours: Vec<bool>,
+    days: Vec<bool>,
+    months: Vec<bool>,
+    weekdays: Vec<bool>,
+    any_day: bool,
+    any_weekday: bool,
+}
+
+fn parse_field(
+    field: &str,
+    min: u32,
+    max: u32,
+) -> std::result::Result<Vec<bool>, String> {
+    let number = |v: &str| v.parse::<u32>().map_err(|_| format!("invalid value {}", v));
+    let mut set = vec![false; max as usize + 1];
+    for part in field.split(',') {
+        let mut halves = part.splitn(2, '/');
+        let range = halves.next().unwrap();
+        let step = match halves.next() {
+            Some(step) => number(step)?,
+            None => 1,
+        };
+        if step == 0 {
+            return Err(format!("invalid step in {}", part));
+        }
+
+        let (from, to) = if range == "*" {
+            (min, max)
+        } else {
+            let mut bounds = range.splitn(2, '-');
+            let from = number(bounds.next().unwrap())?;
+            match bounds.next() {
+                Some(to) => (from, number(to)?),
+                None if step > 1 => (from, max),
+                None => (from, from),
+            }
+        };
+        if from < min || to > max || from > to {
+            return Err(format!("{} is out of {}-{}", part, min, max));
+        }
+        for v in (from..=to).step_by(step as usize) {
+            set[v as usize] = true;
+        }
+    }
+    Ok(set)
+}
+
+impl Cron {
+    pub fn parse(spec: &str) -> Result<Self> {
+        let fields: Vec<&str> = spec.split_whitespace().collect();
+        if fields.len() != 5 {
+            return Err(Error::Spec(format!("{}: expected 5 fields", spec)));
+        }
+        let field = |i: usize, min, max| {
+            parse_field(fields[i], min, max)
+                .map_err(|e| Error::Spec(format!("{}: {}", spec, e)))
+        };
+
+        let mut weekdays = field(4, 0, 7)?;
+        weekdays[0] |= weekdays[7];
+        Ok(Self {
+            spec: fields.join(" "),
+            minutes: field(0, 0, 59)?,
+            hours: field(1, 0, 23)?,
+            days: field(2, 1, 31)?,
+            months: field(3, 1, 12)?,
+            weekdays,
+            any_day: fields[2] == "*",
+            any_weekday: fields[4] == "*",
+        })
+    }
+
+    pub fn spec(&self) -> &str {
+        &self.spec
+    }
+
+    /// Restricted day of month and day of week match if either does, as with cron.
+    fn matches(&self, t: &DateTime<Utc>) -> bool {
+        let day = self.days[t.day() as usize];
+        let weekday = self.weekdays[t.weekday().num_days_from_sunday() as usize];
+        let day = match (self.any_day, self.any_weekday) {
+            (false, false) => day || weekday,
+            _ => day && weekday,
+        };
+        day && self.minutes[t.minute() as usize]
+            && self.hours[t.hour() as usize]
+            && self.months[t.month() as usize]
+    }
+
+    /// First minute strictly after t matching the schedule, if any within 4 years.
+    pub fn next_after(&self, t: DateTime<Utc>) -> Option<DateTime<Utc>> {
+        let mut t = t.with_second(0)?.with_nanosecond(0)? + CDuration::minutes(1);
+        let end = t + CDuration::days(4 * 366);
+        while t < end {
+            if !self.months[t.month() as usize] {
+                // skip to the first day of the next month.
+                t = (t + CDuration::days(32 - t.day() as i64)).with_day(1)?;
+                t = t.with_hour(0)?.with_minute(0)?;
+            } else if !self.hours[t.hour() as usize] {
+                t = t.with_minute(0)? + CDuration::hours(1);
+            } else if self.matches(&t) {
+                return Some(t);
+            } else {
+                t = t + CDuration::minutes(1);
+            }
+        }
+        None
+    }
+}
+
+#[derive(Clone, Debug, PartialEq)]
+pub enum Action {
+    /// message posted on the channel of the job.
+    Post(String),
+    /// name of the callback registered with Jobs::on.
+    Callback(String),
+    /// id of the post deleted from the channel of the job.
+    Delete(String),
+}
+
+#[derive(Clone, Debug, PartialEq)]
+pub enum Schedule {
+    At(DateTime<Utc>),
+    Cron(Cron),
+}
+
+#[derive(Clone, Debug, PartialEq)]
+pub struct Job {
+    pub id: String,
+    pub channel_id: String,
+    pub action: Action,
+    pub schedule: Schedule,
+    /// next time the job runs.
+    pub next: DateTime<Utc>,
+    /// times in a row the post of the job could not be sent.
+    pub failures: u32,
+}
+
+impl Job {
+    pub fn to_json(&self) -> String {
+        let (kind, value) = match &self.action {
+            Action::Post(message) => ("post", message),
+            Action::Callback(name) => ("callback", name),
+            Action::Delete(post_id) => ("delete", post_id),
+        };
+        let schedule = match &self.schedule {
+            Schedule::At(at) => json!({ "at": at.to_rfc3339() }),
+            Schedule::Cron(cron) => json!({ "cron": cron.spec() }),
+        };
+        json!({
+            "id": self.id,
+            "channel_id": self.channel_id,
+            "action": { "kind": kind, "value": value },
+            "schedule": schedule,
+            "next": self.next.to_rfc3339(),
+            "failures": self.failures,
+        })
+        .to_string()
+    }
+
+    pub fn from_json(data: &str) -> Result<Self> {
+        let invalid =
+            |what: &str| Error::Store(format!("invalid job {}: {}", what, data));
+        let v: Value = serde_json::from_str(data).map_err(|_| invalid("json"))?;
+        let string = |pointer: &str| {
+            v.pointer(pointer)
+                .and_then(Value::as_str)
+                .map(String::from)
+                .ok_or_else(|| invalid(pointer))
+        };
+        let time = |pointer: &str| {
+            DateTime::parse_from_rfc3339(&string(pointer)?)
+                .map(|t| t.with_timezone(&Utc))
+                .map_err(|_| invalid(pointer))
+        };
+
+        let action = match string("/action/kind")?.as_str() {
+            "post" => Action::Post(string("/action/value")?),
+            "callback" => Action::Callback(string("/action/value")?),
+            "delete" => Action::Delete(string("/action/value")?),
+            _ => return Err(invalid("action")),
+        };
+        let schedule = match v.pointer("/schedule/cron") {
+            Some(_) => Schedule::Cron(Cron::parse(&string("/schedule/cron")?)?),
+            None => Schedule::At(time("/schedule/at")?),
+        };
+        Ok(Self {
+            id: string("/id")?,
+            channel_id: string("/channel_id")?,
+            action,
+            schedule,
+            next: time("/next")?,
+            failures: v.get("failures").and_then(Value::as_u64).unwrap_or(0) as u32,
+        })
+    }
+}
+
+/// Where jobs are kept between restarts.
+pub trait Store {
+    /// Save job, replacing the job with the same id if any.
+    fn save(&self, job: &Job) -> std::result::Result<(), String>;
+    fn delete(&self, id: &str) -> std::result::Result<(), String>;
+    fn load(&self) -> std::result::Result<Vec<Job>, String>;
+}
+
+/// Where a post sent later waits for its time.
+#[derive(Debug, PartialEq)]
+pub enum Scheduled {
+    /// id of the scheduled post of the backend.
+    Post(String),
+    /// id of the job sending the post.
+    Job(String),
+}
+
+type Callback = Arc<dyn Fn(&Job) + Send + Sync>;
+
+/// One-shot jobs whose post cannot be sent are dropped after this many tries.
+pub const MAX_FAILURES: u32 = 5;
+
+/// Jobs runs due jobs when the task runner executes it, so they run up to a minute
+/// late. Posts are sent and deleted with sender, callbacks are called with their job.
+/// Callbacks are not saved and must be registered again at startup with on().
+///
+/// Clones share jobs: handlers keep one to add their jobs.
+#[derive(Clone)]
+pub struct Jobs<S> {
+    sender: S,
+    store: Arc<dyn Store + Send + Sync>,
+    jobs: Arc<Mutex<Vec<Job>>>,
+    callbacks: Arc<RwLock<HashMap<String, Callback>>>,
+    /// ids of the jobs being run, true when cancelled meanwhile.
+    running: Arc<Mutex<HashMap<String, bool>>>,
+    seq: Arc<AtomicU64>,
+    logger: Logger,
+}
+
+impl<S: Sender + Editor> Jobs<S> {
+    /// Jobs of store, jobs whose time passed while the bot was stopped run first.
+    pub fn new(sender: S, store: Arc<dyn Store + Send + Sync>) -> Result<Self> {
+        let jobs = store.load().map_err(Error::Store)?;
+        Ok(Self {
+            sender,
+            store,
+            jobs: Arc::new(Mutex::new(jobs)),
+            callbacks: Arc::default(),
+            running: Arc::default(),
+            seq: Arc::default(),
+            logger: Logger::default(),
+        })
+    }
+
+    pub fn with_logger(mut self, logger: Logger) -> Self {
+        self.logger = logger;
+        self
+    }
+
+    pub fn on<F: Fn(&Job) + Send + Sync + 'static>(&self, name: &str, f: F) -> &Self {
+        self.callbacks
+            .write()
+            .unwrap()
+            .insert(name.to_string(), Arc::new(f));
+        self
+    }
+
+    fn add(
+        &self,
+        channel_id: &str,
+        action: Action,
+        schedule: Schedule,
+        next: DateTime<Utc>,
+    ) -> Result<String> {
+        let job = Job {
+            id: format!(
+                "{}-{}",
+                Utc::now().timestamp_millis(),
+                self.seq.fetch_add(1, Ordering::Relaxed)
+            ),
+            channel_id: channel_id.to_string(),
+            action,
+            schedule,
+            next,
+            failures: 0,
+        };
+        self.store.save(&job).map_err(Error::Store)?;
+        let id = job.id.clone();
+        self.jobs.lock().unwrap().push(job);
+        Ok(id)
+    }
+
+    /// Run action once at the given time, returns the id of the job.
+    pub fn at(
+        &self,
+        at: DateTime<Utc>,
+        channel_id: &str,
+        action: Action,
+    ) -> Result<String> {
+        self.add(channel_id, action, Schedule::At(at), at)
+    }
+
+    /// Run action on every time matching spec, see Cron.
+    pub fn cron(&self, spec: &str, channel_id: &str, action: Action) -> Result<String> {
+        let cron = Cron::parse(spec)?;
+        let next = cron
+            .next_after(Utc::now())
+            .ok_or_else(|| Error::Spec(format!("{} never runs", spec)))?;
+        self.add(channel_id, action, Schedule::Cron(cron), next)
+    }
+
+    /// Jobs in the order they will run.
+    pub fn list(&self) -> Vec<Job> {
+        let mut jobs = self.jobs.lock().unwrap().clone();
+        jobs.sort_by_key(|job| job.next);
+        jobs
+    }
+
+    /// Returns false if there is no job id. A job being run is not run again.
+    pub fn cancel(&self, id: &str) -> Result<bool> {
+        let mut jobs = self.jobs.lock().unwrap();
+        if let Some(i) = jobs.iter().position(|job| job.id == id) {
+            self.store.delete(id).map_err(Error::Store)?;
+            jobs.remove(i);
+            return Ok(true);
+        }
+        match self.running.lock().unwrap().get_mut(id) {
+            Some(cancelled) => {
+                self.store.delete(id).map_err(Error::Store)?;
+                *cancelled = true;
+                Ok(true)
+            }
+            None => Ok(false),
+        }
+    }
+
+    fn cancelled(&self, id: &str) -> bool {
+        self.running.lock().unwrap().get(id) == Some(&true)
+    }
+
+    fn dispatch(&self, job: &Job) -> bool {
+        match &job.action {
+            Action::Post(message) => {
+                let mut post = Post::with_message(message);
+                post.channel_id = job.channel_id.clone();
+                if let Err(e) = self.sender.post(&post) {
+                    let message =
+                        format!("cannot send post of job {}: {:?}", job.id, e);
+                    self.logger.log(Level::Warn, &message);
+                    return false;
+                }
+            }
+            Action::Delete(post_id) => {
+                let mut post = Post::with_message("");
+                post.id = post_id.clone();
+                post.channel_id = job.channel_id.clone();
+                if let Err(e) = self.sender.delete(&post) {
+                    let message =
+                        format!("cannot delete post of job {}: {:?}", job.id, e);
+                    self.logger.log(Level::Warn, &message);
+                    return false;
+                }
+            }
+            Action::Callback(name) => {
+                let callback = self.callbacks.read().unwrap().get(name).cloned();
+                match callback {
+                    Some(callback) => callback(job),
+                    None => self.logger.log(
+                        Level::Error,
+                        &format!("job {}: no callback {}", job.id, name),
+                    ),
+                }
+            }
+        }
+        true
+    }
+
+    /// Run jobs due at now, returns how many ran. Jobs are run without holding the
+    /// lock, callbacks can add jobs and cancel them. One-shot jobs whose post cannot
+    /// be sent or deleted are kept to be tried again, up to MAX_FAILURES times.
+    fn run_due(&self, now: DateTime<Utc>) -> usize {
+        let due: Vec<Job> = {
+            let mut jobs = self.jobs.lock().unwrap();
+            let (due, later): (Vec<Job>, _) =
+                jobs.drain(..).partition(|job| job.next <= now);
+            *jobs = later;
+            let mut running = self.running.lock().unwrap();
+            running.extend(due.iter().map(|job| (job.id.clone(), false)));
+            due
+        };
+
+        let mut ran = 0;
+        for mut job in due {
+            if self.cancelled(&job.id) {
+                self.running.lock().unwrap().remove(&job.id);
+                continue;
+            }
+            let id = job.id.clone();
+            let done = self.dispatch(&job);
+            if done {
+                ran += 1;
+                job.failures = 0;
+            } else {
+                job.failures += 1;
+            }
+            let res = match &job.schedule {
+                Schedule::At(_) if done => self.store.delete(&job.id).map(|_| None),
+                Schedule::At(_) if job.failures >= MAX_FAILURES => {
+                    let message =
+                        format!("job {}: dropped after {} tries", job.id, job.failures);
+                    self.logger.log(Level::Warn, &message);
+                    self.store.delete(&job.id).map(|_| None)
+                }
+                Schedule::At(_) => self.store.save(&job).map(|_| Some(job)),
+                Schedule::Cron(cron) => match cron.next_after(now) {
+                    Some(next) => {
+                        job.next = next;
+                        self.store.save(&job).map(|_| Some(job))
+                    }
+                    None => self.store.delete(&job.id).map(|_| None),
+                },
+            };
+            match res {
+                Ok(Some(job)) => {
+                    // cancel() looks at jobs before running, keep both locked.
+                    let mut jobs = self.jobs.lock().unwrap();
+                    let cancelled = self.running.lock().unwrap().remove(&job.id);
+                    if cancelled == Some(true) {
+                        if let Err(e) = self.store.delete(&job.id) {
+                            self.logger
+                                .log(Level::Error, &format!("cannot store job: {}", e));
+                        }
+                    } else {
+                        jobs.push(job);
+                    }
+                }
+                Ok(None) => {
+                    self.running.lock().unwrap().remove(&id);
+                }
+                Err(e) => {
+                    self.running.lock().unwrap().remove(&id);
+                    self.logger
+                        .log(Level::Error, &format!("cannot store job: {}", e));
+                }
+            }
+        }
+        ran
+    }
+}
+
+impl<S: Sender + Editor + Scheduler> Jobs<S> {
+    /// Send post at the given time with the backend, or with a job when the backend
+    /// has no scheduled posts. The job posts the message on the channel of post,
+    /// outside of any thread.
+    pub fn schedule(
+        &self,
+        post: &Post,
+        at: DateTime<Utc>,
+    ) -> client::Result<Scheduled> {
+        if let Some(id) = self.sender.schedule(post, at)? {
+            return Ok(Scheduled::Post(id));
+        }
+        self.logger.log(
+            Level::Info,
+            "scheduled posts unsupported by the backend, keeping the post in jobs",
+        );
+        self.at(at, &post.channel_id, Action::Post(post.message.clone()))
+            .map(Scheduled::Job)
+            .map_err(|e| client::Error::Other(e.to_string()))
+    }
+}
+
+/// Deletions are jobs, so they survive restarts.
+impl<S: Sender + Creator + Editor> Expiring for Jobs<S> {
+    fn post_with_ttl(&self, post: &Post, ttl: Duration) -> client::Result<Post> {
+        let created = self.sender.create_post(post)?;
+        let at = Utc::now()
+            + CDuration::from_std(ttl)
+                .map_err(|e| client::Error::Other(e.to_string()))?;
+        self.at(at, &created.channel_id, Action::Delete(created.id.clone()))
+            .map_err(|e| client::Error::Other(e.to_string()))?;
+        Ok(created)
+    }
+}
+
+impl<S: Sender + Editor> task::Task for Jobs<S> {
+    fn name(&self) -> String {
+        "jobs".into()
+    }
+
+    fn init_exec(&self, _now: Now) -> ExecIn {
+        Duration::from_secs(0)
+    }
+
+    fn exec(&self, now: Now) -> std::result::Result<ExecIn, task::Error> {
+        self.run_due(now.with_timezone(&Utc));
+        Ok(Duration::from_secs(60))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::testing::{Down, Recorder};
+    use chrono::TimeZone;
+
+    #[derive(Default)]
+    struct Memory {
+        jobs: Mutex<HashMap<String, String>>,
+    }
+
+    impl Store for Memory {
+        fn save(&self, job: &Job) -> std::result::Result<(), String> {
+            self.jobs
+                .lock()
+                .unwrap()
+                .insert(job.id.clone(), job.to_json());
+            Ok(())
+        }
+
+        fn delete(&self, id: &str) -> std::result::Result<(), String> {
+            self.jobs.lock().unwrap().remove(id);
+            Ok(())
+        }
+
+        fn load(&self) -> std::result::Result<Vec<Job>, String> {
+            let jobs = self.jobs.lock().unwrap();
+            jobs.values()
+                .map(|job| Job::from_json(job).map_err(|e| e.to_string()))
+                .collect()
+        }
+    }
+
+    fn utc(y: i32, m: u32, d: u32, h: u32, min: u32) -> DateTime<Utc> {
+        Utc.ymd(y, m, d).and_hms(h, min, 0)
+    }
+
+    #[test]
+    fn cron_next() {
+        // 2021-09-17 is a friday.
+        let now = utc(2021, 9, 17, 9, 30);
+        let weekdays = Cron::parse("30 9 * * 1-5").unwrap();
+        assert_eq!(Some(utc(2021, 9, 20, 9, 30)), weekdays.next_after(now));
+
+        let quarters = Cron::parse("*/15 * * * *").unwrap();
+        assert_eq!(Some(utc(2021, 9, 17, 9, 45)), quarters.next_after(now));
+
+        let new_year = Cron::parse("0 0 1 1 *").unwrap();
+        assert_eq!(Some(utc(2022, 1, 1, 0, 0)), new_year.next_after(now));
+
+        // day of month or sunday.
+        let either = Cron::parse("0 12 20 * 0,7").unwrap();
+        assert_eq!(Some(utc(2021, 9, 19, 12, 0)), either.next_after(now));
+
+        let never = Cron::parse("0 0 30 2 *").unwrap();
+        assert_eq!(None, never.next_after(now));
+    }
+
+    #[test]
+    fn cron_invalid() {
+        for spec in &[
+            "* * * *",
+            "60 * * * *",
+            "*/0 * * * *",
+            "5-1 * * * *",
+            "a * * * *",
+        ] {
+            assert!(Cron::parse(spec).is_err(), "{}", spec);
+        }
+    }
+
+    #[test]
+    fn job_json() {
+        let job = Job {
+            id: "1".to_string(),
+            channel_id: "town-square".to_string(),
+            action: Action::Callback("standup".to_string()),
+            schedule: Schedule::Cron(Cron::parse("0 9  * * 1-5").unwrap()),
+            next: utc(2021, 9, 20, 9, 0),
+            failures: 2,
+        };
+        assert_eq!(job, Job::from_json(&job.to_json()).unwrap());
+        assert!(Job::from_json("{}").is_err());
+    }
+
+    #[test]
+    fn jobs_run_due() {
+        let client = Recorder::new();
+        let jobs = Jobs::new(client.clone(), Arc::new(Memory::default())).unwrap();
+        let called = Arc::new(Mutex::new(vec![]));
+        let c = called.clone();
+        jobs.on("standup", move |job| {
+            c.lock().unwrap().push(job.channel_id.clone())
+        });
+
+        let now = Utc::now();
+        jobs.at(now, "town-square", Action::Post("remember".to_string()))
+            .unwrap();
+        let later = jobs
+            .at(
+                now + CDuration::hours(1),
+                "town-square",
+                Action::Post("later".to_string()),
+            )
+            .unwrap();
+        jobs.cron(
+            "* * * * *",
+            "standup",
+            Action::Callback("standup".to_string()),
+        )
+        .unwrap();
+
+        assert_eq!(1, jobs.run_due(now));
+        assert_eq!(1, jobs.run_due(now + CDuration::minutes(2)));
+        let posts = client.posts.lock().unwrap().clone();
+        assert_eq!(1, posts.len());
+        assert_eq!(
+            ("remember", "town-square"),
+            (posts[0].message.as_str(), posts[0].channel_id.as_str())
+        );
+        assert_eq!(vec!["standup"], *called.lock().unwrap());
+
+        let ids: Vec<String> = jobs.list().into_iter().map(|job| job.id).collect();
+        assert_eq!(2, ids.len());
+        assert!(ids.contains(&later));
+        assert!(jobs.cancel(&later).unwrap());
+        assert!(!jobs.cancel(&later).unwrap());
+        assert_eq!(1, jobs.list().len());
+    }
+
+    #[test]
+    fn jobs_restart() {
+        let store = Arc::new(Memory::default());
+        let client = Recorder::new();
+        let jobs = Jobs::new(client.clone(), store.clone()).unwrap();
+        let at = Utc::now() + CDuration::hours(2);
+        let id = jobs
+            .at(at, "town-square", Action::Post("hi".to_string()))
+            .unwrap();
+        drop(jobs);
+
+        let restarted = Jobs::new(client.clone(), store.clone()).unwrap();
+        assert_eq!(id, restarted.list()[0].id);
+        assert_eq!(1, restarted.run_due(at));
+        assert!(store.load().unwrap().is_empty());
+    }
+
+    #[test]
+    fn jobs_cancel_running() {
+        let store = Arc::new(Memory::default());
+        let jobs = Jobs::new(Recorder::new(), store.clone()).unwrap();
+        let shared = jobs.clone();
+        jobs.on("once", move |job| {
+            assert!(shared.cancel(&job.id).unwrap());
+        });
+        jobs.cron(
+            "* * * * *",
+            "town-square",
+            Action::Callback("once".to_string()),
+        )
+        .unwrap();
+
+        assert_eq!(1, jobs.run_due(Utc::now() + CDuration::minutes(2)));
+        assert!(jobs.list().is_empty());
+        assert!(store.load().unwrap().is_empty());
+    }
+
+    #[test]
+    fn jobs_retries() {
+        let store = Arc::new(Memory::default());
+        let jobs = Jobs::new(Down, store.clone()).unwrap();
+        let now = Utc::now();
+        jobs.at(now, "town-square", Action::Post("hi".to_string()))
+            .unwrap();
+
+        for tries in 1..MAX_FAILURES {
+            assert_eq!(0, jobs.run_due(now));
+            assert_eq!(tries, store.load().unwrap()[0].failures);
+        }
+        assert_eq!(0, jobs.run_due(now));
+        assert!(jobs.list().is_empty());
+        assert!(store.load().unwrap().is_empty());
+    }
+
+    #[test]
+    fn jobs_post_with_ttl() {
+        let store = Arc::new(Memory::default());
+        let client = Recorder::new();
+        let jobs = Jobs::new(client.clone(), store.clone()).unwrap();
+        let mut post = Post::with_message("short lived");
+        post.channel_id = "town-square".to_string();
+
+        let created = jobs.post_with_ttl(&post, Duration::from_secs(60)).unwrap();
+        assert_eq!("post-1", created.id);
+        assert_eq!(1, client.posts.lock().unwrap().len());
+        let job = &store.load().unwrap()[0];
+        assert_eq!(Action::Delete("post-1".to_string()), job.action);
+
+        assert_eq!(0, jobs.run_due(Utc::now()));
+        assert_eq!(1, jobs.run_due(Utc::now() + CDuration::minutes(2)));
+        assert_eq!(vec!["post-1"], *client.deletes.lock().unwrap());
+    }
+
+    #[test]
+    fn jobs_schedule_fallback() {
+        let client = Recorder::new();
+        let jobs = Jobs::new(client.clone(), Arc::new(Memory::default())).unwrap();
+        let mut post = Post::with_message("standup!");
+        post.channel_id = "town-square".to_string();
+        let at = Utc::now() + CDuration::hours(1);
+
+        let id = match jobs.schedule(&post, at).unwrap() {
+            Scheduled::Job(id) => id,
+            scheduled => panic!("expected a job, got {:?}", scheduled),
+        };
+        let job = &jobs.list()[0];
+        assert_eq!((id.as_str(), at), (job.id.as_str(), job.next));
+        assert_eq!(Action::Post("standup!".to_string()), job.action);
+
+        assert_eq!(1, jobs.run_due(at));
+        assert_eq!("standup!", client.posts.lock().unwrap()[0].message);
+    }
+}
@@ -0,0 +1,167 @@
+//! Shedding of low priority events when the instance falls behind the backend.
+
+use crate::models::Event;
+use crate::stats::Collector;
+use serde_json::Value;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::mpsc::{Receiver, Sender};
+use std::sync::Arc;
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Priority {
+    /// dropped when too many events are queued, like typing events.
+    Low,
+    High,
+}
+
+/// Kind of event as the backend names it, like "posted" or "typing" for the events
+/// the instance does not support.
+pub fn kind(event: &Event) -> String {
+    match event {
+        Event::Hello(_) => "hello".to_string(),
+        Event::Post(_) => "posted".to_string(),
+        Event::PostEdited(_) => "post_edited".to_string(),
+        Event::Status(_) => "status".to_string(),
+        Event::Shutdown => "shutdown".to_string(),
+        // the raw message of the backend, its kind is in the `event` field.
+        Event::Unsupported(raw) => serde_json::from_str::<Value>(raw)
+            .ok()
+            .and_then(|v| v["event"].as_str().map(String::from))
+            .unwrap_or_else(|| "unsupported".to_string()),
+    }
+}
+
+/// Shedder forwards events to the instance, dropping low priority ones while
+/// threshold events or more wait for the instance. The instance tells when it takes
+/// one, see Instance::set_shedder. Clones share the count of queued events.
+///
+/// Unsupported events are the low priority ones, unless kinds are given with
+/// with_low. Shed events are counted in stats.
+#[derive(Clone)]
+pub struct Shedder {
+    threshold: usize,
+    low: Option<Vec<String>>,
+    queued: Arc<AtomicUsize>,
+    collector: Collector,
+}
+
+impl Shedder {
+    pub fn new(threshold: usize, collector: Collector) -> Self {
+        Self {
+            threshold,
+            low: None,
+            queued: Arc::default(),
+            collector,
+        }
+    }
+
+    /// Only events of these kinds are low priority, see kind().
+    pub fn with_low(mut self, kinds: Vec<String>) -> Self {
+        self.low = Some(kinds);
+        self
+    }
+
+    pub fn priority(&self, event: &Event) -> Priority {
+        let low = match (&self.low, event) {
+            (_, Event::Shutdown) => false,
+            (Some(kinds), event) => kinds.contains(&kind(event)),
+            (None, Event::Unsupported(_)) => true,
+            (None, _) => false,
+        };
+        if low {
+            Priority::Low
+        } else {
+            Priority::High
+        }
+    }
+
+    /// Send events received from `from` to `to`, until either is closed.
+    pub fn forward(&self, from: Receiver<Event>, to: Sender<Event>) {
+        for event in from.iter() {
+            if self.priority(&event) == Priority::Low
+                && self.queued.load(Ordering::SeqCst) >= self.threshold
+            {
+                self.collector.shed();
+                continue;
+            }
+            self.queued.fetch_add(1, Ordering::SeqCst);
+            if to.send(event).is_err() {
+                return;
+            }
+        }
+    }
+
+    /// Tell an event was taken from the queue. Events sent to the instance without
+    /// the shedder are not counted, so the count does not go below 0.
+    pub fn taken(&self) {
+        let _ = self
+            .queued
+            .fetch_update(Ordering::SeqCst, Ordering::SeqCst, |q| q.checked_sub(1));
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::models::Post;
+    use std::sync::mpsc::channel;
+
+    fn typing() -> Event {
+        Event::Unsupported(r#"{"event": "typing", "data": {}}"#.to_string())
+    }
+
+    #[test]
+    fn shed_kinds() {
+        assert_eq!("typing", kind(&typing()));
+        assert_eq!("unsupported", kind(&Event::Unsupported("nope".to_string())));
+        assert_eq!("posted", kind(&Event::Post(Post::with_message("hey"))));
+
+        let shedder = Shedder::new(1, Collector::new());
+        assert_eq!(Priority::Low, shedder.priority(&typing()));
+        assert_eq!(Priority::High, shedder.priority(&Event::Shutdown));
+
+        let shedder = shedder.with_low(vec!["posted".to_string()]);
+        assert_eq!(Priority::High, shedder.priority(&typing()));
+        let post = Event::Post(Post::with_message("hey"));
+        assert_eq!(Priority::Low, shedder.priority(&post));
+    }
+
+    #[test]
+    fn shed_saturated() {
+        let collector = Collector::new();
+        let shedder = Shedder::new(2, collector.clone());
+        let (events, received) = channel();
+        let (sender, queue) = channel();
+        for event in vec![typing(), Event::Post(Post::with_message("one"))] {
+            events.send(event).unwrap();
+        }
+        for i in 0..5 {
+            events.send(typing()).unwrap();
+            events
+                .send(Event::Post(Post::with_message(&i.to_string())))
+                .unwrap();
+        }
+        drop(events);
+        shedder.forward(received, sender.clone());
+
+        let kinds: Vec<String> = queue.try_iter().map(|e| kind(&e)).collect();
+        assert_eq!(7, kinds.len());
+        assert_eq!("typing", kinds[0]);
+        assert!(kinds[1..].iter().all(|kind| kind == "posted"));
+        assert_eq!(5, collector.snapshot().shed_events);
+
+        // once taken, low priority events are queued again.
+        for _ in 0..kinds.len() {
+            shedder.taken();
+        }
+        shedder.taken();
+        let (events, received) = channel();
+        events.send(typing()).unwrap();
+        drop(events);
+        shedder.forward(received, sender);
+        assert_eq!(
+            Some("typing".to_string()),
+            queue.try_iter().map(|e| kind(&e)).next()
+        );
+    }
+}
@@ -0,0 +1,247 @@
+use crate::client::{Creator, Getter, Result, Sender};
+use crate::models::Post;
+
+/// Default maximum length of a Mattermost post, in characters. Prefer the limit of the
+/// server, see post_limited().
+pub const MAX_MESSAGE_LEN: usize = 16383;
+
+const FENCE: &str = "```";
+
+fn len(s: &str) -> usize {
+    s.chars().count()
+}
+
+struct Splitter {
+    limit: usize,
+    chunks: Vec<String>,
+    chunk: String,
+    /// length of the chunk when nothing but a reopened code block was written.
+    fresh: usize,
+    /// opening line of the code block being written, if any.
+    fence: Option<String>,
+}
+
+impl Splitter {
+    /// room left in the current chunk, keeping enough space to close the code block.
+    fn room(&self) -> usize {
+        let reserved = match self.fence {
+            Some(_) => FENCE.len() + 1,
+            None => 0,
+        };
+        self.limit.saturating_sub(len(&self.chunk) + reserved)
+    }
+
+    fn flush(&mut self, reopen: bool) {
+        if let Some(fence) = &self.fence {
+            let written = self.chunk.trim_end();
+            if written.ends_with(fence.as_str()) {
+                // nothing in the code block yet: open it in the next chunk only.
+                let cut = written.len() - fence.len();
+                self.chunk.truncate(cut);
+            } else {
+                if !self.chunk.ends_with('\n') {
+                    self.chunk.push('\n');
+                }
+                self.chunk.push_str(FENCE);
+            }
+        }
+
+        let chunk = std::mem::take(&mut self.chunk);
+        if !chunk.trim().is_empty() {
+            self.chunks.push(chunk.trim_end().to_string());
+        }
+
+        self.fresh = 0;
+        if let (true, Some(fence)) = (reopen, &self.fence) {
+            self.chunk = format!("{}\n", fence);
+            self.fresh = len(&self.chunk);
+        }
+    }
+
+    fn push(&mut self, text: &str) {
+        if len(text) > self.room() && len(&self.chunk) > self.fresh {
+            self.flush(true);
+        }
+
+        if len(text) <= self.room() {
+            self.chunk.push_str(text);
+            return;
+        }
+
+        // too long for a single chunk: cut at word boundaries, then anywhere.
+        for word in text.split_inclusive(char::is_whitespace) {
+            if len(word) > self.room() && len(&self.chunk) > self.fresh {
+                self.flush(true);
+            }
+
+            let mut chars = word.chars().peekable();
+            while chars.peek().is_some() {
+                let piece: String = chars.by_ref().take(self.room().max(1)).collect();
+                self.chunk.push_str(&piece);
+                if chars.peek().is_some() {
+                    self.flush(true);
+                }
+            }
+        }
+    }
+
+    fn push_fence(&mut self, line: &str) {
+        match self.fence {
+            None => {
+                if len(line) + FENCE.len() + 1 > self.room() {
+                    self.flush(false);
+                }
+                self.chunk.push_str(line);
+                self.fence = Some(line.trim().to_string());
+            }
+            Some(_) => {
+                if len(line) > self.limit.saturating_sub(len(&self.chunk)) {
+                    // the chunk gets closed anyway.
+                    self.flush(false);
+                } else {
+                    self.chunk.push_str(line);
+                }
+                self.fence = None;
+            }
+        }
+    }
+}
+
+/// Split message into chunks of at most limit characters. Cuts are made between lines
+/// when possible, then between words. A code block cut in two is closed at the end of
+/// a chunk and opened again, with the same language, in the next one.
+pub fn split(message: &str, limit: usize) -> Vec<String> {
+    let mut splitter = Splitter {
+        limit,
+        chunks: vec![],
+        chunk: String::new(),
+        fresh: 0,
+        fence: None,
+    };
+
+    for line in message.split_inclusive('\n') {
+        if line.trim_start().starts_with(FENCE) {
+            splitter.push_fence(line);
+        } else {
+            splitter.push(line);
+        }
+    }
+    splitter.flush(false);
+
+    splitter.chunks
+}
+
+/// Send post.message on post.channel_id in as many posts as needed.
+/// When threaded, the chunks following the first one are sent as replies to it.
+pub fn post<C: Sender + Creator>(
+    client: &C,
+    post: &Post,
+    limit: usize,
+    threaded: bool,
+) -> Result<()> {
+    let mut chunks = split(&post.message, limit).into_iter();
+    if threaded {
+        if let Some(first) = chunks.next() {
+            let first = client.create_post(&post.nmessage(&first))?;
+            for chunk in chunks {
+                client.reply(&first, &chunk)?;
+            }
+        }
+        return Ok(());
+    }
+    for chunk in chunks {
+        client.post(&post.nmessage(&chunk))?;
+    }
+    Ok(())
+}
+
+/// Same as post(), with the post length limit of the server.
+pub fn post_limited<C: Sender + Creator + Getter>(
+    client: &C,
+    post: &Post,
+    threaded: bool,
+) -> Result<()> {
+    self::post(client, post, client.limits().max_post_len, threaded)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::models::ServerLimits;
+    use crate::testing::Recorder;
+
+    #[test]
+    fn split_short() {
+        assert_eq!(vec!["hello"], split("hello", 10));
+        assert!(split("", 10).is_empty());
+    }
+
+    #[test]
+    fn split_long() {
+        let message = "one two three\nfour five six seven\neight";
+        let chunks = split(message, 10);
+        for chunk in chunks.iter() {
+            assert!(len(chunk) <= 10, "chunk too long: {:?}", chunk);
+        }
+        let words: Vec<&str> =
+            chunks.iter().flat_map(|c| c.split_whitespace()).collect();
+        let expect: Vec<&str> = message.split_whitespace().collect();
+        assert_eq!(expect, words);
+        assert_eq!("one two", chunks[0]);
+    }
+
+    #[test]
+    fn split_long_word() {
+        let chunks = split("abcdefghijklmnopqrstuvwxyz", 10);
+        assert_eq!(vec!["abcdefghij", "klmnopqrst", "uvwxyz"], chunks);
+    }
+
+    #[test]
+    fn split_code_fences() {
+        let message = "logs:\n```text\nline 1\nline 2\nline 3\nline 4\n```\nthe end";
+        let chunks = split(message, 24);
+        assert!(chunks.len() > 2);
+        for chunk in chunks.iter() {
+            assert!(len(chunk) <= 24, "chunk too long: {:?}", chunk);
+            assert_eq!(
+                0,
+                chunk.matches(FENCE).count() % 2,
+                "broken fence: {:?}",
+                chunk
+            );
+        }
+        assert_eq!("logs:", chunks[0]);
+        assert!(chunks[1].starts_with("```text\nline 1"));
+        assert!(chunks[2].starts_with("```text\n"));
+        assert!(chunks.last().unwrap().ends_with("the end"));
+    }
+
+    #[test]
+    fn post_server_limit() {
+        let mut client = Recorder::new();
+        client.limits = ServerLimits {
+            max_post_len: 12,
+            ..Default::default()
+        };
+
+        let post = Post::with_message("one two three four five");
+        post_limited(&client, &post, false).unwrap();
+        let posts = client.posts.lock().unwrap();
+        assert_eq!(3, posts.len());
+        assert!(posts.iter().all(|p| len(&p.message) <= 12));
+    }
+
+    #[test]
+    fn post_threaded() {
+        let client = Recorder::new();
+        let post = Post::with_message("one two three four five");
+        self::post(&client, &post, 9, true).unwrap();
+
+        let posts = client.posts.lock().unwrap();
+        assert_eq!(1, posts.len());
+        assert_eq!("one two", posts[0].message);
+        let replies = client.replies.lock().unwrap();
+        assert_eq!(2, replies.len());
+        assert!(replies.iter().all(|(root_id, _)| root_id == "post-1"));
+    }
+}
@@ -0,0 +1,116 @@
+use chrono::{DateTime, Local};
+use std::sync::{Arc, Mutex};
+
+#[derive(Clone, Debug, PartialEq)]
+pub enum Connection {
+    Connected,
+    Disconnected,
+}
+
+/// Snapshot of what the bot went through since it started.
+#[derive(Clone, Debug)]
+pub struct Stats {
+    /// events received by the instance.
+    pub events: u64,
+    /// successful connections, the first one excluded.
+    pub reconnects: u64,
+    pub last_reconnect: Option<DateTime<Local>>,
+    pub last_error: Option<String>,
+    /// handler calls that took longer than the configured threshold.
+    pub slow_handlers: u64,
+    /// low priority events dropped by a shed::Shedder.
+    pub shed_events: u64,
+    pub connection: Connection,
+    connected_once: bool,
+}
+
+impl Default for Stats {
+    fn default() -> Self {
+        Self {
+            events: 0,
+            reconnects: 0,
+            last_reconnect: None,
+            last_error: None,
+            slow_handlers: 0,
+            shed_events: 0,
+            connection: Connection::Disconnected,
+            connected_once: false,
+        }
+    }
+}
+
+/// Collector is shared between the instance and the backend connection to fill stats.
+/// Clone it to share it, then use snapshot() to read stats.
+#[derive(Clone, Default)]
+pub struct Collector {
+    stats: Arc<Mutex<Stats>>,
+}
+
+impl Collector {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn event(&self) {
+        self.stats.lock().unwrap().events += 1;
+    }
+
+    pub fn connected(&self) {
+        let mut stats = self.stats.lock().unwrap();
+        if stats.connected_once {
+            stats.reconnects += 1;
+            stats.last_reconnect = Some(Local::now());
+        }
+        stats.connected_once = true;
+        stats.connection = Connection::Connected;
+    }
+
+    pub fn disconnected(&self) {
+        self.stats.lock().unwrap().connection = Connection::Disconnected;
+    }
+
+    pub fn error(&self, error: &str) {
+        self.stats.lock().unwrap().last_error = Some(error.to_string());
+    }
+
+    pub fn slow_handler(&self) {
+        self.stats.lock().unwrap().slow_handlers += 1;
+    }
+
+    pub fn shed(&self) {
+        self.stats.lock().unwrap().shed_events += 1;
+    }
+
+    pub fn snapshot(&self) -> Stats {
+        self.stats.lock().unwrap().clone()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn collect_connections() {
+        let collector = Collector::new();
+        assert_eq!(Connection::Disconnected, collector.snapshot().connection);
+
+        collector.connected();
+        let stats = collector.snapshot();
+        assert_eq!(Connection::Connected, stats.connection);
+        assert_eq!(0, stats.reconnects);
+        assert!(stats.last_reconnect.is_none());
+
+        collector.disconnected();
+        collector.error("reset by peer");
+        let stats = collector.snapshot();
+        assert_eq!(Connection::Disconnected, stats.connection);
+        assert_eq!(Some("reset by peer".to_string()), stats.last_error);
+
+        collector.clone().connected();
+        let stats = collector.snapshot();
+        assert_eq!(Connection::Connected, stats.connection);
+        assert_eq!(1, stats.reconnects);
+        assert!(stats.last_reconnect.is_some());
+    }
+}
@@ -0,0 +1,290 @@
+//! Fake client recording everything the bot sends, and fake listener, for tests.
+
+use crate::client::{
+    Creator, Editor, Error, Getter, Idempotent, Listener, Notifier, Result, Scheduler,
+    SeenPosts, Sender,
+};
+use crate::models::{
+    ChannelInfo, ChannelUnread, Event, Post, PostDetails, Reaction, ServerLimits, Team,
+    User,
+};
+use chrono::{DateTime, Utc};
+use std::sync::mpsc;
+use std::sync::{Arc, Mutex};
+
+#[derive(Clone, Default)]
+pub struct Recorder {
+    pub posts: Arc<Mutex<Vec<Post>>>,
+    pub replies: Arc<Mutex<Vec<(String, String)>>>,
+    pub reactions: Arc<Mutex<Vec<(String, String)>>>,
+    pub ephemerals: Arc<Mutex<Vec<(String, String)>>>,
+    pub debugs: Arc<Mutex<Vec<String>>>,
+    pub users: Arc<Mutex<Vec<User>>>,
+    pub edits: Arc<Mutex<Vec<(String, String)>>>,
+    pub deletes: Arc<Mutex<Vec<String>>>,
+    pub channels: Arc<Mutex<Vec<ChannelInfo>>>,
+    pub limits: ServerLimits,
+    pub sent: SeenPosts,
+}
+
+impl Recorder {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// messages replied, whatever post they answer to.
+    pub fn replied(&self) -> Vec<String> {
+        self.replies
+            .lock()
+            .unwrap()
+            .iter()
+            .map(|(_, message)| message.clone())
+            .collect()
+    }
+}
+
+/// Client of a backend that is down: sending fails.
+pub struct Down;
+
+impl Sender for Down {
+    fn post(&self, _post: &Post) -> Result<()> {
+        Err(Error::Status(503))
+    }
+
+    fn reaction(&self, _post: &Post, _reaction: &str) -> Result<()> {
+        Err(Error::Status(503))
+    }
+
+    fn remove_reaction(&self, _post: &Post, _reaction: &str) -> Result<()> {
+        Err(Error::Status(503))
+    }
+
+    fn reply(&self, _post: &Post, _message: &str) -> Result<()> {
+        Err(Error::Status(503))
+    }
+
+    fn ephemeral(&self, _post: &Post, _message: &str) -> Result<()> {
+        Err(Error::Status(503))
+    }
+}
+
+impl Editor for Down {
+    fn edit(&self, _post: &Post, _message: &str) -> Result<()> {
+        Err(Error::Status(503))
+    }
+
+    fn delete(&self, _post: &Post) -> Result<()> {
+        Err(Error::Status(503))
+    }
+}
+
+impl Sender for Recorder {
+    fn post(&self, post: &Post) -> Result<()> {
+        self.posts.lock().unwrap().push(post.clone());
+        Ok(())
+    }
+
+    fn reaction(&self, post: &Post, reaction: &str) -> Result<()> {
+        self.reactions
+            .lock()
+            .unwrap()
+            .push((post.id.clone(), reaction.to_string()));
+        Ok(())
+    }
+
+    fn remove_reaction(&self, post: &Post, reaction: &str) -> Result<()> {
+        self.reactions
+            .lock()
+            .unwrap()
+            .retain(|(id, r)| id != &post.id || r != reaction);
+        Ok(())
+    }
+
+    fn reply(&self, post: &Post, message: &str) -> Result<()> {
+        self.replies
+            .lock()
+            .unwrap()
+            .push((post.id.clone(), message.to_string()));
+        Ok(())
+    }
+
+    fn ephemeral(&self, post: &Post, message: &str) -> Result<()> {
+        self.ephemerals
+            .lock()
+            .unwrap()
+            .push((post.user_id.clone(), message.to_string()));
+        Ok(())
+    }
+}
+
+/// Created posts get the id `post-<n>`, n counting every recorded post.
+impl Creator for Recorder {
+    fn create_post(&self, post: &Post) -> Result<Post> {
+        let mut posts = self.posts.lock().unwrap();
+        let mut created = post.clone();
+        created.id = format!("post-{}", posts.len() + 1);
+        posts.push(created.clone());
+        Ok(created)
+    }
+}
+
+impl Idempotent for Recorder {
+    fn post_once(&self, post: &Post, key: &str) -> Result<Post> {
+        self.sent.send_once(key, || {
+            self.post(post)?;
+            Ok(post.clone())
+        })
+    }
+}
+
+impl Editor for Recorder {
+    fn edit(&self, post: &Post, message: &str) -> Result<()> {
+        self.edits
+            .lock()
+            .unwrap()
+            .push((post.id.clone(), message.to_string()));
+        Ok(())
+    }
+
+    fn delete(&self, post: &Post) -> Result<()> {
+        self.deletes.lock().unwrap().push(post.id.clone());
+        Ok(())
+    }
+}
+
+/// Recorder has no scheduled posts.
+impl Scheduler for Recorder {
+    fn schedule(&self, _post: &Post, _at: DateTime<Utc>) -> Result<Option<String>> {
+        Ok(None)
+    }
+}
+
+impl Notifier for Recorder {
+    fn startup(&self, message: &str) -> Result<()> {
+        self.debug(message)
+    }
+
+    fn debug(&self, message: &str) -> Result<()> {
+        self.debugs.lock().unwrap().push(message.to_string());
+        Ok(())
+    }
+
+    fn error(&self, message: &str) -> Result<()> {
+        self.debug(message)
+    }
+
+    fn required_action(&self, message: &str) -> Result<()> {
+        self.debug(message)
+    }
+}
+
+impl Getter for Recorder {
+    fn my_user_id(&self) -> &str {
+        "bot"
+    }
+
+    fn users_by_ids(&self, ids: Vec<&str>) -> Result<Vec<User>> {
+        let users = self.users.lock().unwrap();
+        Ok(users
+            .iter()
+            .filter(|u| ids.contains(&u.id.as_str()))
+            .cloned()
+            .collect())
+    }
+
+    fn team(&self) -> Result<Team> {
+        Err(Error::Other("no team".to_string()))
+    }
+
+    fn unread(&self, _channel_id: &str) -> Result<ChannelUnread> {
+        Err(Error::Other("no unread".to_string()))
+    }
+
+    fn unread_mentions(&self) -> Result<Vec<ChannelUnread>> {
+        Ok(vec![])
+    }
+
+    fn permalink(&self, post_id: &str) -> Result<String> {
+        Ok(format!("http://localhost/team/pl/{}", post_id))
+    }
+
+    fn channel(&self, channel_id: &str) -> Result<ChannelInfo> {
+        let channels = self.channels.lock().unwrap();
+        match channels.iter().find(|c| c.id == channel_id) {
+            Some(channel) => Ok(channel.clone()),
+            None => Err(Error::Status(404)),
+        }
+    }
+
+    fn custom_emoji_exists(&self, _name: &str) -> Result<bool> {
+        Ok(false)
+    }
+
+    fn limits(&self) -> ServerLimits {
+        self.limits.clone()
+    }
+
+    /// posts sent so far in the thread.
+    fn thread(&self, root_id: &str) -> Result<Vec<Post>> {
+        let posts = self.posts.lock().unwrap();
+        Ok(posts
+            .iter()
+            .filter(|p| p.id == root_id || p.root_id == root_id)
+            .cloned()
+            .collect())
+    }
+
+    /// post sent with post_id and the reactions added to it. There are never embeds
+    /// nor files.
+    fn post_with_metadata(&self, post_id: &str) -> Result<PostDetails> {
+        let post = self
+            .posts
+            .lock()
+            .unwrap()
+            .iter()
+            .find(|p| p.id == post_id)
+            .cloned();
+        let post = post.ok_or(Error::Status(404))?;
+        let reactions = self
+            .reactions
+            .lock()
+            .unwrap()
+            .iter()
+            .filter(|(id, _)| id == post_id)
+            .map(|(_, emoji_name)| Reaction {
+                user_id: self.my_user_id().to_string(),
+                emoji_name: emoji_name.clone(),
+            })
+            .collect();
+        Ok(PostDetails {
+            post,
+            embeds: vec![],
+            reactions,
+            files: vec![],
+        })
+    }
+}
+
+/// Listener emitting scripted events once, then returning.
+pub struct Scripted {
+    events: Mutex<Vec<Event>>,
+}
+
+impl Scripted {
+    pub fn new(events: Vec<Event>) -> Self {
+        Self {
+            events: Mutex::new(events),
+        }
+    }
+}
+
+impl Listener for Scripted {
+    fn listen(&self, sender: mpsc::Sender<Event>) -> Result<()> {
+        for event in self.events.lock().unwrap().drain(..) {
+            sender
+                .send(event)
+                .map_err(|e| Error::Other(e.to_string()))?;
+        }
+        Ok(())
+    }
+}
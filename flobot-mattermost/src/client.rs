@@ -1,7 +1,21 @@
 use super::models::*;
-use flobot_lib::client::{Channel, Editor, Getter, Notifier, Result, Sender};
+use chrono::{DateTime, Utc};
+use flobot_lib::client::{
+    Channel as ClientChannel, Creator, Critical, Editor, Error, Getter, Idempotent,
+    Interactive, Notifier, Result, Scheduler, SeenPosts, Sender, SentStore,
+};
 use flobot_lib::conf::Conf;
+use flobot_lib::dialog::Dialog as DialogDef;
+use flobot_lib::emoji;
+use flobot_lib::lifecycle::Lifecycle;
+use flobot_lib::limit::Limiter;
+use flobot_lib::log::{Level, Logger};
 use flobot_lib::models as gm;
+use flobot_lib::stats::Collector;
+use std::collections::HashMap;
+use std::io::Read;
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
 use uuid::Uuid;
 
 #[derive(Clone)]
@@ -9,22 +23,367 @@ pub struct Mattermost {
     pub cfg: Conf,
     me: Me,
     client: reqwest::blocking::Client,
+    team: Arc<Mutex<Option<gm::Team>>>,
+    /// users already fetched, by id.
+    users: Arc<Mutex<HashMap<String, gm::User>>>,
+    /// shared by clones so a bursting handler cannot overwhelm the api.
+    limiter: Limiter,
+    limits: gm::ServerLimits,
+    /// custom emoji names already looked up, and whether they exist.
+    emojis: Arc<Mutex<HashMap<String, bool>>>,
+    /// posts sent with Idempotent::post_once, by key.
+    sent: SeenPosts,
+    pub(crate) collector: Collector,
+    pub(crate) lifecycle: Lifecycle,
+    logger: Logger,
+}
+
+trait SendLimited {
+    fn send_with(
+        self,
+        limiter: &Limiter,
+    ) -> reqwest::Result<reqwest::blocking::Response>;
+}
+
+impl SendLimited for reqwest::blocking::RequestBuilder {
+    /// Send the request once limiter gave a permit.
+    fn send_with(
+        self,
+        limiter: &Limiter,
+    ) -> reqwest::Result<reqwest::blocking::Response> {
+        let _permit = limiter.acquire();
+        self.send()
+    }
+}
+
+/// Maximum number of user ids sent in a single lookup.
+const USERS_BATCH: usize = 100;
+
+/// Id of the post accepted by the scheduled post API according to the response
+/// status and body. None means the server has no scheduled posts: it is too old or
+/// they are disabled.
+fn scheduled_post(status: u16, body: &str) -> Result<Option<String>> {
+    match status {
+        200..=299 => {
+            let created: GenericID =
+                serde_json::from_str(body).map_err(|e| Error::Body(e.to_string()))?;
+            Ok(Some(created.id))
+        }
+        404 | 501 => Ok(None),
+        status => Err(Error::Status(status as u64)),
+    }
+}
+
+/// Send with api, then with webhook if api failed and a webhook is configured.
+/// The api error is only logged when the webhook is used.
+fn with_fallback<A, W>(logger: &Logger, api: A, webhook: Option<W>) -> Result<()>
+where
+    A: FnOnce() -> Result<()>,
+    W: FnOnce() -> Result<()>,
+{
+    match (api(), webhook) {
+        (Err(e), Some(webhook)) => {
+            let message =
+                format!("cannot post with the api, falling back to webhook: {:?}", e);
+            logger.log(Level::Warn, &message);
+            webhook()
+        }
+        (res, _) => res,
+    }
+}
+
+/// Limits found in the client config of the server, defaults for the missing ones.
+fn server_limits(config: &HashMap<String, String>) -> gm::ServerLimits {
+    let defaults = gm::ServerLimits::default();
+    gm::ServerLimits {
+        max_post_len: config
+            .get("MaxPostSize")
+            .and_then(|v| v.parse().ok())
+            .unwrap_or(defaults.max_post_len),
+        max_file_size: config
+            .get("MaxFileSize")
+            .and_then(|v| v.parse().ok())
+            .unwrap_or(defaults.max_file_size),
+    }
+}
+
+/// Tells if a custom emoji exists according to the status of its lookup.
+fn custom_emoji(status: u16) -> Result<bool> {
+    match status {
+        200..=299 => Ok(true),
+        404 => Ok(false),
+        status => Err(Error::Status(status as u64)),
+    }
+}
+
+/// Error of a reaction refused with status. The emoji is unknown only when it is not
+/// a common standard one and its custom emoji lookup found nothing, otherwise the
+/// lookup does not tell why the reaction was refused.
+fn refused_reaction(status: u16, emoji: &str, known: Result<bool>) -> Error {
+    match known {
+        Ok(false) => Error::Other(format!("unknown emoji {}", emoji)),
+        _ => Error::Status(status as u64),
+    }
+}
+
+/// API error id of a channel creation when the name is already taken.
+const CHANNEL_EXISTS: &str = "store.sql_channel.save_channel.exists.app_error";
+
+/// Channel created according to the response status and body, None when the name was
+/// already taken.
+fn created_channel(status: u16, body: &str) -> Result<Option<Channel>> {
+    if (200..300).contains(&status) {
+        let channel =
+            serde_json::from_str(body).map_err(|e| Error::Body(e.to_string()))?;
+        return Ok(Some(channel));
+    }
+
+    let error: ApiError =
+        serde_json::from_str(body).map_err(|_| Error::Status(status as u64))?;
+    if error.id == CHANNEL_EXISTS {
+        return Ok(None);
+    }
+    Err(Error::Other(format!(
+        "cannot create channel: {}",
+        error.message
+    )))
+}
+
+/// Pick the team named `name` among the teams the bot is member of. Without name,
+/// the bot must be member of a single team.
+fn find_team(teams: Vec<Team>, name: Option<&str>) -> Result<gm::Team> {
+    match name {
+        Some(name) => match teams.into_iter().find(|t| t.name == name) {
+            Some(team) => Ok(team.into()),
+            None => Err(Error::Other(format!(
+                "bot user is not a member of team {}",
+                name
+            ))),
+        },
+        None => {
+            if teams.len() != 1 {
+                return Err(Error::Other(format!(
+                    "bot user is member of {} teams, configure BOT_TEAM_NAME",
+                    teams.len()
+                )));
+            }
+            Ok(teams.into_iter().next().unwrap().into())
+        }
+    }
+}
+
+/// Channels of members with unread mentions.
+fn mentioned(members: Vec<ChannelMember>) -> Vec<String> {
+    members
+        .into_iter()
+        .filter(|m| m.mention_count > 0)
+        .map(|m| m.channel_id)
+        .collect()
+}
+
+/// Build the permalink of post_id in team, api_url being the configured API URL.
+fn permalink(api_url: &str, team: &str, post_id: &str) -> String {
+    let server = api_url.trim_end_matches('/').trim_end_matches("/api/v4");
+    format!("{}/{}/pl/{}", server, team, post_id)
+}
+
+/// Details of post from its metadata or, when the server did not send metadata, from
+/// reactions and files. Embeds are only found in metadata.
+fn post_details<R, F>(mut post: Post, reactions: R, files: F) -> Result<gm::PostDetails>
+where
+    R: FnOnce() -> Result<Vec<Reaction>>,
+    F: FnOnce() -> Result<Vec<FileInfo>>,
+{
+    let metadata = match post.metadata.take() {
+        Some(metadata) => metadata,
+        None => PostMetadata {
+            embeds: vec![],
+            reactions: reactions()?,
+            files: files()?,
+        },
+    };
+    Ok(gm::PostDetails {
+        post: post.into(),
+        embeds: metadata.embeds.into_iter().map(|e| e.into()).collect(),
+        reactions: metadata.reactions.into_iter().map(|r| r.into()).collect(),
+        files: metadata.files.into_iter().map(|f| f.into()).collect(),
+    })
+}
+
+/// Posts of a thread in chronological order, deleted ones excluded. page fetches the
+/// posts created after a (create_at, post id) cursor, from the root when there is none.
+fn collect_thread<F>(mut page: F) -> Result<Vec<Post>>
+where
+    F: FnMut(Option<(u64, &str)>) -> Result<PostList>,
+{
+    let mut posts: HashMap<String, Post> = HashMap::new();
+    let mut cursor: Option<(u64, String)> = None;
+    loop {
+        let list = page(cursor.as_ref().map(|(at, id)| (*at, id.as_str())))?;
+        let last = list
+            .posts
+            .values()
+            .map(|p| (p.create_at, p.id.clone()))
+            .max();
+        // stop as well if the page brought nothing new, not to loop forever.
+        let more = list.has_next && last.is_some() && last > cursor;
+        posts.extend(list.posts);
+        if !more {
+            break;
+        }
+        cursor = last;
+    }
+
+    let mut posts: Vec<Post> = posts
+        .into_iter()
+        .map(|(_, p)| p)
+        .filter(|p| p.delete_at == 0)
+        .collect();
+    posts.sort_by(|a, b| (a.create_at, &a.id).cmp(&(b.create_at, &b.id)));
+    Ok(posts)
+}
+
+/// Users of ids, from cache or fetched batch ids at a time. Fetched users are cached.
+/// Ids that are unknown to the backend are left out.
+fn cached_users<F>(
+    cache: &mut HashMap<String, gm::User>,
+    ids: Vec<&str>,
+    batch: usize,
+    mut fetch: F,
+) -> Result<Vec<gm::User>>
+where
+    F: FnMut(&[&str]) -> Result<Vec<User>>,
+{
+    let mut missing: Vec<&str> = ids
+        .iter()
+        .filter(|id| !cache.contains_key(**id))
+        .copied()
+        .collect();
+    missing.sort_unstable();
+    missing.dedup();
+
+    for chunk in missing.chunks(batch) {
+        for user in fetch(chunk)? {
+            cache.insert(user.id.clone(), user.into());
+        }
+    }
+
+    Ok(ids
+        .iter()
+        .filter_map(|id| cache.get(*id))
+        .cloned()
+        .collect())
 }
 
 impl Mattermost {
     pub fn new(cfg: Conf) -> Result<Self> {
         let client = reqwest::blocking::Client::new();
+        let limiter = Limiter::new(cfg.api_concurrency);
         let me: Me = client
             .get(&format!("{}/users/me", &cfg.api_url))
             .bearer_auth(&cfg.token)
-            .send()?
+            .send_with(&limiter)?
             .json()?;
         println!("my user id: {}", me.id);
-        Ok(Mattermost {
+
+        let config: Result<HashMap<String, String>> = client
+            .get(&format!("{}/config/client", &cfg.api_url))
+            .bearer_auth(&cfg.token)
+            .query(&[("format", "old")])
+            .send_with(&limiter)
+            .and_then(|r| r.error_for_status())
+            .and_then(|r| r.json())
+            .map_err(Error::from);
+        let limits = match config {
+            Ok(config) => server_limits(&config),
+            Err(e) => {
+                println!("cannot fetch server limits, using defaults: {:?}", e);
+                gm::ServerLimits::default()
+            }
+        };
+        println!("server limits: {:?}", limits);
+
+        Ok(Self::from_parts(cfg, client, me, limiter, limits))
+    }
+
+    fn from_parts(
+        cfg: Conf,
+        client: reqwest::blocking::Client,
+        me: Me,
+        limiter: Limiter,
+        limits: gm::ServerLimits,
+    ) -> Self {
+        let sent = SeenPosts::new(Duration::from_secs(cfg.post_dedup_secs));
+        Mattermost {
             cfg: cfg,
             me,
             client,
-        })
+            team: Arc::default(),
+            users: Arc::default(),
+            limiter,
+            limits,
+            emojis: Arc::default(),
+            sent,
+            collector: Collector::new(),
+            lifecycle: Lifecycle::new(),
+            logger: Logger::default(),
+        }
+    }
+
+    /// Run at most max calls to the api at the same time, instead of
+    /// cfg.api_concurrency. Clones made before keep the previous limit.
+    pub fn with_concurrency(mut self, max: usize) -> Self {
+        self.cfg.api_concurrency = max;
+        self.limiter = Limiter::new(max);
+        self
+    }
+
+    /// Listen to the websocket at url instead of cfg.ws_url, connecting again when
+    /// it drops if reconnect is true.
+    pub fn with_websocket(mut self, url: &str, reconnect: bool) -> Self {
+        self.cfg.ws_url = url.to_string();
+        self.cfg.ws_reconnect = reconnect;
+        self
+    }
+
+    /// Send posts with the same idempotency key once within window, instead of
+    /// cfg.post_dedup_secs. Keys already seen are forgotten.
+    pub fn with_dedup_window(mut self, window: Duration) -> Self {
+        self.cfg.post_dedup_secs = window.as_secs();
+        self.sent = SeenPosts::new(window);
+        self
+    }
+
+    /// Remember posts sent with Idempotent::post_once in store rather than in memory,
+    /// so that bots sharing it send them once. Clones made before keep the previous
+    /// store.
+    pub fn with_sent_store<S: SentStore + 'static>(mut self, store: S) -> Self {
+        self.sent = self.sent.with_store(store);
+        self
+    }
+
+    /// Send refused critical posts to webhook instead of cfg.fallback_webhook, None
+    /// disables the fallback.
+    pub fn with_fallback_webhook(mut self, webhook: Option<String>) -> Self {
+        self.cfg.fallback_webhook = webhook;
+        self
+    }
+
+    /// Run lifecycle callbacks when the websocket connects and disconnects.
+    pub fn with_logger(mut self, logger: Logger) -> Self {
+        self.logger = logger;
+        self
+    }
+
+    pub fn with_lifecycle(mut self, lifecycle: Lifecycle) -> Self {
+        self.lifecycle = lifecycle;
+        self
+    }
+
+    /// Report connections and errors of the websocket to collector.
+    pub fn with_collector(mut self, collector: Collector) -> Self {
+        self.collector = collector;
+        self
     }
 
     fn url(&self, add: &str) -> String {
@@ -32,9 +391,61 @@ impl Mattermost {
         url.push_str(add);
         url
     }
+
+    /// Set the name shown for the bot account, that must be a bot, not a user.
+    pub fn set_display_name(&self, name: &str) -> Result<()> {
+        let patch = BotPatch {
+            display_name: Some(name),
+        };
+        self.client
+            .put(&self.url(&format!("/bots/{}", self.me.id)))
+            .bearer_auth(&self.cfg.token)
+            .json(&patch)
+            .send_with(&self.limiter)?
+            .error_for_status()?;
+        Ok(())
+    }
+
+    /// Set the profile image of the bot account from PNG or JPEG data.
+    pub fn set_icon<R: Read>(&self, mut data: R) -> Result<()> {
+        let mut image = vec![];
+        data.read_to_end(&mut image)
+            .map_err(|e| Error::Other(format!("cannot read icon: {}", e)))?;
+
+        let mut enc_buf = Uuid::encode_buffer();
+        let boundary = Uuid::new_v4()
+            .to_simple()
+            .encode_lower(&mut enc_buf)
+            .to_string();
+        self.client
+            .post(&self.url(&format!("/users/{}/image", self.me.id)))
+            .bearer_auth(&self.cfg.token)
+            .header(
+                "Content-Type",
+                format!("multipart/form-data; boundary={}", boundary),
+            )
+            .body(image_form(&boundary, &image))
+            .send_with(&self.limiter)?
+            .error_for_status()?;
+        Ok(())
+    }
+}
+
+/// Multipart body holding image as the `image` field, the way the profile image
+/// endpoint expects it.
+fn image_form(boundary: &str, image: &[u8]) -> Vec<u8> {
+    let mut body = format!(
+        "--{}\r\nContent-Disposition: form-data; name=\"image\"; filename=\"icon\"\r\n\
+         Content-Type: application/octet-stream\r\n\r\n",
+        boundary
+    )
+    .into_bytes();
+    body.extend_from_slice(image);
+    body.extend_from_slice(format!("\r\n--{}--\r\n", boundary).as_bytes());
+    body
 }
 
-impl Channel for Mattermost {
+impl ClientChannel for Mattermost {
     fn create_private(
         &self,
         team_id: &str,
@@ -56,7 +467,7 @@ impl Channel for Mattermost {
             .post(&self.url("/channels"))
             .bearer_auth(&self.cfg.token)
             .json(&mmchannel)
-            .send()?
+            .send_with(&self.limiter)?
             .json()?;
 
         for user_id in users.iter() {
@@ -67,20 +478,110 @@ impl Channel for Mattermost {
                 .post(&self.url(&format!("/channels/{}/members", r.id)))
                 .bearer_auth(&self.cfg.token)
                 .json(&uid)
-                .send()?;
+                .send_with(&self.limiter)?;
         }
 
         Ok(r.id)
     }
 
+    fn create(
+        &self,
+        team_id: &str,
+        name: &str,
+        display_name: &str,
+        public: bool,
+    ) -> Result<gm::ChannelInfo> {
+        let mmchannel = CreateChannel {
+            team_id,
+            name,
+            display_name,
+            type_: if public { "O" } else { "P" },
+        };
+
+        let r = self
+            .client
+            .post(&self.url("/channels"))
+            .bearer_auth(&self.cfg.token)
+            .json(&mmchannel)
+            .send_with(&self.limiter)?;
+        let status = r.status().as_u16();
+
+        let channel = match created_channel(status, &r.text()?)? {
+            Some(channel) => channel,
+            None => {
+                let existing: Channel = self
+                    .client
+                    .get(
+                        &self
+                            .url(&format!("/teams/{}/channels/name/{}", team_id, name)),
+                    )
+                    .bearer_auth(&self.cfg.token)
+                    .query(&[("include_deleted", "true")])
+                    .send_with(&self.limiter)?
+                    .error_for_status()?
+                    .json()?;
+                if existing.delete_at != 0 {
+                    return Err(Error::Other(format!(
+                        "channel {} already exists and is archived",
+                        name
+                    )));
+                }
+                existing
+            }
+        };
+        Ok(channel.into())
+    }
+
     fn archive(&self, channel_id: &str) -> Result<()> {
         self.client
             .delete(&self.url(&format!("/channels/{}", channel_id)))
             .bearer_auth(&self.cfg.token)
-            .send()?;
+            .send_with(&self.limiter)?;
 
         Ok(())
     }
+
+    fn notify_props(
+        &self,
+        channel_id: &str,
+        props: &HashMap<String, String>,
+    ) -> Result<()> {
+        let payload = NotifyProps {
+            channel_id,
+            user_id: &self.me.id,
+            props,
+        };
+        self.client
+            .put(&self.url(&format!(
+                "/channels/{}/members/{}/notify_props",
+                channel_id, self.me.id
+            )))
+            .bearer_auth(&self.cfg.token)
+            .json(&payload)
+            .send_with(&self.limiter)?
+            .error_for_status()?;
+        Ok(())
+    }
+}
+
+/// The fallback webhook posts on the channel it is bound to, whatever the channel of
+/// the post.
+impl Critical for Mattermost {
+    fn post_critical(&self, post: &gm::Post) -> Result<()> {
+        let webhook = self.cfg.fallback_webhook.as_ref().map(|url| {
+            move || -> Result<()> {
+                self.client
+                    .post(url)
+                    .json(&WebhookPost {
+                        text: &post.message,
+                    })
+                    .send_with(&self.limiter)?
+                    .error_for_status()?;
+                Ok(())
+            }
+        });
+        with_fallback(&self.logger, || self.post(post), webhook)
+    }
 }
 
 impl Sender for Mattermost {
@@ -91,7 +592,7 @@ impl Sender for Mattermost {
             file_ids: vec![],
             message: &post.message,
             metadata: Metadata {},
-            props: Props {},
+            props: Props::default(),
             update_at: 0,
             user_id: self.me.id.clone(),
             parent_id: None,
@@ -101,21 +602,50 @@ impl Sender for Mattermost {
             .post(&self.url("/posts"))
             .bearer_auth(&self.cfg.token)
             .json(&mmpost)
-            .send()?;
+            .send_with(&self.limiter)?
+            .error_for_status()?;
         Ok(())
     }
 
+    /// Custom emoji are only looked for when the reaction is refused, so that a
+    /// standard emoji missing from the list emoji::is_standard knows still works.
     fn reaction(&self, post: &gm::Post, reaction: &str) -> Result<()> {
         let reaction = Reaction {
             user_id: self.me.id.clone(),
             post_id: post.id.clone(),
             emoji_name: String::from(reaction),
         };
-        self.client
+        let status = self
+            .client
             .post(&self.url("/reactions"))
             .bearer_auth(&self.cfg.token)
             .json(&reaction)
-            .send()?;
+            .send_with(&self.limiter)?
+            .status();
+        if status.is_success() {
+            return Ok(());
+        }
+
+        let known = if emoji::is_standard(&reaction.emoji_name) {
+            Ok(true)
+        } else {
+            self.custom_emoji_exists(&reaction.emoji_name)
+        };
+        Err(refused_reaction(
+            status.as_u16(),
+            &reaction.emoji_name,
+            known,
+        ))
+    }
+
+    fn remove_reaction(&self, post: &gm::Post, reaction: &str) -> Result<()> {
+        self.client
+            .delete(&self.url(&format!(
+                "/users/{}/posts/{}/reactions/{}",
+                self.me.id, post.id, reaction
+            )))
+            .bearer_auth(&self.cfg.token)
+            .send_with(&self.limiter)?;
         Ok(())
     }
 
@@ -126,7 +656,7 @@ impl Sender for Mattermost {
             file_ids: vec![],
             message: message,
             metadata: Metadata {},
-            props: Props {},
+            props: Props::default(),
             update_at: 0,
             user_id: self.me.id.clone(),
             parent_id: Some(post.id.clone()),
@@ -136,7 +666,23 @@ impl Sender for Mattermost {
             .post(&self.url("/posts"))
             .bearer_auth(&self.cfg.token)
             .json(&mmpost)
-            .send()?;
+            .send_with(&self.limiter)?;
+        Ok(())
+    }
+
+    fn ephemeral(&self, post: &gm::Post, message: &str) -> Result<()> {
+        let ephemeral = EphemeralPost {
+            user_id: &post.user_id,
+            post: EphemeralMessage {
+                channel_id: &post.channel_id,
+                message,
+            },
+        };
+        self.client
+            .post(&self.url("/posts/ephemeral"))
+            .bearer_auth(&self.cfg.token)
+            .json(&ephemeral)
+            .send_with(&self.limiter)?;
         Ok(())
     }
 }
@@ -152,7 +698,113 @@ impl Editor for Mattermost {
             .put(&self.url(&format!("/posts/{}/patch", post.id)))
             .bearer_auth(&self.cfg.token)
             .json(&edit)
-            .send()?;
+            .send_with(&self.limiter)?;
+        Ok(())
+    }
+
+    fn delete(&self, post: &gm::Post) -> Result<()> {
+        self.client
+            .delete(&self.url(&format!("/posts/{}", post.id)))
+            .bearer_auth(&self.cfg.token)
+            .send_with(&self.limiter)?
+            .error_for_status()?;
+        Ok(())
+    }
+}
+
+impl Scheduler for Mattermost {
+    fn schedule(&self, post: &gm::Post, at: DateTime<Utc>) -> Result<Option<String>> {
+        let scheduled = ScheduledPost {
+            channel_id: &post.channel_id,
+            message: &post.message,
+            root_id: &post.root_id,
+            scheduled_at: at.timestamp_millis(),
+        };
+        let res = self
+            .client
+            .post(&self.url("/posts/schedule"))
+            .bearer_auth(&self.cfg.token)
+            .json(&scheduled)
+            .send_with(&self.limiter)?;
+        let status = res.status().as_u16();
+        scheduled_post(status, &res.text()?)
+    }
+}
+
+impl Creator for Mattermost {
+    fn create_post(&self, post: &gm::Post) -> Result<gm::Post> {
+        let mmpost = NewPost {
+            channel_id: post.channel_id.clone(),
+            create_at: 0,
+            file_ids: vec![],
+            message: &post.message,
+            metadata: Metadata {},
+            props: Props::default(),
+            update_at: 0,
+            user_id: self.me.id.clone(),
+            parent_id: None,
+            root_id: None,
+        };
+        let created: Post = self
+            .client
+            .post(&self.url("/posts"))
+            .bearer_auth(&self.cfg.token)
+            .json(&mmpost)
+            .send_with(&self.limiter)?
+            .error_for_status()?
+            .json()?;
+        Ok(created.into())
+    }
+}
+
+impl Idempotent for Mattermost {
+    fn post_once(&self, post: &gm::Post, key: &str) -> Result<gm::Post> {
+        self.sent.send_once(key, || {
+            let mmpost = NewPost {
+                channel_id: post.channel_id.clone(),
+                create_at: 0,
+                file_ids: vec![],
+                message: &post.message,
+                metadata: Metadata {},
+                props: Props {
+                    idempotency_key: Some(key.to_string()),
+                },
+                update_at: 0,
+                user_id: self.me.id.clone(),
+                parent_id: None,
+                root_id: None,
+            };
+            let created: Post = self
+                .client
+                .post(&self.url("/posts"))
+                .bearer_auth(&self.cfg.token)
+                .json(&mmpost)
+                .send_with(&self.limiter)?
+                .error_for_status()?
+                .json()?;
+            Ok(created.into())
+        })
+    }
+}
+
+impl Interactive for Mattermost {
+    fn open_dialog(
+        &self,
+        trigger_id: &str,
+        url: &str,
+        dialog: &DialogDef,
+    ) -> Result<()> {
+        let payload = OpenDialog {
+            trigger_id,
+            url,
+            dialog: dialog.into(),
+        };
+        self.client
+            .post(&self.url("/actions/dialogs/open"))
+            .bearer_auth(&self.cfg.token)
+            .json(&payload)
+            .send_with(&self.limiter)?
+            .error_for_status()?;
         Ok(())
     }
 }
@@ -191,20 +843,622 @@ impl Getter for Mattermost {
     }
 
     fn users_by_ids(&self, ids: Vec<&str>) -> Result<Vec<gm::User>> {
-        let r = self
+        let mut cache = self.users.lock().unwrap();
+        cached_users(&mut cache, ids, USERS_BATCH, |batch| {
+            Ok(self
+                .client
+                .post(self.url("/users/ids"))
+                .bearer_auth(&self.cfg.token)
+                .json(&batch)
+                .send_with(&self.limiter)?
+                .json()?)
+        })
+    }
+
+    fn team(&self) -> Result<gm::Team> {
+        let mut team = self.team.lock().unwrap();
+        if let Some(team) = team.as_ref() {
+            return Ok(team.clone());
+        }
+
+        let teams: Vec<Team> = self
+            .client
+            .get(&self.url("/users/me/teams"))
+            .bearer_auth(&self.cfg.token)
+            .send_with(&self.limiter)?
+            .json()?;
+
+        let found = find_team(teams, self.cfg.team_name.as_deref())?;
+        println!("working with team {} ({})", found.name, found.id);
+        *team = Some(found.clone());
+        Ok(found)
+    }
+
+    fn unread(&self, channel_id: &str) -> Result<gm::ChannelUnread> {
+        let unread: ChannelUnread = self
             .client
-            .post(self.url("/users/ids"))
+            .get(&self.url(&format!(
+                "/users/{}/channels/{}/unread",
+                self.me.id, channel_id
+            )))
             .bearer_auth(&self.cfg.token)
-            .json(&ids)
-            .send()?;
+            .send_with(&self.limiter)?
+            .json()?;
+        Ok(unread.into())
+    }
 
-        let users: Vec<User> = r.json()?;
+    fn unread_mentions(&self) -> Result<Vec<gm::ChannelUnread>> {
+        let team = self.team()?;
+        let members: Vec<ChannelMember> = self
+            .client
+            .get(&self.url(&format!("/users/me/teams/{}/channels/members", team.id)))
+            .bearer_auth(&self.cfg.token)
+            .send_with(&self.limiter)?
+            .json()?;
 
-        let mut fusers: Vec<gm::User> = vec![];
-        for u in users.iter() {
-            fusers.push((*u).clone().into());
+        let mut unreads = vec![];
+        for channel_id in mentioned(members).iter() {
+            unreads.push(self.unread(channel_id)?);
         }
+        Ok(unreads)
+    }
+
+    fn permalink(&self, post_id: &str) -> Result<String> {
+        let post: Post = self
+            .client
+            .get(&self.url(&format!("/posts/{}", post_id)))
+            .bearer_auth(&self.cfg.token)
+            .send_with(&self.limiter)?
+            .error_for_status()?
+            .json()?;
+        let channel: Channel = self
+            .client
+            .get(&self.url(&format!("/channels/{}", post.channel_id)))
+            .bearer_auth(&self.cfg.token)
+            .send_with(&self.limiter)?
+            .error_for_status()?
+            .json()?;
+
+        let mine = self.team()?;
+        let team = if channel.team_id.is_empty() || channel.team_id == mine.id {
+            mine.name
+        } else {
+            let team: Team = self
+                .client
+                .get(&self.url(&format!("/teams/{}", channel.team_id)))
+                .bearer_auth(&self.cfg.token)
+                .send_with(&self.limiter)?
+                .error_for_status()?
+                .json()?;
+            team.name
+        };
+
+        Ok(permalink(&self.cfg.api_url, &team, post_id))
+    }
+
+    fn custom_emoji_exists(&self, name: &str) -> Result<bool> {
+        let name = name.trim_matches(':');
+        if let Some(exists) = self.emojis.lock().unwrap().get(name) {
+            return Ok(*exists);
+        }
+
+        let status = self
+            .client
+            .get(&self.url(&format!("/emoji/name/{}", name)))
+            .bearer_auth(&self.cfg.token)
+            .send_with(&self.limiter)?
+            .status()
+            .as_u16();
+        let exists = custom_emoji(status)?;
+        self.emojis.lock().unwrap().insert(name.to_string(), exists);
+        Ok(exists)
+    }
+
+    fn limits(&self) -> gm::ServerLimits {
+        self.limits.clone()
+    }
+
+    fn channel(&self, channel_id: &str) -> Result<gm::ChannelInfo> {
+        let channel: Channel = self
+            .client
+            .get(&self.url(&format!("/channels/{}", channel_id)))
+            .bearer_auth(&self.cfg.token)
+            .send_with(&self.limiter)?
+            .error_for_status()?
+            .json()?;
+        Ok(channel.into())
+    }
+
+    fn thread(&self, root_id: &str) -> Result<Vec<gm::Post>> {
+        let posts = collect_thread(|cursor| {
+            let mut query = vec![
+                ("perPage", "200".to_string()),
+                ("direction", "down".to_string()),
+            ];
+            if let Some((create_at, post_id)) = cursor {
+                query.push(("fromCreateAt", create_at.to_string()));
+                query.push(("fromPost", post_id.to_string()));
+            }
+            Ok(self
+                .client
+                .get(&self.url(&format!("/posts/{}/thread", root_id)))
+                .bearer_auth(&self.cfg.token)
+                .query(&query)
+                .send_with(&self.limiter)?
+                .error_for_status()?
+                .json()?)
+        })?;
+        Ok(posts.into_iter().map(|p| p.into()).collect())
+    }
+
+    fn post_with_metadata(&self, post_id: &str) -> Result<gm::PostDetails> {
+        let get = |path: &str| {
+            self.client
+                .get(&self.url(path))
+                .bearer_auth(&self.cfg.token)
+                .send_with(&self.limiter)?
+                .error_for_status()
+        };
+        let post: Post = get(&format!("/posts/{}", post_id))?.json()?;
+        post_details(
+            post,
+            || Ok(get(&format!("/posts/{}/reactions", post_id))?.json()?),
+            || Ok(get(&format!("/posts/{}/files/info", post_id))?.json()?),
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn offline() -> Mattermost {
+        offline_at("http://localhost/api/v4")
+    }
+
+    /// Client of the api at api_url, without any call to it.
+    fn offline_at(api_url: &str) -> Mattermost {
+        let cfg = Conf {
+            debug_channel: "debug".to_string(),
+            api_url: api_url.to_string(),
+            ws_url: "ws://localhost".to_string(),
+            ws_reconnect: true,
+            token: "token".to_string(),
+            db_url: "flobot.db".to_string(),
+            team_name: None,
+            log_level: flobot_lib::log::Level::Info,
+            log_sample: 1,
+            api_concurrency: 8,
+            post_dedup_secs: 600,
+            fallback_webhook: Some("http://localhost/hooks/alerts".to_string()),
+            admin_users: vec![],
+        };
+        let me = Me {
+            id: "bot".to_string(),
+            username: "flobot".to_string(),
+            email: "".to_string(),
+            nickname: "".to_string(),
+            first_name: "".to_string(),
+            last_name: "".to_string(),
+            is_bot: true,
+        };
+        let client = reqwest::blocking::Client::new();
+        let limiter = Limiter::new(cfg.api_concurrency);
+        Mattermost::from_parts(cfg, client, me, limiter, gm::ServerLimits::default())
+    }
+
+    #[test]
+    fn options_override_conf() {
+        let mm = offline();
+        assert_eq!(8, mm.cfg.api_concurrency);
+        assert_eq!("ws://localhost", mm.cfg.ws_url);
+
+        let mm = mm
+            .with_concurrency(2)
+            .with_websocket("wss://chat.example.com", false)
+            .with_dedup_window(Duration::from_secs(30))
+            .with_fallback_webhook(None);
+        assert_eq!(2, mm.cfg.api_concurrency);
+        assert_eq!("wss://chat.example.com", mm.cfg.ws_url);
+        assert!(!mm.cfg.ws_reconnect);
+        assert_eq!(30, mm.cfg.post_dedup_secs);
+        assert!(mm.cfg.fallback_webhook.is_none());
+        assert_eq!("debug", mm.cfg.debug_channel);
+    }
+
+    #[test]
+    fn post_fallback() {
+        let used = std::cell::Cell::new(false);
+        let webhook = || {
+            used.set(true);
+            Ok(())
+        };
+
+        let logger = Logger::default();
+        assert!(
+            with_fallback(&logger, || Err(Error::Status(403)), Some(webhook)).is_ok()
+        );
+        assert!(used.get());
+
+        used.set(false);
+        assert!(with_fallback(&logger, || Ok(()), Some(webhook)).is_ok());
+        assert!(!used.get());
+
+        let webhook: Option<fn() -> Result<()>> = None;
+        assert!(with_fallback(&logger, || Err(Error::Status(403)), webhook).is_err());
+    }
+
+    fn team(id: &str, name: &str) -> Team {
+        Team {
+            id: id.to_string(),
+            name: name.to_string(),
+            display_name: name.to_uppercase(),
+        }
+    }
+
+    #[test]
+    fn find_team_by_name() {
+        let teams = vec![team("1", "one"), team("2", "two")];
+        let found = find_team(teams, Some("two")).unwrap();
+        assert_eq!("2", found.id);
+        assert_eq!("TWO", found.display_name);
+    }
+
+    #[test]
+    fn find_team_not_member() {
+        let teams = vec![team("1", "one")];
+        match find_team(teams, Some("two")) {
+            Err(Error::Other(e)) => assert!(e.contains("not a member of team two")),
+            _ => panic!("expected not a member error"),
+        }
+    }
+
+    fn member(channel_id: &str, mention_count: u64) -> ChannelMember {
+        ChannelMember {
+            channel_id: channel_id.to_string(),
+            user_id: "me".to_string(),
+            msg_count: 10,
+            mention_count,
+        }
+    }
+
+    #[test]
+    fn mentioned_channels() {
+        let members = vec![member("c1", 0), member("c2", 3), member("c3", 1)];
+        assert_eq!(vec!["c2", "c3"], mentioned(members));
+        assert!(mentioned(vec![member("c1", 0)]).is_empty());
+        assert!(mentioned(vec![]).is_empty());
+    }
+
+    #[test]
+    fn permalink_url() {
+        let expect = "http://localhost:8065/dev/pl/p1x2";
+        assert_eq!(
+            expect,
+            permalink("http://localhost:8065/api/v4", "dev", "p1x2")
+        );
+        assert_eq!(
+            expect,
+            permalink("http://localhost:8065/api/v4/", "dev", "p1x2")
+        );
+    }
+
+    #[test]
+    fn post_metadata() {
+        let json = r#"{"id": "post", "message": "look", "create_at": 1, "update_at": 1,
+            "edit_at": 0, "delete_at": 0, "is_pinned": false, "user_id": "user",
+            "channel_id": "channel", "root_id": "", "original_id": "",
+            "metadata": {
+                "embeds": [{"type": "opengraph", "url": "https://example.com"}],
+                "reactions": [{"user_id": "user2", "post_id": "post", "emoji_name": "eyes"}],
+                "files": [{"id": "file", "name": "cat.png", "size": 1024, "mime_type": "image/png"}]
+            }}"#;
+        let post: Post = serde_json::from_str(json).unwrap();
+        let unused = || -> Result<Vec<Reaction>> { panic!("metadata was sent") };
+        let details =
+            post_details(post, unused, || panic!("metadata was sent")).unwrap();
+
+        assert_eq!("look", details.post.message);
+        assert_eq!(
+            vec![gm::Embed {
+                kind: "opengraph".to_string(),
+                url: "https://example.com".to_string()
+            }],
+            details.embeds
+        );
+        assert_eq!("eyes", details.reactions[0].emoji_name);
+        assert_eq!("user2", details.reactions[0].user_id);
+        assert_eq!(1024, details.files[0].size);
+        assert_eq!("image/png", details.files[0].mime_type);
+    }
+
+    #[test]
+    fn post_metadata_fallback() {
+        let post = thread_post("post", 1, 0);
+        let reactions = || {
+            Ok(vec![Reaction {
+                user_id: "user2".to_string(),
+                post_id: "post".to_string(),
+                emoji_name: "+1".to_string(),
+            }])
+        };
+        let files = || {
+            Ok(vec![FileInfo {
+                id: "file".to_string(),
+                name: "notes.txt".to_string(),
+                size: 12,
+                mime_type: "text/plain".to_string(),
+            }])
+        };
+        let details = post_details(post, reactions, files).unwrap();
+
+        assert!(details.embeds.is_empty());
+        assert_eq!("+1", details.reactions[0].emoji_name);
+        assert_eq!("notes.txt", details.files[0].name);
+
+        let post = thread_post("post", 1, 0);
+        let failed = post_details(post, || Err(Error::Status(403)), files);
+        assert!(failed.is_err());
+    }
+
+    fn thread_post(id: &str, create_at: u64, delete_at: u64) -> Post {
+        Post {
+            id: id.to_string(),
+            message: format!("message {}", id),
+            create_at,
+            update_at: create_at,
+            edit_at: 0,
+            delete_at,
+            is_pinned: false,
+            user_id: "user".to_string(),
+            channel_id: "channel".to_string(),
+            root_id: if id == "root" { "" } else { "root" }.to_string(),
+            original_id: "".to_string(),
+            metadata: None,
+        }
+    }
+
+    fn page(posts: Vec<Post>, has_next: bool) -> PostList {
+        PostList {
+            order: posts.iter().map(|p| p.id.clone()).collect(),
+            posts: posts.into_iter().map(|p| (p.id.clone(), p)).collect(),
+            has_next,
+        }
+    }
+
+    #[test]
+    fn thread_pages() {
+        let mut cursors = vec![];
+        let posts = collect_thread(|cursor| {
+            cursors.push(cursor.map(|(at, id)| (at, id.to_string())));
+            Ok(match cursors.len() {
+                1 => page(
+                    vec![thread_post("b", 20, 0), thread_post("root", 10, 0)],
+                    true,
+                ),
+                2 => page(
+                    vec![thread_post("d", 40, 0), thread_post("c", 30, 35)],
+                    true,
+                ),
+                _ => page(vec![thread_post("e", 50, 0)], false),
+            })
+        })
+        .unwrap();
+
+        let ids: Vec<&str> = posts.iter().map(|p| p.id.as_str()).collect();
+        assert_eq!(vec!["root", "b", "d", "e"], ids);
+        assert_eq!(
+            vec![
+                None,
+                Some((20, "b".to_string())),
+                Some((40, "d".to_string()))
+            ],
+            cursors
+        );
+    }
+
+    #[test]
+    fn thread_no_progress() {
+        let mut calls = 0;
+        let posts = collect_thread(|_| {
+            calls += 1;
+            Ok(page(vec![thread_post("root", 10, 0)], true))
+        })
+        .unwrap();
+        assert_eq!(1, posts.len());
+        assert_eq!(2, calls);
+    }
+
+    fn user(id: &str) -> User {
+        User {
+            id: id.to_string(),
+            username: format!("user.{}", id),
+        }
+    }
+
+    #[test]
+    fn users_batched_and_cached() {
+        let mut cache = HashMap::new();
+        let mut batches: Vec<Vec<String>> = vec![];
+        let mut fetch = |ids: &[&str]| {
+            batches.push(ids.iter().map(|id| id.to_string()).collect());
+            Ok(ids
+                .iter()
+                .filter(|id| **id != "ghost")
+                .map(|id| user(id))
+                .collect())
+        };
+
+        let users =
+            cached_users(&mut cache, vec!["c", "a", "b", "a", "ghost"], 2, &mut fetch)
+                .unwrap();
+        let ids: Vec<&str> = users.iter().map(|u| u.id.as_str()).collect();
+        assert_eq!(vec!["c", "a", "b", "a"], ids);
+        assert_eq!(3, cache.len());
+
+        let users = cached_users(&mut cache, vec!["b", "d"], 2, &mut fetch).unwrap();
+        assert_eq!("user.d", users[1].username);
+        assert_eq!(vec![vec!["a", "b"], vec!["c", "ghost"], vec!["d"]], batches);
+    }
+
+    /// Answers a single request with status and body, on a local port. Returns the
+    /// api url to call and the request line and body received.
+    fn serve_once(
+        status: u16,
+        body: &'static str,
+    ) -> (String, std::thread::JoinHandle<(String, String)>) {
+        use std::io::{BufRead, BufReader, Write};
+        let listener = std::net::TcpListener::bind("127.0.0.1:0").unwrap();
+        let url = format!("http://{}/api/v4", listener.local_addr().unwrap());
+        let server = std::thread::spawn(move || {
+            let (mut stream, _) = listener.accept().unwrap();
+            let mut reader = BufReader::new(stream.try_clone().unwrap());
+            let mut request = String::new();
+            reader.read_line(&mut request).unwrap();
+            let mut length = 0;
+            loop {
+                let mut header = String::new();
+                reader.read_line(&mut header).unwrap();
+                if header.trim().is_empty() {
+                    break;
+                }
+                if let Some((name, value)) = header.split_once(':') {
+                    if name.eq_ignore_ascii_case("content-length") {
+                        length = value.trim().parse().unwrap();
+                    }
+                }
+            }
+            let mut received = vec![0; length];
+            reader.read_exact(&mut received).unwrap();
+            write!(
+                stream,
+                "HTTP/1.1 {} OK\r\nContent-Type: application/json\r\n\
+                Content-Length: {}\r\nConnection: close\r\n\r\n{}",
+                status,
+                body.len(),
+                body
+            )
+            .unwrap();
+            (
+                request.trim().to_string(),
+                String::from_utf8(received).unwrap(),
+            )
+        });
+        (url, server)
+    }
+
+    #[test]
+    fn display_name_patch() {
+        let (url, server) = serve_once(200, r#"{"user_id": "bot"}"#);
+        offline_at(&url).set_display_name("Flobot").unwrap();
+
+        let (request, body) = server.join().unwrap();
+        assert_eq!("PUT /api/v4/bots/bot HTTP/1.1", request);
+        assert_eq!(r#"{"display_name":"Flobot"}"#, body);
+    }
+
+    #[test]
+    fn icon_form() {
+        let body = image_form("b0undary", b"\x89PNG");
+        let expect = b"--b0undary\r\n\
+            Content-Disposition: form-data; name=\"image\"; filename=\"icon\"\r\n\
+            Content-Type: application/octet-stream\r\n\r\n\
+            \x89PNG\r\n--b0undary--\r\n";
+        assert_eq!(expect.to_vec(), body);
+    }
+
+    #[test]
+    fn channel_creation() {
+        let body = r#"{"id": "c1", "team_id": "t1", "name": "incident-42",
+            "display_name": "Incident 42", "type": "O", "delete_at": 0}"#;
+        let channel: gm::ChannelInfo =
+            created_channel(201, body).unwrap().unwrap().into();
+        assert_eq!("c1", channel.id);
+        assert_eq!(gm::ChannelKind::Public, channel.kind);
+    }
+
+    #[test]
+    fn channel_creation_collision() {
+        let body = format!(
+            r#"{{"id": "{}", "message": "A channel with that name already exists"}}"#,
+            CHANNEL_EXISTS
+        );
+        assert!(created_channel(400, &body).unwrap().is_none());
+
+        let body =
+            r#"{"id": "api.context.permissions.app_error", "message": "denied"}"#;
+        match created_channel(403, body) {
+            Err(Error::Other(e)) => assert!(e.contains("denied")),
+            _ => panic!("expected creation error"),
+        }
+        assert!(matches!(
+            created_channel(502, "bad gateway"),
+            Err(Error::Status(502))
+        ));
+    }
+
+    #[test]
+    fn schedule_api_or_fallback() {
+        let body = r#"{"id": "s1", "channel_id": "c1", "message": "standup!"}"#;
+        assert_eq!(Some("s1".to_string()), scheduled_post(201, body).unwrap());
+        assert!(scheduled_post(404, "").unwrap().is_none());
+        assert!(scheduled_post(501, "").unwrap().is_none());
+        assert!(matches!(scheduled_post(403, ""), Err(Error::Status(403))));
+        assert!(matches!(scheduled_post(201, "{}"), Err(Error::Body(_))));
+
+        let scheduled = ScheduledPost {
+            channel_id: "c1",
+            message: "standup!",
+            root_id: "",
+            scheduled_at: 1623229200000,
+        };
+        assert_eq!(
+            r#"{"channel_id":"c1","message":"standup!","root_id":"","scheduled_at":1623229200000}"#,
+            serde_json::to_string(&scheduled).unwrap()
+        );
+    }
+
+    #[test]
+    fn limits_from_config() {
+        let mut config = HashMap::new();
+        config.insert("MaxPostSize".to_string(), "16383".to_string());
+        config.insert("MaxFileSize".to_string(), "not a size".to_string());
+
+        let limits = server_limits(&config);
+        assert_eq!(16383, limits.max_post_len);
+        assert_eq!(
+            gm::ServerLimits::default().max_file_size,
+            limits.max_file_size
+        );
+        assert_eq!(gm::ServerLimits::default(), server_limits(&HashMap::new()));
+    }
+
+    #[test]
+    fn custom_emoji_lookup() {
+        assert!(custom_emoji(200).unwrap());
+        assert!(!custom_emoji(404).unwrap());
+        assert!(matches!(custom_emoji(500), Err(Error::Status(500))));
+    }
+
+    #[test]
+    fn reaction_refused() {
+        match refused_reaction(400, "nope", Ok(false)) {
+            Error::Other(e) => assert_eq!("unknown emoji nope", e),
+            e => panic!("expected unknown emoji, got {:?}", e),
+        }
+        assert!(matches!(
+            refused_reaction(403, "thumbsup", Ok(true)),
+            Error::Status(403)
+        ));
+        assert!(matches!(
+            refused_reaction(403, "party", Err(Error::Status(403))),
+            Error::Status(403)
+        ));
+    }
 
-        Ok(fusers)
+    #[test]
+    fn find_team_single() {
+        assert_eq!("1", find_team(vec![team("1", "one")], None).unwrap().id);
+        assert!(find_team(vec![team("1", "one"), team("2", "two")], None).is_err());
     }
 }
@@ -0,0 +1,159 @@
+//! Submissions of interactive dialogs, for the server receiving them on the dialog url.
+
+use super::models::{SubmitDialog, SubmitDialogResponse};
+use flobot_lib::client::{Error, Result};
+use flobot_lib::dialog::{Dialogs, Response, Submission};
+
+/// Parse the body of a request sent to the dialog url.
+pub fn parse_submission(body: &[u8]) -> Result<Submission> {
+    let submission: SubmitDialog = serde_json::from_slice(body)
+        .map_err(|e| Error::Body(format!("invalid dialog submission: {}", e)))?;
+    Ok(submission.into())
+}
+
+/// Body answering a submission with response.
+pub fn response_body(response: &Response) -> String {
+    serde_json::to_string(&SubmitDialogResponse {
+        error: response.error.as_deref(),
+        errors: &response.errors,
+    })
+    .unwrap()
+}
+
+/// Callback serves submissions of dialogs on `/dialogs/<secret>`. Mattermost doesn't
+/// sign submissions, so the secret in the dialog url tells they come from it: open
+/// dialogs with url() and keep it out of logs.
+pub struct Callback {
+    dialogs: Dialogs,
+    secret: String,
+}
+
+impl Callback {
+    /// secret must not be empty.
+    pub fn new(dialogs: Dialogs, secret: &str) -> Self {
+        Self {
+            dialogs,
+            secret: secret.to_string(),
+        }
+    }
+
+    /// Url to open dialogs with, base is the url Mattermost reaches the server at.
+    pub fn url(&self, base: &str) -> String {
+        format!("{}/dialogs/{}", base.trim_end_matches('/'), self.secret)
+    }
+
+    /// Answer a request, returns the status and the JSON body of the response.
+    /// Requests without the secret get a 404.
+    pub fn handle(&self, method: &str, path: &str, body: &[u8]) -> (u16, String) {
+        let secret = path.strip_prefix("/dialogs/");
+        if self.secret.is_empty() || secret != Some(self.secret.as_str()) {
+            return (404, response_body(&Response::error("not found")));
+        }
+        if method != "POST" {
+            return (405, response_body(&Response::error("method not allowed")));
+        }
+        match parse_submission(body) {
+            Ok(submission) => (200, response_body(&self.dialogs.submit(&submission))),
+            Err(e) => (400, response_body(&Response::error(&e.to_string()))),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::models::OpenDialog;
+    use flobot_lib::dialog::{Dialog, DialogHandler, Element};
+
+    #[test]
+    fn submission_parse() {
+        let body = br#"{"type": "dialog_submission", "callback_id": "poll",
+            "state": "s", "user_id": "user", "channel_id": "channel", "team_id": "team",
+            "submission": {"answer": "yes", "count": 3, "notify": true, "comment": null},
+            "cancelled": false}"#;
+        let submission = parse_submission(body).unwrap();
+        assert_eq!("poll", submission.callback_id);
+        assert_eq!("user", submission.user_id);
+        assert_eq!(Some(&"yes".to_string()), submission.values.get("answer"));
+        assert_eq!(Some(&"3".to_string()), submission.values.get("count"));
+        assert_eq!(Some(&"true".to_string()), submission.values.get("notify"));
+        assert!(submission.values.get("comment").is_none());
+        assert!(!submission.cancelled);
+
+        assert!(parse_submission(b"not json").is_err());
+    }
+
+    #[test]
+    fn submission_response() {
+        assert_eq!("{}", response_body(&Response::ok()));
+        let response = Response::ok().field_error("answer", "required");
+        assert_eq!(
+            r#"{"errors":{"answer":"required"}}"#,
+            response_body(&response)
+        );
+        assert_eq!(
+            r#"{"error":"unknown dialog"}"#,
+            response_body(&Response::error("unknown dialog"))
+        );
+    }
+
+    #[test]
+    fn dialog_payload() {
+        let dialog = Dialog::new("poll", "Poll")
+            .submit_label("Vote")
+            .element(Element::select(
+                "answer",
+                "Answer",
+                vec![("Yes".to_string(), "yes".to_string())],
+            ))
+            .element(Element::text("comment", "Comment").optional());
+        let payload = serde_json::to_value(OpenDialog {
+            trigger_id: "trigger",
+            url: "http://bot/dialogs",
+            dialog: (&dialog).into(),
+        })
+        .unwrap();
+
+        assert_eq!("Vote", payload["dialog"]["submit_label"]);
+        let elements = &payload["dialog"]["elements"];
+        assert_eq!("select", elements[0]["type"]);
+        assert_eq!("yes", elements[0]["options"][0]["value"]);
+        assert_eq!(false, elements[0]["optional"]);
+        assert_eq!(true, elements[1]["optional"]);
+        assert!(elements[1].get("options").is_none());
+    }
+
+    struct Accept;
+
+    impl DialogHandler for Accept {
+        fn submit(&self, _submission: &Submission) -> Response {
+            Response::ok()
+        }
+    }
+
+    #[test]
+    fn callback_secret() {
+        let mut dialogs = Dialogs::new();
+        dialogs.add(&Dialog::new("poll", "Poll"), Accept);
+        let callback = Callback::new(dialogs, "s3cret");
+        assert_eq!(
+            "http://bot:6801/dialogs/s3cret",
+            callback.url("http://bot:6801/")
+        );
+
+        let body =
+            br#"{"callback_id": "poll", "user_id": "user", "channel_id": "channel",
+            "team_id": "team", "submission": {}}"#;
+        assert_eq!(
+            (200, "{}".to_string()),
+            callback.handle("POST", "/dialogs/s3cret", body)
+        );
+        assert_eq!(404, callback.handle("POST", "/dialogs/guess", body).0);
+        assert_eq!(404, callback.handle("POST", "/dialogs/", body).0);
+        assert_eq!(405, callback.handle("GET", "/dialogs/s3cret", b"").0);
+        assert_eq!(400, callback.handle("POST", "/dialogs/s3cret", b"nope").0);
+
+        let open = Callback::new(Dialogs::new(), "");
+        assert_eq!(404, open.handle("POST", "/dialogs/", body).0);
+    }
+}
@@ -1,3 +1,4 @@
 pub mod client;
+pub mod dialog;
 pub mod models;
 pub mod websocket;
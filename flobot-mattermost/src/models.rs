@@ -1,12 +1,18 @@
+use flobot_lib::dialog;
 use flobot_lib::models as gm;
 use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
 use std::convert::Into;
 
 #[derive(Serialize)]
 pub struct Metadata {}
 
-#[derive(Serialize)]
-pub struct Props {}
+#[derive(Default, Serialize)]
+pub struct Props {
+    /// key given to Idempotent::post_once, kept with the post to track retries.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub idempotency_key: Option<String>,
+}
 
 #[derive(Serialize)]
 pub struct NewPost<'a> {
@@ -22,6 +28,148 @@ pub struct NewPost<'a> {
     pub parent_id: Option<String>,
 }
 
+/// Post sent through an incoming webhook, in the channel of the webhook.
+#[derive(Serialize)]
+pub struct WebhookPost<'a> {
+    pub text: &'a str,
+}
+
+#[derive(Serialize)]
+pub struct OpenDialog<'a> {
+    pub trigger_id: &'a str,
+    pub url: &'a str,
+    pub dialog: Dialog<'a>,
+}
+
+#[derive(Serialize)]
+pub struct Dialog<'a> {
+    pub callback_id: &'a str,
+    pub title: &'a str,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub submit_label: Option<&'a str>,
+    pub state: &'a str,
+    pub elements: Vec<DialogElement<'a>>,
+}
+
+#[derive(Serialize)]
+pub struct DialogElement<'a> {
+    pub display_name: &'a str,
+    pub name: &'a str,
+    #[serde(rename = "type")]
+    pub type_: &'a str,
+    pub optional: bool,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub options: Vec<DialogOption<'a>>,
+}
+
+#[derive(Serialize)]
+pub struct DialogOption<'a> {
+    pub text: &'a str,
+    pub value: &'a str,
+}
+
+impl<'a> From<&'a dialog::Dialog> for Dialog<'a> {
+    fn from(d: &'a dialog::Dialog) -> Self {
+        Dialog {
+            callback_id: &d.callback_id,
+            title: &d.title,
+            submit_label: d.submit_label.as_deref(),
+            state: &d.state,
+            elements: d
+                .elements
+                .iter()
+                .map(|e| {
+                    let (type_, options) = match &e.kind {
+                        dialog::ElementKind::Text => ("text", vec![]),
+                        dialog::ElementKind::Textarea => ("textarea", vec![]),
+                        dialog::ElementKind::Select(options) => (
+                            "select",
+                            options
+                                .iter()
+                                .map(|(text, value)| DialogOption { text, value })
+                                .collect(),
+                        ),
+                    };
+                    DialogElement {
+                        display_name: &e.display_name,
+                        name: &e.name,
+                        type_,
+                        optional: e.optional,
+                        options,
+                    }
+                })
+                .collect(),
+        }
+    }
+}
+
+/// Submission of a dialog, as sent by the server to the dialog url.
+#[derive(Deserialize)]
+pub struct SubmitDialog {
+    pub callback_id: String,
+    #[serde(default)]
+    pub state: String,
+    pub user_id: String,
+    pub channel_id: String,
+    pub team_id: String,
+    #[serde(default)]
+    pub submission: HashMap<String, serde_json::Value>,
+    #[serde(default)]
+    pub cancelled: bool,
+}
+
+impl Into<dialog::Submission> for SubmitDialog {
+    fn into(self) -> dialog::Submission {
+        let values = self
+            .submission
+            .into_iter()
+            .filter_map(|(name, value)| match value {
+                serde_json::Value::Null => None,
+                serde_json::Value::String(value) => Some((name, value)),
+                value => Some((name, value.to_string())),
+            })
+            .collect();
+        dialog::Submission {
+            callback_id: self.callback_id,
+            state: self.state,
+            user_id: self.user_id,
+            channel_id: self.channel_id,
+            team_id: self.team_id,
+            values,
+            cancelled: self.cancelled,
+        }
+    }
+}
+
+#[derive(Serialize)]
+pub struct SubmitDialogResponse<'a> {
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<&'a str>,
+    #[serde(skip_serializing_if = "HashMap::is_empty")]
+    pub errors: &'a HashMap<String, String>,
+}
+
+#[derive(Serialize)]
+pub struct ScheduledPost<'a> {
+    pub channel_id: &'a str,
+    pub message: &'a str,
+    pub root_id: &'a str,
+    /// milliseconds since epoch.
+    pub scheduled_at: i64,
+}
+
+#[derive(Serialize)]
+pub struct EphemeralPost<'a> {
+    pub user_id: &'a str,
+    pub post: EphemeralMessage<'a>,
+}
+
+#[derive(Serialize)]
+pub struct EphemeralMessage<'a> {
+    pub channel_id: &'a str,
+    pub message: &'a str,
+}
+
 #[derive(Deserialize, Serialize)]
 pub struct Post {
     pub id: String,
@@ -35,6 +183,46 @@ pub struct Post {
     pub channel_id: String,
     pub root_id: String,
     pub original_id: String,
+    /// missing from the responses of old servers.
+    #[serde(default, skip_serializing)]
+    pub metadata: Option<PostMetadata>,
+}
+
+/// Metadata of a post. The server leaves out empty lists.
+#[derive(Default, Deserialize)]
+pub struct PostMetadata {
+    #[serde(default)]
+    pub embeds: Vec<Embed>,
+    #[serde(default)]
+    pub reactions: Vec<Reaction>,
+    #[serde(default)]
+    pub files: Vec<FileInfo>,
+}
+
+#[derive(Deserialize)]
+pub struct Embed {
+    #[serde(rename = "type")]
+    pub type_: String,
+    #[serde(default)]
+    pub url: String,
+}
+
+#[derive(Deserialize)]
+pub struct FileInfo {
+    pub id: String,
+    pub name: String,
+    pub size: u64,
+    #[serde(default)]
+    pub mime_type: String,
+}
+
+/// Page of posts, as returned by the thread endpoint.
+#[derive(Deserialize)]
+pub struct PostList {
+    pub order: Vec<String>,
+    pub posts: HashMap<String, Post>,
+    #[serde(default)]
+    pub has_next: bool,
 }
 
 #[derive(Debug, Serialize)]
@@ -47,6 +235,14 @@ pub struct CreateChannel<'a> {
 }
 
 #[derive(Serialize)]
+pub struct NotifyProps<'a> {
+    pub channel_id: &'a str,
+    pub user_id: &'a str,
+    #[serde(flatten)]
+    pub props: &'a HashMap<String, String>,
+}
+
+#[derive(Deserialize, Serialize)]
 pub struct Reaction {
     pub user_id: String,
     pub post_id: String,
@@ -77,6 +273,13 @@ pub struct PostEdit<'a> {
     pub file_ids: Option<Vec<&'a str>>,
 }
 
+/// Fields of a bot account, only the given ones are changed.
+#[derive(Serialize)]
+pub struct BotPatch<'a> {
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub display_name: Option<&'a str>,
+}
+
 #[derive(Deserialize, Serialize)]
 pub struct Hello {
     pub server_version: String,
@@ -88,6 +291,48 @@ pub struct User {
     pub username: String,
 }
 
+#[derive(Clone, Deserialize)]
+pub struct Team {
+    pub id: String,
+    pub name: String,
+    pub display_name: String,
+}
+
+/// team_id is empty for direct and group messages.
+#[derive(Deserialize)]
+pub struct Channel {
+    pub id: String,
+    pub team_id: String,
+    pub name: String,
+    pub display_name: String,
+    #[serde(rename = "type")]
+    pub type_: String,
+    pub delete_at: u64,
+}
+
+/// Error returned by the API along with a non 2xx status.
+#[derive(Deserialize)]
+pub struct ApiError {
+    pub id: String,
+    pub message: String,
+}
+
+#[derive(Deserialize)]
+pub struct ChannelUnread {
+    pub team_id: String,
+    pub channel_id: String,
+    pub msg_count: u64,
+    pub mention_count: u64,
+}
+
+#[derive(Deserialize)]
+pub struct ChannelMember {
+    pub channel_id: String,
+    pub user_id: String,
+    pub msg_count: u64,
+    pub mention_count: u64,
+}
+
 #[derive(Deserialize, Serialize)]
 pub struct Posted {
     pub channel_display_name: String,
@@ -144,6 +389,85 @@ impl Into<gm::User> for User {
     }
 }
 
+impl Into<gm::Post> for Post {
+    fn into(self) -> gm::Post {
+        let mut post = gm::Post::with_message(&self.message);
+        post.id = self.id;
+        post.user_id = self.user_id;
+        post.channel_id = self.channel_id;
+        post.parent_id = self.root_id.clone();
+        post.root_id = self.root_id;
+        post
+    }
+}
+
+impl Into<gm::Embed> for Embed {
+    fn into(self) -> gm::Embed {
+        gm::Embed {
+            kind: self.type_,
+            url: self.url,
+        }
+    }
+}
+
+impl Into<gm::Reaction> for Reaction {
+    fn into(self) -> gm::Reaction {
+        gm::Reaction {
+            user_id: self.user_id,
+            emoji_name: self.emoji_name,
+        }
+    }
+}
+
+impl Into<gm::FileInfo> for FileInfo {
+    fn into(self) -> gm::FileInfo {
+        gm::FileInfo {
+            id: self.id,
+            name: self.name,
+            size: self.size,
+            mime_type: self.mime_type,
+        }
+    }
+}
+
+impl Into<gm::ChannelInfo> for Channel {
+    fn into(self) -> gm::ChannelInfo {
+        gm::ChannelInfo {
+            kind: match self.type_.as_str() {
+                "O" => gm::ChannelKind::Public,
+                "D" => gm::ChannelKind::Direct,
+                "G" => gm::ChannelKind::Group,
+                _ => gm::ChannelKind::Private,
+            },
+            id: self.id,
+            team_id: self.team_id,
+            name: self.name,
+            display_name: self.display_name,
+        }
+    }
+}
+
+impl Into<gm::Team> for Team {
+    fn into(self) -> gm::Team {
+        gm::Team {
+            id: self.id,
+            name: self.name,
+            display_name: self.display_name,
+        }
+    }
+}
+
+impl Into<gm::ChannelUnread> for ChannelUnread {
+    fn into(self) -> gm::ChannelUnread {
+        gm::ChannelUnread {
+            team_id: self.team_id,
+            channel_id: self.channel_id,
+            msg_count: self.msg_count,
+            mention_count: self.mention_count,
+        }
+    }
+}
+
 impl Into<gm::Post> for Posted {
     fn into(self) -> gm::Post {
         // FIXME: must still decode self.post
@@ -156,6 +480,7 @@ impl Into<gm::Post> for Posted {
             channel_id: post.channel_id.clone(),
             id: post.id.clone(),
             team_id: self.team_id.clone(),
+            metadata: Default::default(),
         }
     }
 }
@@ -269,6 +594,26 @@ impl Into<gm::Event> for MetaEvent {
 mod tests {
     use super::*;
 
+    #[test]
+    fn notify_props_payload() {
+        let mut props = HashMap::new();
+        props.insert("desktop".to_string(), "none".to_string());
+        props.insert("mark_unread".to_string(), "mention".to_string());
+        let payload = NotifyProps {
+            channel_id: "c1",
+            user_id: "bot",
+            props: &props,
+        };
+
+        let expect = serde_json::json!({
+            "channel_id": "c1",
+            "user_id": "bot",
+            "desktop": "none",
+            "mark_unread": "mention",
+        });
+        assert_eq!(expect, serde_json::to_value(&payload).unwrap());
+    }
+
     #[test]
     fn post_valid() {
         let data = r#"{"event": "posted", "data": {"channel_display_name":"Town Square","channel_name":"town-square","channel_type":"O","post":"{\"id\":\"ghkm74cqzbnjxr5dx638k73xqa\",\"create_at\":1576937676623,\"update_at\":1576937676623,\"edit_at\":0,\"delete_at\":0,\"is_pinned\":false,\"user_id\":\"kh9859j8kir15dmxonsm8sxq1w\",\"channel_id\":\"amtak96j3br5iyokgunmf188jc\",\"root_id\":\"\",\"parent_id\":\"\",\"original_id\":\"\",\"message\":\"test\",\"type\":\"\",\"props\":{},\"hashtags\":\"\",\"pending_post_id\":\"kh9859j8kir15dmxonsm8sxq1w:1576937676569\",\"metadata\":{}}","sender_name":"@admin","team_id":"49ck75z1figmpjy6eknrohsjnw"}, "broadcast": {"omit_users":null,"user_id":"","channel_id":"amtak96j3br5iyokgunmf188jc","team_id":""}, "seq": 7}"#;
@@ -315,6 +660,17 @@ mod tests {
         let _invalid: MetaEvent = serde_json::from_str(data).unwrap();
     }
 
+    #[test]
+    fn channel_unread() {
+        let data = r#"{"team_id": "49ck75z1figmpjy6eknrohsjnw", "channel_id": "amtak96j3br5iyokgunmf188jc", "msg_count": 4, "mention_count": 1, "notify_props": {"desktop": "default", "mark_unread": "all"}}"#;
+        let unread: ChannelUnread = serde_json::from_str(data).unwrap();
+        let unread: gm::ChannelUnread = unread.into();
+        assert_eq!("49ck75z1figmpjy6eknrohsjnw", unread.team_id);
+        assert_eq!("amtak96j3br5iyokgunmf188jc", unread.channel_id);
+        assert_eq!(4, unread.msg_count);
+        assert_eq!(1, unread.mention_count);
+    }
+
     #[test]
     fn app_error() {
         let data = r#"{"status": "FAIL", "error": {"id": "api.web_socket_router.bad_seq.app_error", "message": "Invalid sequence for WebSocket message.", "detailed_error": "", "status_code": 400}}"#;
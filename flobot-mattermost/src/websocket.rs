@@ -1,20 +1,43 @@
 use super::models::MetaEvent;
+use flobot_lib::client::{Error, Listener, Result as ClientResult};
+use flobot_lib::lifecycle::Lifecycle;
 use flobot_lib::models::Event;
+use flobot_lib::stats::{Collector, Connection};
 use serde_json::json;
 use std::sync::mpsc::Sender as ChannelSender;
+use std::time::Duration;
 use ws::{connect, CloseCode, Handler, Handshake, Message, Sender};
 
 type Result = ws::Result<()>;
 
-struct MattermostWS {
-    out: Sender,
+/// Where a handler sends to the server: the ws::Sender of its connection.
+trait Out {
+    fn send(&self, msg: Message) -> Result;
+    fn close_with_reason(&self, code: CloseCode, reason: String) -> Result;
+}
+
+impl Out for Sender {
+    fn send(&self, msg: Message) -> Result {
+        Sender::send(self, msg)
+    }
+
+    fn close_with_reason(&self, code: CloseCode, reason: String) -> Result {
+        Sender::close_with_reason(self, code, reason)
+    }
+}
+
+struct MattermostWS<O> {
+    out: O,
     send: ChannelSender<Event>,
     token: String,
     seq: u64,
+    collector: Collector,
+    lifecycle: Lifecycle,
 }
 
-impl Handler for MattermostWS {
-    fn on_open(&mut self, _: Handshake) -> Result {
+impl<O: Out> MattermostWS<O> {
+    /// Authenticate the connection once it is open.
+    fn opened(&mut self) -> Result {
         self.seq += 1;
         let auth = json!({
             "action": "authentication_challenge",
@@ -25,10 +48,18 @@ impl Handler for MattermostWS {
 
         if res.is_ok() {
             println!("websocket connected!");
+            self.collector.connected();
+            self.lifecycle.connected();
         }
 
         res
     }
+}
+
+impl<O: Out> Handler for MattermostWS<O> {
+    fn on_open(&mut self, _: Handshake) -> Result {
+        self.opened()
+    }
 
     fn on_message(&mut self, msg: Message) -> Result {
         let txt = msg.as_text().unwrap();
@@ -42,46 +73,363 @@ impl Handler for MattermostWS {
             Ok(()) => Ok(()),
         }
     }
+
+    /// Disconnections are reported once connect() returned, see reconnect_loop.
+    fn on_close(&mut self, code: CloseCode, reason: &str) {
+        println!("websocket closed: {:?} {}", code, reason);
+    }
+}
+
+/// Tells if the websocket must be connected again once connect() returned res.
+/// IO errors and closed connections are retried unless reconnect is false.
+fn retry(reconnect: bool, res: ws::Result<()>) -> ClientResult<()> {
+    match res {
+        Err(e) => match e.kind {
+            ws::ErrorKind::Io(details) if reconnect => {
+                println!("websocket io error: {:?}", details);
+                Ok(())
+            }
+            e => Err(Error::Other(format!("websocket error: {:?}", e))),
+        },
+        Ok(()) if reconnect => Ok(()),
+        Ok(()) => Err(Error::Other("websocket closed".to_string())),
+    }
+}
+
+/// Delay between two connections, doubled after each failed one up to max.
+struct Backoff {
+    initial: Duration,
+    max: Duration,
+    next: Duration,
+}
+
+impl Backoff {
+    fn new(initial: Duration, max: Duration) -> Self {
+        Self {
+            initial,
+            max,
+            next: initial,
+        }
+    }
+
+    fn delay(&mut self) -> Duration {
+        let delay = self.next;
+        self.next = (self.next * 2).min(self.max);
+        delay
+    }
+
+    fn reset(&mut self) {
+        self.next = self.initial;
+    }
 }
 
-impl super::client::Mattermost {
-    pub fn listen(&self, sender: ChannelSender<Event>) {
+/// Call connect until it returns an error that cannot be recovered or, when reconnect
+/// is false, as soon as it returns. Waits for backoff between two connections, from
+/// its initial delay again once a connection succeeded.
+fn reconnect_loop<F>(
+    reconnect: bool,
+    collector: &Collector,
+    lifecycle: &Lifecycle,
+    backoff: &mut Backoff,
+    mut connect: F,
+) -> ClientResult<()>
+where
+    F: FnMut() -> ws::Result<()>,
+{
+    loop {
+        let res = connect();
+
+        // attempts that never connected are not disconnections.
+        if collector.snapshot().connection == Connection::Connected {
+            backoff.reset();
+            collector.disconnected();
+            lifecycle.disconnected();
+        }
+        if let Err(e) = &res {
+            collector.error(&format!("websocket: {}", e));
+        }
+
+        if let Err(e) = retry(reconnect, res) {
+            println!("websocket disconnected with unrecoverable error: {:?}", e);
+            return Err(e);
+        }
+
+        let delay = backoff.delay();
+        println!(
+            "websocket returned, retrying in {} seconds",
+            delay.as_secs()
+        );
+        std::thread::sleep(delay);
+    }
+}
+
+impl Listener for super::client::Mattermost {
+    /// Listen to events and send them to sender. Returns only on errors that cannot
+    /// be recovered or, when cfg.ws_reconnect is false, as soon as the connection drops.
+    fn listen(&self, sender: ChannelSender<Event>) -> ClientResult<()> {
         let mut url = self.cfg.ws_url.clone();
         url.push_str("/api/v4/websocket");
 
-        let reco_time = std::time::Duration::from_secs(5);
-        let mut retry = true;
-
-        while retry {
-            if let Err(e) = connect(url.clone(), |out| MattermostWS {
-                out,
-                send: sender.clone(),
-                token: self.cfg.token.clone(),
-                seq: 0,
-            }) {
-                match e.kind {
-                    ws::ErrorKind::Io(details) => {
-                        println!("websocket io error: {:?}", details);
-                    }
-                    e => {
-                        println!(
-                            "websocket disconnected with unrecoverable error: {:?}",
-                            e
-                        );
-                        retry = false;
+        reconnect_loop(
+            self.cfg.ws_reconnect,
+            &self.collector,
+            &self.lifecycle,
+            &mut Backoff::new(Duration::from_secs(1), Duration::from_secs(60)),
+            || {
+                connect(url.clone(), |out| MattermostWS {
+                    out,
+                    send: sender.clone(),
+                    token: self.cfg.token.clone(),
+                    seq: 0,
+                    collector: self.collector.clone(),
+                    lifecycle: self.lifecycle.clone(),
+                })
+            },
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::mpsc::channel;
+    use std::sync::{Arc, Mutex};
+
+    /// Out of a fake connection, recording what the handler sends.
+    #[derive(Clone, Default)]
+    struct Recorded {
+        sent: Arc<Mutex<Vec<String>>>,
+    }
+
+    impl Out for Recorded {
+        fn send(&self, msg: Message) -> Result {
+            self.sent.lock().unwrap().push(msg.as_text()?.to_string());
+            Ok(())
+        }
+
+        fn close_with_reason(&self, _code: CloseCode, reason: String) -> Result {
+            self.sent.lock().unwrap().push(format!("close: {}", reason));
+            Ok(())
+        }
+    }
+
+    fn io_error() -> ws::Result<()> {
+        Err(ws::Error {
+            kind: ws::ErrorKind::Io(std::io::Error::new(
+                std::io::ErrorKind::ConnectionReset,
+                "reset",
+            )),
+            details: "".into(),
+        })
+    }
+
+    #[test]
+    fn retry_reconnect() {
+        assert!(retry(true, io_error()).is_ok());
+        assert!(retry(true, Ok(())).is_ok());
+    }
+
+    #[test]
+    fn retry_fail_fast() {
+        assert!(retry(false, io_error()).is_err());
+        assert!(retry(false, Ok(())).is_err());
+    }
+
+    #[test]
+    fn retry_unrecoverable() {
+        let res = Err(ws::Error {
+            kind: ws::ErrorKind::Internal,
+            details: "".into(),
+        });
+        assert!(retry(true, res).is_err());
+    }
+
+    fn no_backoff() -> Backoff {
+        Backoff::new(Duration::from_millis(0), Duration::from_millis(0))
+    }
+
+    #[test]
+    fn backoff_delays() {
+        let mut backoff = Backoff::new(Duration::from_secs(1), Duration::from_secs(5));
+        let delays: Vec<_> = (0..5).map(|_| backoff.delay().as_secs()).collect();
+        assert_eq!(vec![1, 2, 4, 5, 5], delays);
+
+        backoff.reset();
+        assert_eq!(1, backoff.delay().as_secs());
+    }
+
+    #[test]
+    fn reconnect_backoff_reset() {
+        let collector = Collector::new();
+        let mut backoff =
+            Backoff::new(Duration::from_millis(1), Duration::from_millis(8));
+        let mut attempts = 0;
+        let res =
+            reconnect_loop(true, &collector, &Lifecycle::new(), &mut backoff, || {
+                attempts += 1;
+                match attempts {
+                    1..=3 => io_error(),
+                    4 => {
+                        collector.connected();
+                        io_error()
                     }
+                    _ => Err(ws::Error {
+                        kind: ws::ErrorKind::Internal,
+                        details: "".into(),
+                    }),
                 }
-            }
+            });
 
-            if retry {
-                println!(
-                    "websocket returned, retrying in {} seconds",
-                    reco_time.as_secs()
-                );
-                std::thread::sleep(reco_time);
-            } else {
-                return;
-            }
+        assert!(res.is_err());
+        // failures after the 4th attempt connected wait from the initial delay again.
+        assert_eq!(Duration::from_millis(2), backoff.next);
+    }
+
+    #[test]
+    fn reconnect_until_unrecoverable() {
+        let collector = Collector::new();
+        let mut attempts = 0;
+        let res = reconnect_loop(
+            true,
+            &collector,
+            &Lifecycle::new(),
+            &mut no_backoff(),
+            || {
+                attempts += 1;
+                match attempts {
+                    1 => io_error(),
+                    2 => Ok(()),
+                    _ => Err(ws::Error {
+                        kind: ws::ErrorKind::Internal,
+                        details: "".into(),
+                    }),
+                }
+            },
+        );
+
+        assert!(res.is_err());
+        assert_eq!(3, attempts);
+        assert!(collector.snapshot().last_error.is_some());
+    }
+
+    #[test]
+    fn reconnect_fail_fast() {
+        let collector = Collector::new();
+        let mut attempts = 0;
+        let res = reconnect_loop(
+            false,
+            &collector,
+            &Lifecycle::new(),
+            &mut no_backoff(),
+            || {
+                attempts += 1;
+                Ok(())
+            },
+        );
+
+        assert!(res.is_err());
+        assert_eq!(1, attempts);
+    }
+
+    #[test]
+    fn reconnect_lifecycle() {
+        let lifecycle = Lifecycle::new();
+        let calls = std::sync::Arc::new(std::sync::Mutex::new(vec![]));
+        let (c1, c2, c3) = (calls.clone(), calls.clone(), calls.clone());
+        lifecycle
+            .on_connect(move || c1.lock().unwrap().push("connect"))
+            .on_disconnect(move || c2.lock().unwrap().push("disconnect"))
+            .on_reconnect(move || c3.lock().unwrap().push("reconnect"));
+
+        // connection drops once, is restored, then the server is down.
+        let collector = Collector::new();
+        let mut attempts = 0;
+        let res =
+            reconnect_loop(true, &collector, &lifecycle, &mut no_backoff(), || {
+                attempts += 1;
+                if attempts > 4 {
+                    return Err(ws::Error {
+                        kind: ws::ErrorKind::Internal,
+                        details: "".into(),
+                    });
+                }
+                if attempts > 2 {
+                    return io_error();
+                }
+                collector.connected();
+                lifecycle.connected();
+                io_error()
+            });
+
+        assert!(res.is_err());
+        assert_eq!(
+            vec![
+                "connect",
+                "disconnect",
+                "connect",
+                "reconnect",
+                "disconnect"
+            ],
+            *calls.lock().unwrap()
+        );
+    }
+
+    #[test]
+    fn handler_reconnect() {
+        let lifecycle = Lifecycle::new();
+        let calls = Arc::new(Mutex::new(vec![]));
+        let (c1, c2, c3) = (calls.clone(), calls.clone(), calls.clone());
+        lifecycle
+            .on_connect(move || c1.lock().unwrap().push("connect"))
+            .on_disconnect(move || c2.lock().unwrap().push("disconnect"))
+            .on_reconnect(move || c3.lock().unwrap().push("reconnect"));
+        let collector = Collector::new();
+        let out = Recorded::default();
+        let (sender, receiver) = channel();
+
+        // each connection is opened, receives an event, then is closed by the server.
+        let mut attempts = 0;
+        let res =
+            reconnect_loop(true, &collector, &lifecycle, &mut no_backoff(), || {
+                attempts += 1;
+                if attempts > 2 {
+                    return Err(ws::Error {
+                        kind: ws::ErrorKind::Internal,
+                        details: "".into(),
+                    });
+                }
+                let mut handler = MattermostWS {
+                    out: out.clone(),
+                    send: sender.clone(),
+                    token: "token".to_string(),
+                    seq: 0,
+                    collector: collector.clone(),
+                    lifecycle: lifecycle.clone(),
+                };
+                handler.opened()?;
+                handler.on_message(Message::Text("{}".to_string()))?;
+                handler.on_close(CloseCode::Away, "server restart");
+                io_error()
+            });
+
+        assert!(res.is_err());
+        assert_eq!(
+            vec![
+                "connect",
+                "disconnect",
+                "connect",
+                "reconnect",
+                "disconnect"
+            ],
+            *calls.lock().unwrap()
+        );
+        assert_eq!(1, collector.snapshot().reconnects);
+        let sent = out.sent.lock().unwrap();
+        assert_eq!(2, sent.len());
+        for auth in sent.iter() {
+            assert!(auth.contains("authentication_challenge"));
+            assert!(auth.contains("\"seq\":1"));
         }
+        assert_eq!(2, receiver.try_iter().count());
     }
 }
@@ -1,6 +1,16 @@
 pub mod models;
+use chrono::{DateTime, Utc};
 use diesel::Connection;
+use flobot_lib::client::SentStore;
+use flobot_lib::middleware;
+use flobot_lib::models::Post;
+use flobot_lib::schedule::{self, Job};
+use serde::de::DeserializeOwned;
+use serde::Serialize;
+use serde_json::{json, Value};
 use std::convert::From;
+use std::sync::Arc;
+use std::time::Duration;
 
 use crate::db::models as business_models;
 
@@ -15,6 +25,7 @@ pub mod schema;
 pub enum Error {
     Database(String),
     Migration(String),
+    Json(String),
 }
 
 impl std::error::Error for Error {}
@@ -24,6 +35,7 @@ impl std::fmt::Display for Error {
         match self {
             Error::Migration(e) => write!(f, "Cannot run migrations: {}", e),
             Error::Database(e) => write!(f, "db::Error: {}", e),
+            Error::Json(e) => write!(f, "db::Error: invalid json value: {}", e),
         }
     }
 }
@@ -40,6 +52,12 @@ impl From<diesel_migrations::RunMigrationsError> for Error {
     }
 }
 
+impl From<serde_json::Error> for Error {
+    fn from(e: serde_json::Error) -> Self {
+        Error::Json(e.to_string())
+    }
+}
+
 pub type Result<T> = std::result::Result<T, Error>;
 
 pub trait Trigger {
@@ -105,6 +123,296 @@ pub trait SMS {
     ) -> Result<Vec<(business_models::SMSPrepare, business_models::SMSContact)>>;
 }
 
+/// Values by key, in namespaces that do not share keys. Handlers should use a
+/// Namespace rather than this trait directly.
+pub trait KV {
+    fn get(&self, namespace: &str, key: &str) -> Result<Option<String>>;
+    /// Replace the value of key, if any.
+    fn set(&self, namespace: &str, key: &str, value: &str) -> Result<()>;
+    fn del(&self, namespace: &str, key: &str) -> Result<()>;
+    fn keys(&self, namespace: &str) -> Result<Vec<String>>;
+    /// Set the value of key unless it has one, returns false if it had.
+    fn set_if_absent(&self, namespace: &str, key: &str, value: &str) -> Result<bool>;
+    /// Replace the value of key by new if it is old, returns false if it was not.
+    fn swap(&self, namespace: &str, key: &str, old: &str, new: &str) -> Result<bool>;
+    /// Add delta to the number stored at key, 0 when it has no value, and return
+    /// the result. It fails without changing the value if it is not a number.
+    fn increment(&self, namespace: &str, key: &str, delta: i64) -> Result<i64>;
+    /// Same as set, the value being deleted by purge once expired.
+    fn set_until(
+        &self,
+        namespace: &str,
+        key: &str,
+        value: &str,
+        expires: DateTime<Utc>,
+    ) -> Result<()>;
+    /// Same as set_if_absent, the value being deleted by purge once expired.
+    fn set_if_absent_until(
+        &self,
+        namespace: &str,
+        key: &str,
+        value: &str,
+        expires: DateTime<Utc>,
+    ) -> Result<bool>;
+    /// Delete the values of namespace expired at now, returns how many were.
+    fn purge(&self, namespace: &str, now: DateTime<Utc>) -> Result<usize>;
+}
+
+/// Namespace is the keyspace of a handler in a KV store, values can be stored as
+/// JSON with get_json and set_json.
+pub struct Namespace<K: KV> {
+    kv: Arc<K>,
+    name: String,
+}
+
+impl<K: KV> Namespace<K> {
+    pub fn new(kv: Arc<K>, name: &str) -> Self {
+        Self {
+            kv,
+            name: name.to_string(),
+        }
+    }
+
+    pub fn get(&self, key: &str) -> Result<Option<String>> {
+        self.kv.get(&self.name, key)
+    }
+
+    pub fn set(&self, key: &str, value: &str) -> Result<()> {
+        self.kv.set(&self.name, key, value)
+    }
+
+    pub fn del(&self, key: &str) -> Result<()> {
+        self.kv.del(&self.name, key)
+    }
+
+    pub fn keys(&self) -> Result<Vec<String>> {
+        self.kv.keys(&self.name)
+    }
+
+    pub fn set_if_absent(&self, key: &str, value: &str) -> Result<bool> {
+        self.kv.set_if_absent(&self.name, key, value)
+    }
+
+    pub fn swap(&self, key: &str, old: &str, new: &str) -> Result<bool> {
+        self.kv.swap(&self.name, key, old, new)
+    }
+
+    pub fn increment(&self, key: &str, delta: i64) -> Result<i64> {
+        self.kv.increment(&self.name, key, delta)
+    }
+
+    pub fn set_until(
+        &self,
+        key: &str,
+        value: &str,
+        expires: DateTime<Utc>,
+    ) -> Result<()> {
+        self.kv.set_until(&self.name, key, value, expires)
+    }
+
+    pub fn set_if_absent_until(
+        &self,
+        key: &str,
+        value: &str,
+        expires: DateTime<Utc>,
+    ) -> Result<bool> {
+        self.kv.set_if_absent_until(&self.name, key, value, expires)
+    }
+
+    pub fn purge(&self, now: DateTime<Utc>) -> Result<usize> {
+        self.kv.purge(&self.name, now)
+    }
+
+    pub fn get_json<T: DeserializeOwned>(&self, key: &str) -> Result<Option<T>> {
+        match self.get(key)? {
+            Some(value) => Ok(Some(serde_json::from_str(&value)?)),
+            None => Ok(None),
+        }
+    }
+
+    pub fn set_json<T: Serialize>(&self, key: &str, value: &T) -> Result<()> {
+        self.set(key, &serde_json::to_string(value)?)
+    }
+}
+
+/// Jobs are saved as JSON, by id.
+impl<K: KV> schedule::Store for Namespace<K> {
+    fn save(&self, job: &Job) -> std::result::Result<(), String> {
+        self.set(&job.id, &job.to_json()).map_err(|e| e.to_string())
+    }
+
+    fn delete(&self, id: &str) -> std::result::Result<(), String> {
+        self.del(id).map_err(|e| e.to_string())
+    }
+
+    fn load(&self) -> std::result::Result<Vec<Job>, String> {
+        let mut jobs = vec![];
+        for id in self.keys().map_err(|e| e.to_string())? {
+            if let Some(job) = self.get(&id).map_err(|e| e.to_string())? {
+                jobs.push(Job::from_json(&job).map_err(|e| e.to_string())?);
+            }
+        }
+        Ok(jobs)
+    }
+}
+
+/// Locks are keys expiring once their ttl elapsed. Expired locks are purged before
+/// taking one, so that they can be taken again and do not pile up.
+impl<K: KV> middleware::Lock for Namespace<K> {
+    fn acquire(
+        &self,
+        key: &str,
+        ttl: Duration,
+    ) -> std::result::Result<bool, middleware::Error> {
+        let lock_error = |e: Error| middleware::Error::Lock(e.to_string());
+        let now = Utc::now();
+        let expires = now + chrono::Duration::from_std(ttl).unwrap();
+        self.purge(now).map_err(lock_error)?;
+        self.set_if_absent_until(key, &expires.timestamp_millis().to_string(), expires)
+            .map_err(lock_error)
+    }
+}
+
+/// Sent posts are saved as JSON with the time they were sent, by key, expiring with
+/// their window. Expired posts are purged when a post is remembered.
+impl<K: KV + Send + Sync> SentStore for Namespace<K> {
+    fn sent(
+        &self,
+        key: &str,
+    ) -> std::result::Result<Option<(DateTime<Utc>, Post)>, String> {
+        match self.get(key).map_err(|e| e.to_string())? {
+            Some(sent) => sent_from_json(&sent).map(Some),
+            None => Ok(None),
+        }
+    }
+
+    fn remember(
+        &self,
+        key: &str,
+        at: DateTime<Utc>,
+        post: &Post,
+        window: Duration,
+    ) -> std::result::Result<(), String> {
+        self.purge(at).map_err(|e| e.to_string())?;
+        let expires = at + chrono::Duration::from_std(window).unwrap();
+        let sent = json!({
+            "at": at.to_rfc3339(),
+            "post": {
+                "id": post.id,
+                "channel_id": post.channel_id,
+                "team_id": post.team_id,
+                "user_id": post.user_id,
+                "root_id": post.root_id,
+                "parent_id": post.parent_id,
+                "message": post.message,
+            },
+        });
+        self.set_until(key, &sent.to_string(), expires)
+            .map_err(|e| e.to_string())
+    }
+}
+
+fn sent_from_json(data: &str) -> std::result::Result<(DateTime<Utc>, Post), String> {
+    let invalid = |what: &str| format!("invalid sent post {}: {}", what, data);
+    let v: Value = serde_json::from_str(data).map_err(|_| invalid("json"))?;
+    let string = |pointer: &str| {
+        v.pointer(pointer)
+            .and_then(Value::as_str)
+            .map(String::from)
+            .ok_or_else(|| invalid(pointer))
+    };
+    let at = DateTime::parse_from_rfc3339(&string("/at")?)
+        .map(|t| t.with_timezone(&Utc))
+        .map_err(|_| invalid("/at"))?;
+    let mut post = Post::with_message(&string("/post/message")?);
+    post.id = string("/post/id")?;
+    post.channel_id = string("/post/channel_id")?;
+    post.team_id = string("/post/team_id")?;
+    post.user_id = string("/post/user_id")?;
+    post.root_id = string("/post/root_id")?;
+    post.parent_id = string("/post/parent_id")?;
+    Ok((at, post))
+}
+
 pub fn conn(db_url: &str) -> DatabaseConnection {
     return DatabaseConnection::establish(db_url).expect("db connection");
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use flobot_lib::middleware::Lock;
+    use serde::Deserialize;
+
+    #[derive(Debug, Deserialize, PartialEq, Serialize)]
+    struct Score {
+        user: String,
+        points: u32,
+    }
+
+    #[test]
+    fn namespace_isolation() {
+        let kv = Arc::new(sqlite::memory());
+        let jobs = Namespace::new(kv.clone(), "jobs");
+        let locks = Namespace::new(kv.clone(), "locks");
+
+        jobs.set("a", "job").unwrap();
+        assert_eq!(None, locks.get("a").unwrap());
+        assert!(locks.set_if_absent("a", "lock").unwrap());
+        assert_eq!(Some("job".to_string()), jobs.get("a").unwrap());
+        assert_eq!(vec!["a"], locks.keys().unwrap());
+    }
+
+    #[test]
+    fn namespace_json() {
+        let scores = Namespace::new(Arc::new(sqlite::memory()), "scores");
+        let score = Score {
+            user: "john".to_string(),
+            points: 3,
+        };
+        scores.set_json("john", &score).unwrap();
+        assert_eq!(Some(score), scores.get_json("john").unwrap());
+        assert_eq!(None, scores.get_json::<Score>("jane").unwrap());
+
+        scores.set("jane", "not json").unwrap();
+        match scores.get_json::<Score>("jane") {
+            Err(Error::Json(_)) => {}
+            res => panic!("expected a json error, got {:?}", res),
+        }
+    }
+
+    #[test]
+    fn lock_expired() {
+        let locks = Namespace::new(Arc::new(sqlite::memory()), "locks");
+        let minute = Duration::from_secs(60);
+        assert!(locks.acquire("post-1", minute).unwrap());
+        assert!(!locks.acquire("post-1", minute).unwrap());
+
+        assert!(locks.acquire("post-2", Duration::from_millis(0)).unwrap());
+        assert!(locks.acquire("post-2", Duration::from_millis(0)).unwrap());
+        // taking another lock purges the expired ones.
+        assert!(locks.acquire("post-3", minute).unwrap());
+        assert_eq!(vec!["post-1", "post-3"], locks.keys().unwrap());
+    }
+
+    #[test]
+    fn sent_expired() {
+        let sent = Namespace::new(Arc::new(sqlite::memory()), "sent_posts");
+        let window = Duration::from_secs(60);
+        let start = Utc::now();
+        let mut post = Post::with_message("report ready");
+        post.id = "post-1".to_string();
+
+        sent.remember("report", start, &post, window).unwrap();
+        let (at, found) = sent.sent("report").unwrap().unwrap();
+        assert_eq!(start.timestamp(), at.timestamp());
+        assert_eq!("post-1", found.id);
+        assert_eq!("report ready", found.message);
+
+        // purged once its window elapsed, when another post is remembered.
+        let later = start + chrono::Duration::seconds(61);
+        sent.remember("other", later, &post, window).unwrap();
+        assert!(sent.sent("report").unwrap().is_none());
+        assert_eq!(vec!["other"], sent.keys().unwrap());
+    }
+}
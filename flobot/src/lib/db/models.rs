@@ -1,5 +1,6 @@
 use crate::db::schema::blague;
 use crate::db::schema::edits;
+use crate::db::schema::kv;
 use crate::db::schema::sms_contact;
 use crate::db::schema::sms_prepare;
 use crate::db::schema::trigger;
@@ -31,6 +32,16 @@ pub struct NewJoke<'a> {
     pub text: &'a str,
 }
 
+#[derive(Insertable)]
+#[table_name = "kv"]
+pub struct NewKV<'a> {
+    pub namespace: &'a str,
+    pub key: &'a str,
+    pub value: &'a str,
+    /// milliseconds since epoch, see KV::purge.
+    pub expires_at: Option<i64>,
+}
+
 #[derive(Insertable)]
 #[table_name = "sms_contact"]
 pub struct NewSMSContact<'a> {
@@ -97,3 +108,12 @@ pub struct SMSPrepare {
     pub name: String,
     pub text: String,
 }
+
+#[derive(Debug, Queryable)]
+pub struct KV {
+    pub id: i32,
+    pub namespace: String,
+    pub key: String,
+    pub value: String,
+    pub expires_at: Option<i64>,
+}
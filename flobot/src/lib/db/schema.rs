@@ -17,6 +17,16 @@ table! {
     }
 }
 
+table! {
+    kv (id) {
+        id -> Integer,
+        namespace -> Text,
+        key -> Text,
+        value -> Text,
+        expires_at -> Nullable<BigInt>,
+    }
+}
+
 table! {
     sms_contact (id) {
         id -> Integer,
@@ -50,4 +60,11 @@ table! {
 
 joinable!(sms_prepare -> sms_contact (sms_contact_id));
 
-allow_tables_to_appear_in_same_query!(blague, edits, sms_contact, sms_prepare, trigger,);
+allow_tables_to_appear_in_same_query!(
+    blague,
+    edits,
+    kv,
+    sms_contact,
+    sms_prepare,
+    trigger,
+);
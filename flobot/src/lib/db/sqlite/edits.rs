@@ -9,7 +9,7 @@ impl crate::db::Edits for super::Sqlite {
             .filter(table::team_id.eq(team_id))
             .order_by(table::user_id) // user edits first, then team
             .order_by(table::edit)
-            .load::<Edit>(&*self.db.lock().unwrap())?);
+            .load::<Edit>(&*self.conn()?)?);
     }
 
     /// Find the first Edit available, sorted by user_id, then team_id, and matching edit parameter.
@@ -44,7 +44,7 @@ impl crate::db::Edits for super::Sqlite {
                     .and(table::edit.eq(edit.trim())),
             )
             .order_by(table::user_id) // user edits first, then team
-            .first::<Edit>(&*self.db.lock().unwrap());
+            .first::<Edit>(&*self.conn()?);
 
         match res {
             Ok(edit) => Ok(Some(edit)),
@@ -56,7 +56,7 @@ impl crate::db::Edits for super::Sqlite {
     fn del_team(&self, team_id: &str, edit: &str) -> Result<()> {
         let filter =
             table::edits.filter(table::team_id.eq(team_id).and(table::edit.eq(edit)));
-        let _ = diesel::delete(filter).execute(&*self.db.lock().unwrap())?;
+        let _ = diesel::delete(filter).execute(&*self.conn()?)?;
         Ok(())
     }
 
@@ -71,7 +71,7 @@ impl crate::db::Edits for super::Sqlite {
 
         let _ = diesel::insert_into(table::edits)
             .values(&edit_)
-            .execute(&*self.db.lock().unwrap())?;
+            .execute(&*self.conn()?)?;
         Ok(())
     }
 }
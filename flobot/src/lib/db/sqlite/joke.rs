@@ -8,7 +8,7 @@ impl crate::db::Joke for super::Sqlite {
         let filter = table::blague
             .filter(table::team_id.eq(team_id))
             .offset(relnum as i64);
-        match filter.first(&*self.db.lock().unwrap()) {
+        match filter.first(&*self.conn()?) {
             Ok(b) => Ok(Some(b)),
             Err(e) => match e {
                 diesel::result::Error::NotFound => Ok(None),
@@ -21,7 +21,7 @@ impl crate::db::Joke for super::Sqlite {
         let filter = table::blague.filter(table::team_id.eq(team_id));
         let res: i64 = filter
             .select(diesel::dsl::count_star())
-            .first(&*self.db.lock().unwrap())?;
+            .first(&*self.conn()?)?;
         Ok(res as u64)
     }
 
@@ -29,13 +29,13 @@ impl crate::db::Joke for super::Sqlite {
         return Ok(table::blague
             .filter(table::team_id.eq(team_id))
             .order_by(table::id.asc())
-            .load::<Joke>(&*self.db.lock().unwrap())?);
+            .load::<Joke>(&*self.conn()?)?);
     }
 
     fn del(&self, team_id: &str, id: i32) -> Result<()> {
         let filter =
             table::blague.filter(table::team_id.eq(team_id).and(table::id.eq(id)));
-        let _ = diesel::delete(filter).execute(&*self.db.lock().unwrap())?;
+        let _ = diesel::delete(filter).execute(&*self.conn()?)?;
         Ok(())
     }
 
@@ -46,7 +46,7 @@ impl crate::db::Joke for super::Sqlite {
         };
         let _ = diesel::insert_into(table::blague)
             .values(&new_blague)
-            .execute(&*self.db.lock().unwrap())?;
+            .execute(&*self.conn()?)?;
         Ok(())
     }
 }
@@ -0,0 +1,262 @@
+use crate::db::models::{NewKV, KV};
+use crate::db::schema::kv::dsl as table;
+use crate::db::Error;
+use crate::db::Result;
+use chrono::{DateTime, Utc};
+use diesel::prelude::*;
+
+impl crate::db::KV for super::Sqlite {
+    fn get(&self, namespace: &str, key: &str) -> Result<Option<String>> {
+        let filter =
+            table::kv.filter(table::namespace.eq(namespace).and(table::key.eq(key)));
+        match filter.first::<KV>(&*self.conn()?) {
+            Ok(kv) => Ok(Some(kv.value)),
+            Err(diesel::NotFound) => Ok(None),
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    fn set(&self, namespace: &str, key: &str, value: &str) -> Result<()> {
+        let new_kv = NewKV {
+            namespace: namespace,
+            key: key,
+            value: value,
+            expires_at: None,
+        };
+        let _ = diesel::replace_into(table::kv)
+            .values(&new_kv)
+            .execute(&*self.conn()?)?;
+        Ok(())
+    }
+
+    fn del(&self, namespace: &str, key: &str) -> Result<()> {
+        let filter =
+            table::kv.filter(table::namespace.eq(namespace).and(table::key.eq(key)));
+        let _ = diesel::delete(filter).execute(&*self.conn()?)?;
+        Ok(())
+    }
+
+    fn set_if_absent(&self, namespace: &str, key: &str, value: &str) -> Result<bool> {
+        let new_kv = NewKV {
+            namespace: namespace,
+            key: key,
+            value: value,
+            expires_at: None,
+        };
+        // ignored when (namespace, key) is already taken.
+        let inserted = diesel::insert_or_ignore_into(table::kv)
+            .values(&new_kv)
+            .execute(&*self.conn()?)?;
+        Ok(inserted == 1)
+    }
+
+    fn set_until(
+        &self,
+        namespace: &str,
+        key: &str,
+        value: &str,
+        expires: DateTime<Utc>,
+    ) -> Result<()> {
+        let new_kv = NewKV {
+            namespace: namespace,
+            key: key,
+            value: value,
+            expires_at: Some(expires.timestamp_millis()),
+        };
+        let _ = diesel::replace_into(table::kv)
+            .values(&new_kv)
+            .execute(&*self.conn()?)?;
+        Ok(())
+    }
+
+    fn set_if_absent_until(
+        &self,
+        namespace: &str,
+        key: &str,
+        value: &str,
+        expires: DateTime<Utc>,
+    ) -> Result<bool> {
+        let new_kv = NewKV {
+            namespace: namespace,
+            key: key,
+            value: value,
+            expires_at: Some(expires.timestamp_millis()),
+        };
+        let inserted = diesel::insert_or_ignore_into(table::kv)
+            .values(&new_kv)
+            .execute(&*self.conn()?)?;
+        Ok(inserted == 1)
+    }
+
+    fn purge(&self, namespace: &str, now: DateTime<Utc>) -> Result<usize> {
+        let filter = table::kv.filter(
+            table::namespace
+                .eq(namespace)
+                .and(table::expires_at.le(now.timestamp_millis())),
+        );
+        Ok(diesel::delete(filter).execute(&*self.conn()?)?)
+    }
+
+    fn swap(&self, namespace: &str, key: &str, old: &str, new: &str) -> Result<bool> {
+        let filter = table::kv.filter(
+            table::namespace
+                .eq(namespace)
+                .and(table::key.eq(key))
+                .and(table::value.eq(old)),
+        );
+        let updated = diesel::update(filter)
+            .set(table::value.eq(new))
+            .execute(&*self.conn()?)?;
+        Ok(updated == 1)
+    }
+
+    fn increment(&self, namespace: &str, key: &str, delta: i64) -> Result<i64> {
+        let db = &*self.conn()?;
+        db.transaction::<_, Error, _>(|| {
+            let filter = || {
+                table::kv.filter(table::namespace.eq(namespace).and(table::key.eq(key)))
+            };
+            let current = match filter().select(table::value).first::<String>(db) {
+                Ok(value) => Some(value.parse::<i64>().map_err(|e| {
+                    Error::Database(format!("{} is not a number: {}", key, e))
+                })?),
+                Err(diesel::NotFound) => None,
+                Err(e) => return Err(e.into()),
+            };
+
+            let value = current.unwrap_or(0) + delta;
+            match current {
+                // the expiry of the value, if any, is kept.
+                Some(_) => diesel::update(filter())
+                    .set(table::value.eq(value.to_string()))
+                    .execute(db)?,
+                None => diesel::insert_into(table::kv)
+                    .values(&NewKV {
+                        namespace: namespace,
+                        key: key,
+                        value: &value.to_string(),
+                        expires_at: None,
+                    })
+                    .execute(db)?,
+            };
+            Ok(value)
+        })
+    }
+
+    fn keys(&self, namespace: &str) -> Result<Vec<String>> {
+        Ok(table::kv
+            .filter(table::namespace.eq(namespace))
+            .order_by(table::key.asc())
+            .select(table::key)
+            .load(&*self.conn()?)?)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::db::sqlite::memory;
+    use crate::db::KV;
+    use chrono::{Duration, Utc};
+    use std::sync::Arc;
+
+    #[test]
+    fn kv_get_set_del() {
+        let kv = memory();
+        assert_eq!(None, kv.get("jobs", "a").unwrap());
+
+        kv.set("jobs", "a", "1").unwrap();
+        kv.set("jobs", "b", "2").unwrap();
+        kv.set("jobs", "a", "3").unwrap();
+        assert_eq!(Some("3".to_string()), kv.get("jobs", "a").unwrap());
+        assert_eq!(vec!["a", "b"], kv.keys("jobs").unwrap());
+
+        kv.del("jobs", "a").unwrap();
+        kv.del("jobs", "missing").unwrap();
+        assert_eq!(None, kv.get("jobs", "a").unwrap());
+        assert_eq!(vec!["b"], kv.keys("jobs").unwrap());
+    }
+
+    #[test]
+    fn kv_namespaces() {
+        let kv = memory();
+        kv.set("jobs", "a", "job").unwrap();
+        kv.set("locks", "a", "lock").unwrap();
+
+        assert_eq!(Some("job".to_string()), kv.get("jobs", "a").unwrap());
+        assert_eq!(Some("lock".to_string()), kv.get("locks", "a").unwrap());
+        kv.del("jobs", "a").unwrap();
+        assert_eq!(Some("lock".to_string()), kv.get("locks", "a").unwrap());
+        assert!(kv.keys("jobs").unwrap().is_empty());
+    }
+
+    #[test]
+    fn kv_set_if_absent() {
+        let kv = memory();
+        assert!(kv.set_if_absent("locks", "a", "1").unwrap());
+        assert!(!kv.set_if_absent("locks", "a", "2").unwrap());
+        assert!(kv.set_if_absent("other", "a", "3").unwrap());
+        assert_eq!(Some("1".to_string()), kv.get("locks", "a").unwrap());
+    }
+
+    #[test]
+    fn kv_swap() {
+        let kv = memory();
+        assert!(!kv.swap("locks", "a", "1", "2").unwrap());
+        assert_eq!(None, kv.get("locks", "a").unwrap());
+
+        kv.set("locks", "a", "1").unwrap();
+        assert!(!kv.swap("locks", "a", "0", "2").unwrap());
+        assert!(kv.swap("locks", "a", "1", "2").unwrap());
+        assert!(!kv.swap("locks", "a", "1", "3").unwrap());
+        assert_eq!(Some("2".to_string()), kv.get("locks", "a").unwrap());
+    }
+
+    #[test]
+    fn kv_increment() {
+        let kv = Arc::new(memory());
+        assert_eq!(2, kv.increment("polls", "yes", 2).unwrap());
+        assert_eq!(-1, kv.increment("other", "yes", -1).unwrap());
+        kv.set("polls", "text", "nope").unwrap();
+        assert!(kv.increment("polls", "text", 1).is_err());
+        assert_eq!(Some("nope".to_string()), kv.get("polls", "text").unwrap());
+
+        let threads: Vec<_> = (0..8)
+            .map(|_| {
+                let kv = kv.clone();
+                std::thread::spawn(move || {
+                    for _ in 0..25 {
+                        kv.increment("polls", "yes", 1).unwrap();
+                    }
+                })
+            })
+            .collect();
+        for t in threads {
+            t.join().unwrap();
+        }
+        assert_eq!(Some("202".to_string()), kv.get("polls", "yes").unwrap());
+        assert_eq!(199, kv.increment("polls", "yes", -3).unwrap());
+    }
+
+    #[test]
+    fn kv_purge() {
+        let kv = memory();
+        let now = Utc::now();
+        kv.set("locks", "replaced", "1").unwrap();
+        assert!(kv
+            .set_if_absent_until("locks", "expired", "2", now)
+            .unwrap());
+        assert!(!kv
+            .set_if_absent_until("locks", "expired", "3", now)
+            .unwrap());
+        assert!(kv
+            .set_if_absent_until("locks", "later", "4", now + Duration::minutes(1))
+            .unwrap());
+        assert!(kv.set_if_absent_until("other", "a", "5", now).unwrap());
+        kv.set_until("locks", "replaced", "6", now).unwrap();
+        kv.set("locks", "later", "7").unwrap();
+
+        assert_eq!(2, kv.purge("locks", now).unwrap());
+        assert_eq!(vec!["later"], kv.keys("locks").unwrap());
+        assert_eq!(vec!["a"], kv.keys("other").unwrap());
+    }
+}
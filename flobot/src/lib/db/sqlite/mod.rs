@@ -1,13 +1,43 @@
+use crate::db::{Error, Result};
 use diesel::SqliteConnection;
-use std::sync::Mutex;
+use std::ops::Deref;
+use std::sync::{Mutex, MutexGuard};
 
 pub struct Sqlite {
-    db: Mutex<SqliteConnection>,
+    /// None once closed.
+    db: Mutex<Option<SqliteConnection>>,
+}
+
+/// Connection of a Sqlite, locked until dropped.
+struct Conn<'a>(MutexGuard<'a, Option<SqliteConnection>>);
+
+impl Deref for Conn<'_> {
+    type Target = SqliteConnection;
+
+    fn deref(&self) -> &SqliteConnection {
+        self.0.as_ref().expect("checked by Sqlite::conn")
+    }
 }
 
 impl Sqlite {
     pub fn new(db: SqliteConnection) -> Self {
-        Self { db: Mutex::new(db) }
+        Self {
+            db: Mutex::new(Some(db)),
+        }
+    }
+
+    /// Connection to query the database with, an error once closed.
+    fn conn(&self) -> Result<Conn<'_>> {
+        let db = self.db.lock().unwrap();
+        match *db {
+            Some(_) => Ok(Conn(db)),
+            None => Err(Error::Database("database closed".to_string())),
+        }
+    }
+
+    /// Close the connection, releasing the database file. Queries fail afterwards.
+    pub fn close(&self) {
+        self.db.lock().unwrap().take();
     }
 }
 
@@ -16,7 +46,56 @@ pub fn new(db: SqliteConnection) -> Sqlite {
     Sqlite::new(db)
 }
 
+#[cfg(test)]
+diesel_migrations::embed_migrations!();
+
+/// Database in memory with the migrations run, for tests.
+#[cfg(test)]
+pub fn memory() -> Sqlite {
+    use diesel::Connection;
+    let conn = SqliteConnection::establish(":memory:").expect("db connection");
+    embedded_migrations::run(&conn).expect("migrations");
+    Sqlite::new(conn)
+}
+
 mod edits;
 mod joke;
+mod kv;
 mod sms;
 mod trigger;
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db::KV;
+
+    /// File descriptors of this process opened on path.
+    #[cfg(target_os = "linux")]
+    fn opened(path: &std::path::Path) -> usize {
+        std::fs::read_dir("/proc/self/fd")
+            .unwrap()
+            .filter_map(|fd| std::fs::read_link(fd.ok()?.path()).ok())
+            .filter(|target| target == path)
+            .count()
+    }
+
+    #[test]
+    #[cfg(target_os = "linux")]
+    fn close() {
+        use diesel::Connection;
+        let path = std::env::temp_dir().join("flobot-sqlite-close.db");
+        let _ = std::fs::remove_file(&path);
+        let conn = SqliteConnection::establish(path.to_str().unwrap()).unwrap();
+        embedded_migrations::run(&conn).unwrap();
+        let db = Sqlite::new(conn);
+        db.set("jobs", "a", "1").unwrap();
+        assert_eq!(1, opened(&path));
+
+        db.close();
+        assert_eq!(0, opened(&path));
+        assert!(db.get("jobs", "a").is_err());
+        assert!(db.set("jobs", "b", "2").is_err());
+        db.close();
+        std::fs::remove_file(path).unwrap();
+    }
+}
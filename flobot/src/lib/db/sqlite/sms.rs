@@ -12,7 +12,7 @@ impl crate::db::SMS for super::Sqlite {
         name: &str,
         number: &str,
     ) -> Result<SMSContact> {
-        let db = &*self.db.lock().unwrap();
+        let db = &*self.conn()?;
         db.transaction::<(), Error, _>(|| {
             let res = tc::sms_contact
                 .filter(tc::team_id.eq(team_id).and(tc::name.eq(name)))
@@ -57,7 +57,7 @@ impl crate::db::SMS for super::Sqlite {
         Ok(tc::sms_contact
             .filter(tc::team_id.eq(team_id))
             .order_by(tc::name)
-            .load(&*self.db.lock().unwrap())?)
+            .load(&*self.conn()?)?)
     }
 
     fn set_prepare(
@@ -68,7 +68,7 @@ impl crate::db::SMS for super::Sqlite {
         name: &str,
         text: &str,
     ) -> Result<SMSPrepare> {
-        let db = &*self.db.lock().unwrap();
+        let db = &*self.conn()?;
         db.transaction::<_, Error, _>(|| {
             let res = tp::sms_prepare
                 .filter(
@@ -120,7 +120,7 @@ impl crate::db::SMS for super::Sqlite {
             .filter(tp::team_id.eq(team_id))
             .order_by(tp::trigname)
             .inner_join(tc::sms_contact)
-            .load(&*self.db.lock().unwrap())?;
+            .load(&*self.conn()?)?;
         Ok(res)
     }
 
@@ -138,7 +138,7 @@ impl crate::db::SMS for super::Sqlite {
         if let Some(id) = id {
             query = query.filter(tc::id.eq(id));
         }
-        match query.first(&*self.db.lock().unwrap()) {
+        match query.first(&*self.conn()?) {
             Ok(contact) => Ok(Some(contact)),
             Err(diesel::NotFound) => Ok(None),
             Err(e) => Err(e.into()),
@@ -148,7 +148,7 @@ impl crate::db::SMS for super::Sqlite {
     fn get_prepare(&self, team_id: &str, trigname: &str) -> Result<Option<SMSPrepare>> {
         match tp::sms_prepare
             .filter(tp::team_id.eq(team_id).and(tp::trigname.eq(trigname)))
-            .first(&*self.db.lock().unwrap())
+            .first(&*self.conn()?)
         {
             Ok(prepare) => Ok(Some(prepare)),
             Err(diesel::NotFound) => Ok(None),
@@ -8,14 +8,14 @@ impl crate::db::Trigger for super::Sqlite {
         return Ok(table::trigger
             .filter(table::team_id.eq(team_id))
             .order(table::triggered_by.asc())
-            .load::<Trigger>(&*self.db.lock().unwrap())?);
+            .load::<Trigger>(&*self.conn()?)?);
     }
 
     fn search(&self, team_id: &str) -> Result<Vec<Trigger>> {
         Ok(table::trigger
             .filter(table::team_id.eq(team_id))
             .order_by(table::text_) // emojis first -> all emoji triggers processed first, then text
-            .load::<Trigger>(&*self.db.lock().unwrap())?)
+            .load::<Trigger>(&*self.conn()?)?)
     }
 
     fn add_text(&self, team_id: &str, trigger_: &str, text_: &str) -> Result<()> {
@@ -28,7 +28,7 @@ impl crate::db::Trigger for super::Sqlite {
 
         let _ = diesel::insert_into(table::trigger)
             .values(&new_trigger)
-            .execute(&*self.db.lock().unwrap())?;
+            .execute(&*self.conn()?)?;
         Ok(())
     }
 
@@ -42,7 +42,7 @@ impl crate::db::Trigger for super::Sqlite {
 
         let _ = diesel::insert_into(table::trigger)
             .values(&new_trigger)
-            .execute(&*self.db.lock().unwrap())?;
+            .execute(&*self.conn()?)?;
         Ok(())
     }
 
@@ -50,8 +50,8 @@ impl crate::db::Trigger for super::Sqlite {
         let filter = table::triggered_by
             .eq(trigger_)
             .and(table::team_id.eq(team_id_));
-        let _ = diesel::delete(table::trigger.filter(filter))
-            .execute(&*self.db.lock().unwrap())?;
+        let _ =
+            diesel::delete(table::trigger.filter(filter)).execute(&*self.conn()?)?;
         Ok(())
     }
 }
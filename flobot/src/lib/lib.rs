@@ -17,6 +17,7 @@ impl From<db::Error> for HandlerError {
     fn from(e: db::Error) -> Self {
         match e {
             db::Error::Migration(e) => HandlerError::Other(e),
+            db::Error::Json(e) => HandlerError::Other(e),
             db::Error::Database(e) => HandlerError::Database(e),
         }
     }
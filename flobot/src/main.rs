@@ -1,5 +1,7 @@
 #[macro_use]
 extern crate diesel_migrations;
+use chrono::{Duration as CDuration, Utc};
+use chrono_tz::Tz;
 use dotenv;
 use flobot::db;
 use flobot::joke;
@@ -8,19 +10,30 @@ use flobot::{
     edits::Edit as HandlerEdit, pinterest::Pinterest, sms,
     trigger::Trigger as HandlerTrigger, werewolf::Handler as HandlerWW,
 };
-use flobot_lib::client::Getter;
+use flobot_lib::admin::Admin;
+use flobot_lib::client::{Getter, Listener};
+use flobot_lib::command::{Arg, Command, Router};
 use flobot_lib::conf::Conf;
-use flobot_lib::handler::MutexedHandler;
-use flobot_lib::instance::Instance;
+use flobot_lib::dialog::Dialogs;
+use flobot_lib::handler::{Error as HandlerError, MutexedHandler, Replier};
+use flobot_lib::instance::{Instance, Stopper};
+use flobot_lib::lifecycle::Announcer;
+use flobot_lib::limit::{Budgeted, PostBudget};
+use flobot_lib::log::Logger;
 use flobot_lib::middleware;
-use flobot_lib::models::Event;
+use flobot_lib::schedule::{Action, Jobs};
+use flobot_lib::shed::Shedder;
 use flobot_lib::task::*;
 use flobot_lib::tempo::Tempo;
 use flobot_mattermost::client::Mattermost;
+use flobot_mattermost::dialog::Callback;
 use signal_libc::signal::{self, Signal};
 use simple_server as ss;
 use std::env;
 use std::fs;
+use std::io::{self, BufRead, BufReader, Write};
+use std::net::{TcpListener, TcpStream};
+use std::sync::atomic::{AtomicBool, Ordering};
 use std::sync::mpsc::channel;
 use std::sync::Arc;
 use std::thread;
@@ -66,7 +79,6 @@ fn bot() -> std::result::Result<(), Box<dyn std::error::Error>> {
 
     dotenv::from_filename("flobot.env").ok();
     let cfg = Conf::new().expect("cfg err");
-    let mm = Mattermost::new(cfg.clone())?;
 
     let db_url: &str = &cfg.db_url;
 
@@ -77,14 +89,109 @@ fn bot() -> std::result::Result<(), Box<dyn std::error::Error>> {
     println!("init");
 
     // BASICS
-    let mm_client = Mattermost::new(cfg.clone())?;
+    // a single client, cloned for handlers and the listener so they share limits.
+    let logger = Logger::new(cfg.log_level, cfg.log_sample);
+    let mm_client = Mattermost::new(cfg.clone())?.with_logger(logger.clone());
     let mut instance = Instance::new(mm_client.clone());
+    let mm_client = mm_client
+        .with_collector(instance.collector())
+        .with_lifecycle(instance.lifecycle());
+    instance.set_logger(logger.clone());
+    if let Ok(millis) = env::var("BOT_SLOW_HANDLER_MILLIS") {
+        instance.set_slow_threshold(Duration::from_millis(millis.parse().unwrap()));
+    }
+    instance
+        .lifecycle()
+        .on_reconnect(|| println!("websocket connection restored"))
+        .on_shutdown(|| println!("instance shut down"));
+    if let Ok(message) = env::var("BOT_RECONNECT_ANNOUNCE") {
+        let cooldown = Duration::from_secs(
+            env::var("BOT_RECONNECT_ANNOUNCE_COOLDOWN_SECONDS")
+                .unwrap_or("300".to_string())
+                .parse()
+                .unwrap(),
+        );
+        let announcer = Announcer::new(mm_client.clone(), &message, cooldown)
+            .with_logger(logger.clone());
+        instance.lifecycle().on_reconnect(move || {
+            announcer.announce();
+        });
+    }
+
+    // FLAGS
+    if let Ok(path) = env::var("BOT_FLAGS_FILE") {
+        instance.set_flags_file(&path);
+        instance.reload_flags()?;
+        println!("flags loaded from {}, reload with SIGUSR1", path);
+    }
+    if env::var("BOT_FLAGGED_HANDLERS").map_or(false, |v| v == "true") {
+        println!("only handlers flagged as handler.<name> are enabled");
+        instance.set_flagged_handlers(true);
+    }
+
+    // PROFILE
+    if let Ok(name) = env::var("BOT_DISPLAY_NAME") {
+        if let Err(e) = mm_client.set_display_name(&name) {
+            println!("cannot set display name: {:?}", e);
+        }
+    }
+
+    if let Ok(path) = env::var("BOT_ICON_PATH") {
+        match fs::File::open(&path) {
+            Ok(icon) => {
+                if let Err(e) = mm_client.set_icon(icon) {
+                    println!("cannot set icon: {:?}", e);
+                }
+            }
+            Err(e) => println!("cannot open icon {}: {:?}", path, e),
+        }
+    }
     let botdb = Arc::new(db::sqlite::new(conn));
+    // posts sent once by key are remembered in the db, across restarts.
+    let mm_client =
+        mm_client.with_sent_store(db::Namespace::new(botdb.clone(), "sent_posts"));
 
     // TASKRUNNER
     let mut taskrunner = SequentialTaskRunner::new();
     taskrunner.add(Arc::new(Tick {}));
 
+    // EVENTS
+    let (sender, receiver) = channel();
+    instance.set_event_sender(sender.clone());
+
+    // SHEDDING
+    // the listener sends to events, forwarded to the instance unless shed.
+    let events = match env::var("BOT_SHED_THRESHOLD") {
+        Ok(threshold) => {
+            let mut shedder =
+                Shedder::new(threshold.parse().unwrap(), instance.collector());
+            if let Ok(kinds) = env::var("BOT_SHED_EVENTS") {
+                shedder = shedder
+                    .with_low(kinds.split_whitespace().map(String::from).collect());
+            }
+            println!("shed low priority events past {} queued events", threshold);
+            instance.set_shedder(shedder.clone());
+            let (events, received) = channel();
+            let sender = sender.clone();
+            let _shed_t = thread::spawn(move || shedder.forward(received, sender));
+            events
+        }
+        Err(_) => sender.clone(),
+    };
+
+    // POST BUDGET
+    // handlers send through client, so that the budget caps what they post per event.
+    let budget = match env::var("BOT_POST_BUDGET") {
+        Ok(max) => {
+            let budget = PostBudget::new(max.parse().unwrap());
+            println!("handlers send at most {} posts per event", max);
+            instance.set_post_budget(budget.clone());
+            budget
+        }
+        Err(_) => PostBudget::new(usize::MAX),
+    };
+    let client = Budgeted::new(mm_client.clone(), budget);
+
     // MIDDLEWARE
     let ignore_self =
         middleware::IgnoreSelf::new(mm_client.my_user_id().to_string().clone());
@@ -93,6 +200,86 @@ fn bot() -> std::result::Result<(), Box<dyn std::error::Error>> {
     }
     instance.add_middleware(Box::new(ignore_self));
 
+    if let Ok(ttl) = env::var("BOT_DEDUPE_SECONDS") {
+        let ttl = Duration::from_secs(ttl.parse().unwrap());
+        println!("handle each post in a single bot process sharing the database");
+        let locks = db::Namespace::new(botdb.clone(), "locks");
+        instance.add_middleware(Box::new(middleware::Dedupe::new(locks, ttl)));
+    }
+
+    let recent = env::var("BOT_RECENT_EVENTS").ok().map(|size| {
+        let recent = middleware::Recent::new(size.parse().unwrap())
+            .with_admins(cfg.admin_users.clone());
+        instance.add_middleware(Box::new(recent.clone()));
+        if cfg.admin_users.is_empty() {
+            println!("keep the last {} events for the admin api", size);
+        } else {
+            println!("keep the last {} events for !debug events", size);
+            let debug = Replier::new(recent.clone(), client.clone());
+            instance.add_post_handler(Box::new(debug));
+        }
+        recent
+    });
+
+    if let Ok(team_id) = env::var("BOT_ONLY_TEAM_ID") {
+        println!("only process events from team {}", team_id);
+        instance.add_middleware(Box::new(middleware::TeamOnly::new(&team_id)));
+    }
+
+    if env::var("BOT_CHANNEL_KINDS").map_or(false, |v| v == "true") {
+        println!("resolve the kind of channel of posts, for handlers on channel kinds");
+        instance
+            .add_middleware(Box::new(middleware::ChannelType::new(mm_client.clone())));
+    }
+
+    if let Ok(max) = env::var("BOT_MAX_MESSAGE_BYTES") {
+        let max = max.parse().unwrap();
+        println!("ignore messages longer than {} bytes", max);
+        instance.add_middleware(Box::new(middleware::MaxLength::new(
+            max,
+            Some(mm_client.clone()),
+        )));
+    }
+
+    if let Ok(names) = env::var("BOT_TRIGGER_NAMES") {
+        let names: Vec<String> = names.split_whitespace().map(String::from).collect();
+        println!("addressed as {:?}", names);
+        instance.add_middleware(Box::new(middleware::Addressed::new(names)));
+    }
+
+    if let Ok(prefixes) = env::var("BOT_QUOTE_PREFIXES") {
+        let prefixes: Vec<String> =
+            prefixes.split_whitespace().map(String::from).collect();
+        println!("ignore commands quoted with {:?}", prefixes);
+        instance.add_middleware(Box::new(middleware::StripQuotes::new(prefixes, true)));
+    }
+
+    if let Ok(windows) = env::var("BOT_BUSINESS_HOURS") {
+        let tz: Tz = env::var("BOT_BUSINESS_HOURS_TZ")
+            .unwrap_or("UTC".to_string())
+            .parse()
+            .unwrap();
+        let schedule = middleware::Schedule::parse(tz, &windows).unwrap();
+        let reply = env::var("BOT_BUSINESS_HOURS_REPLY")
+            .ok()
+            .map(|reply| (mm_client.clone(), reply));
+        println!("only process messages during business hours {:?}", schedule);
+        instance
+            .add_middleware(Box::new(middleware::BusinessHours::new(schedule, reply)));
+    }
+
+    if let Ok(millis) = env::var("BOT_EDITS_DEBOUNCE_MILLIS") {
+        let edits_debounce = Duration::from_millis(millis.parse().unwrap());
+        println!(
+            "edits debounced with a window of {} milliseconds",
+            edits_debounce.as_millis()
+        );
+        instance.add_middleware(Box::new(
+            middleware::Debounce::new(edits_debounce, sender.clone())
+                .with_logger(logger.clone()),
+        ));
+    }
+
     // TRIGGER
     let trigger_delay_secs = Duration::from_secs(
         std::env::var("BOT_TRIGGER_DELAY_SECONDS")
@@ -106,14 +293,14 @@ fn bot() -> std::result::Result<(), Box<dyn std::error::Error>> {
     );
     let trigger = HandlerTrigger::new(
         botdb.clone(),
-        mm_client.clone(),
+        client.clone(),
         Tempo::new(),
         trigger_delay_secs,
     );
     instance.add_post_handler(Box::new(trigger));
 
     // EDIT
-    let edits = HandlerEdit::new(botdb.clone(), mm_client.clone());
+    let edits = HandlerEdit::new(botdb.clone(), client.clone());
     instance.add_post_handler(Box::new(edits));
 
     // JOKES
@@ -175,12 +362,11 @@ fn bot() -> std::result::Result<(), Box<dyn std::error::Error>> {
         );
     }
 
-    let handler_joke =
-        joke::Handler::new(botdb.clone(), jokeprovider, mm_client.clone());
+    let handler_joke = joke::Handler::new(botdb.clone(), jokeprovider, client.clone());
     instance.add_post_handler(Box::new(MutexedHandler::from(handler_joke)));
 
     // WEREWOLF GAME
-    let ww = HandlerWW::new(mm_client.clone());
+    let ww = HandlerWW::new(client.clone());
     instance.add_post_handler(Box::new(MutexedHandler::from(ww)));
 
     // SMS
@@ -189,7 +375,7 @@ fn bot() -> std::result::Result<(), Box<dyn std::error::Error>> {
         env::var("BOT_OCTOPUSH_APIKEY"),
     ) {
         let smsprov = sms::Octopush::new(&login, &apikey);
-        let sms = sms::SMS::new(smsprov, botdb.clone(), mm_client.clone());
+        let sms = sms::SMS::new(smsprov, botdb.clone(), client.clone());
         instance.add_post_handler(Box::new(sms));
     }
 
@@ -205,14 +391,61 @@ fn bot() -> std::result::Result<(), Box<dyn std::error::Error>> {
         );
     }
 
+    // JOBS
+    let jobs = Jobs::new(
+        mm_client.clone(),
+        Arc::new(db::Namespace::new(botdb.clone(), "jobs")),
+    )?
+    .with_logger(logger.clone());
+    println!("exec jobs in {:?}", taskrunner.add(Arc::new(jobs.clone())));
+    if env::var("BOT_REMINDERS").map_or(false, |v| v == "true") {
+        if cfg.admin_users.is_empty() {
+            println!(
+                "reminders are open to everyone, set BOT_ADMIN_USERS to restrict them"
+            );
+        }
+        let mut reminders = Router::new("remind", client.clone());
+        reminders.add(
+            Command::new(
+                "remind",
+                "post message here in minutes",
+                move |post, args| {
+                    let minutes = args.integer("minutes").unwrap();
+                    let message = args.get("message").unwrap().to_string();
+                    jobs.at(
+                        Utc::now() + CDuration::minutes(minutes),
+                        &post.channel_id,
+                        Action::Post(message),
+                    )
+                    .map_err(|e| HandlerError::Other(e.to_string()))?;
+                    Ok(())
+                },
+            )
+            // up to a year, so that the reminder time cannot overflow.
+            .arg(Arg::integer("minutes").range(1, 525600))
+            .arg(Arg::text("message"))
+            .allow_users(cfg.admin_users.clone()),
+        );
+        instance.add_router(reminders);
+    }
+
     // RUN FOREVER
     println!("launch bot!");
-    let (sender, receiver) = channel();
+    let stopper = instance.stopper();
+    let listener_failed = Arc::new(AtomicBool::new(false));
     let _listener_t = {
-        let sender = sender.clone();
+        let mm = mm_client.clone();
+        let sender = events.clone();
+        let stopper = stopper.clone();
+        let failed = listener_failed.clone();
         thread::spawn(move || {
             println!("launch client thread");
-            mm.listen(sender);
+            if let Err(e) = mm.listen(sender) {
+                // stop, and exit with an error so that the supervisor restarts the bot.
+                println!("client thread returned with error: {:?}", e);
+                failed.store(true, Ordering::SeqCst);
+                graceful_stop(&stopper);
+            }
             println!("client thread returned");
         })
     };
@@ -227,7 +460,23 @@ fn bot() -> std::result::Result<(), Box<dyn std::error::Error>> {
         })
     };
 
+    // ADMIN
+    let instance = Arc::new(instance);
+    let admin = env::var("BOT_ADMIN_TOKEN").ok().map(|token| {
+        let mut admin = Admin::new(&token, &instance);
+        if env::var("BOT_FLAGS_FILE").is_ok() {
+            let shared = instance.clone();
+            admin = admin.with_flags_reload(move || shared.reload_flags());
+        }
+        if let Some(recent) = &recent {
+            admin = admin.with_recent(recent.clone());
+        }
+        Arc::new(admin)
+    });
+
+    let ready = instance.ready();
     let instance_t = {
+        let instance = instance.clone();
         thread::spawn(move || {
             if let Err(e) = instance.run(receiver) {
                 println!("instance returned with error: {:?}", e);
@@ -252,34 +501,168 @@ fn bot() -> std::result::Result<(), Box<dyn std::error::Error>> {
         });
     }
 
+    // stopped with the instance, unlike the other servers.
+    let admin_stop = Arc::new(AtomicBool::new(false));
+    let admin_t = admin.map(|admin| {
+        let addr = env::var("BOT_ADMIN_ADDR").unwrap_or("localhost:6800".to_string());
+        let listener = TcpListener::bind(&addr).expect("BOT_ADMIN_ADDR");
+        let stop = admin_stop.clone();
+        thread::spawn(move || {
+            println!("launch admin api on {}", addr);
+            serve_admin(&admin, listener, &stop);
+            println!("admin api stopped");
+        })
+    });
+
+    // DIALOGS
+    // handlers opening dialogs register them here, the callback serves their
+    // submissions.
+    let dialogs = Dialogs::new();
+    match env::var("BOT_DIALOG_SECRET") {
+        Ok(_) if dialogs.is_empty() => {
+            println!("no dialog registered, dialog callback not started")
+        }
+        Ok(secret) => {
+            let callback = Callback::new(dialogs, &secret);
+            let addr =
+                env::var("BOT_DIALOG_ADDR").unwrap_or("localhost:6801".to_string());
+            let _dialog_t = thread::spawn(move || {
+                let server = ss::Server::new(
+                    move |request: ss::Request<Vec<u8>>,
+                          mut response: ss::ResponseBuilder|
+                          -> ss::ResponseResult {
+                        let (status, body) = callback.handle(
+                            request.method().as_str(),
+                            request.uri().path(),
+                            request.body(),
+                        );
+                        Ok(response
+                            .status(status)
+                            .header("Content-Type", "application/json")
+                            .body(body.into_bytes())?)
+                    },
+                );
+                let (host, port) = addr.split_once(':').expect("BOT_DIALOG_ADDR");
+                println!("launch dialog callback on {}", addr);
+                server.listen(host, port);
+            });
+        }
+        Err(_) => {}
+    }
+
+    // servers are started first, so that they do not wait for the connection.
+    if ready.wait(Duration::from_secs(30)) {
+        println!("instance ready");
+    } else {
+        println!("instance not ready after 30 seconds");
+    }
+
     println!("wire signals");
     signal::register(Signal::SIGINT);
     signal::register(Signal::SIGTERM);
+    signal::register(Signal::SIGUSR1);
 
     let stop_instance_t = {
-        let sender = sender.clone();
         thread::spawn(move || {
             loop {
                 match signal::recv() {
                     Some(Signal::OTHER(_)) => {}
                     Some(Signal::SIGINT) | Some(Signal::SIGTERM) | None => break,
+                    Some(Signal::SIGUSR1) => match instance.reload_flags() {
+                        Ok(()) => println!("flags reloaded"),
+                        Err(e) => println!("cannot reload flags: {}", e),
+                    },
                     _ => {}
                 }
             }
 
-            while sender.send(Event::Shutdown).is_err() {}
             println!("graceful stop asked");
+            graceful_stop(&stopper);
         })
     };
 
-    println!("graceful stop: {:?}", stop_instance_t.join());
+    println!("instance thread returned: {:?}", instance_t.join());
+    if let Some(admin_t) = admin_t {
+        admin_stop.store(true, Ordering::SeqCst);
+        println!("admin thread returned: {:?}", admin_t.join());
+    }
     taskrunner.stop();
     println!("taskrunner thread returned: {:?}", taskrunner_t.join());
-    println!("instance thread returned: {:?}", instance_t.join());
+    // closed once the instance and the tasks using it stopped.
+    botdb.close();
+    if listener_failed.load(Ordering::SeqCst) {
+        return Err("client thread returned with error".into());
+    }
+    println!("graceful stop: {:?}", stop_instance_t.join());
 
     Ok(())
 }
 
+fn graceful_stop(stopper: &Stopper) {
+    match stopper.stop(Duration::from_secs(10)) {
+        Some(dropped) => println!("graceful stop: {} events dropped", dropped),
+        None => println!("instance did not stop in time"),
+    }
+}
+
+/// Answer admin requests on listener, one at a time, until stop is set.
+fn serve_admin(admin: &Admin, listener: TcpListener, stop: &AtomicBool) {
+    if let Err(e) = listener.set_nonblocking(true) {
+        println!("admin api not started: {}", e);
+        return;
+    }
+    while !stop.load(Ordering::SeqCst) {
+        match listener.accept() {
+            Ok((stream, _)) => {
+                if let Err(e) = answer_admin(admin, stream) {
+                    println!("admin api request failed: {}", e);
+                }
+            }
+            Err(e) if e.kind() == io::ErrorKind::WouldBlock => {
+                thread::sleep(Duration::from_millis(100))
+            }
+            Err(e) => println!("admin api cannot accept: {}", e),
+        }
+    }
+}
+
+fn answer_admin(admin: &Admin, mut stream: TcpStream) -> io::Result<()> {
+    stream.set_nonblocking(false)?;
+    stream.set_read_timeout(Some(Duration::from_secs(5)))?;
+    let mut reader = BufReader::new(stream.try_clone()?);
+    let mut request = String::new();
+    reader.read_line(&mut request)?;
+    let mut parts = request.split_whitespace();
+    let method = parts.next().unwrap_or_default();
+    let path = parts
+        .next()
+        .and_then(|target| target.split('?').next())
+        .unwrap_or_default();
+
+    let mut authorization = None;
+    loop {
+        let mut header = String::new();
+        if reader.read_line(&mut header)? == 0 || header.trim().is_empty() {
+            break;
+        }
+        if let Some((name, value)) = header.split_once(':') {
+            if name.eq_ignore_ascii_case("authorization") {
+                authorization = Some(value.trim().to_string());
+            }
+        }
+    }
+
+    let reply = admin.handle(method, path, authorization.as_deref());
+    write!(
+        stream,
+        "HTTP/1.1 {} \r\nContent-Type: application/json\r\nContent-Length: {}\r\n\
+        Connection: close\r\n\r\n{}",
+        reply.status,
+        reply.body.len(),
+        reply.body
+    )
+}
+
 fn main() -> std::result::Result<(), Box<dyn std::error::Error>> {
     bot()
 }
@@ -0,0 +1,2 @@
+-- This file should undo anything in `up.sql`
+DROP TABLE kv;
\ No newline at end of file
@@ -0,0 +1,8 @@
+-- Your SQL goes here
+CREATE TABLE kv (
+    id integer primary key not null,
+    namespace varchar(256) not null,
+    key varchar(256) not null,
+    value text not null,
+    UNIQUE(namespace, key)
+);
@@ -0,0 +1,12 @@
+-- This file should undo anything in `up.sql`
+DROP INDEX kv_expires_at;
+CREATE TABLE kv_old (
+    id integer primary key not null,
+    namespace varchar(256) not null,
+    key varchar(256) not null,
+    value text not null,
+    UNIQUE(namespace, key)
+);
+INSERT INTO kv_old (id, namespace, key, value) SELECT id, namespace, key, value FROM kv;
+DROP TABLE kv;
+ALTER TABLE kv_old RENAME TO kv;
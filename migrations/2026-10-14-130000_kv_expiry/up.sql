@@ -0,0 +1,3 @@
+-- Your SQL goes here
+ALTER TABLE kv ADD COLUMN expires_at bigint;
+CREATE INDEX kv_expires_at ON kv (namespace, expires_at);